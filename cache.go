@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
@@ -28,16 +29,45 @@ var (
 )
 
 type responseCache struct {
-	Status int
-	Header http.Header
-	Data   []byte
+	Status  int
+	Header  http.Header
+	Data    []byte
+	Created time.Time
+	// Chunks is the number of chunks holding the body of large responses,
+	// stored apart under chunkKey, and Size the length of that body
+	Chunks int
+	Size   int64
 }
 
+// size returns the length of the body of the response
+func (cache *responseCache) size() int64 {
+	if cache.Chunks > 0 {
+		return cache.Size
+	}
+	return int64(len(cache.Data))
+}
+
+// responseChunk is a part of the body of a chunked response. Created tells
+// which response the chunk belongs to.
+type responseChunk struct {
+	Data    []byte
+	Created time.Time
+}
+
+// DefaultChunkSize is the size of the chunks of the responses that are too
+// large to be stored as a single entry
+const DefaultChunkSize = 512 * 1024
+
 // RegisterResponseCacheGob registers the responseCache type with the encoding/gob package
 func RegisterResponseCacheGob() {
 	gob.Register(responseCache{})
+	gob.Register(responseChunk{})
 }
 
+// cachedWriter passes the response on to the client and keeps it for the
+// cache. The body is kept in memory up to chunkSize, and stored chunk by
+// chunk beyond that, so that large and streamed responses are never held in
+// full. Nothing is visible in the cache until commit stores the response.
 type cachedWriter struct {
 	gin.ResponseWriter
 	status  int
@@ -45,6 +75,25 @@ type cachedWriter struct {
 	store   persistence.CacheStore
 	expire  time.Duration
 	key     string
+	created time.Time
+
+	// statuses are the rules of WithStatusTTL and WithoutStatus
+	statuses  []statusRule
+	maxAge    time.Duration
+	chunkSize int
+	// maxBodySize limits the size of the cached responses when positive
+	maxBodySize int64
+	// shouldCache, when set, tells whether the response may be cached
+	shouldCache ShouldCacheResponse
+	// ttl is the expiration of the response, depending on its status
+	ttl time.Duration
+	// body holds what was written since the last stored chunk
+	body     []byte
+	chunks   int
+	size     int64
+	buffered bool
+	// failed is set when the response can't be cached anymore
+	failed bool
 }
 
 var _ gin.ResponseWriter = &cachedWriter{}
@@ -68,8 +117,20 @@ func urlEscape(prefix string, u string) string {
 	return buffer.String()
 }
 
+// chunkKey returns the key of a chunk of the response cached under key
+func chunkKey(key string, chunk int) string {
+	return key + "#" + strconv.Itoa(chunk)
+}
+
 func newCachedWriter(store persistence.CacheStore, expire time.Duration, writer gin.ResponseWriter, key string) *cachedWriter {
-	return &cachedWriter{writer, 0, false, store, expire, key}
+	return &cachedWriter{
+		ResponseWriter: writer,
+		store:          store,
+		expire:         expire,
+		key:            key,
+		created:        time.Now(),
+		chunkSize:      DefaultChunkSize,
+	}
 }
 
 func (w *cachedWriter) WriteHeader(code int) {
@@ -88,32 +149,98 @@ func (w *cachedWriter) Written() bool {
 
 func (w *cachedWriter) Write(data []byte) (int, error) {
 	ret, err := w.ResponseWriter.Write(data)
-	if err == nil {
-		store := w.store
-		var cache responseCache
-		if err := store.Get(w.key, &cache); err == nil {
-			data = append(cache.Data, data...)
+	if err != nil {
+		// the client is gone, the response is incomplete
+		w.failed = true
+	} else if ttl, ok := statusExpire(w.statuses, w.Status(), w.expire); ok {
+		w.buffer(data[:ret], ttl)
+	}
+	return ret, err
+}
+
+// buffer keeps data for the cache, storing the chunks that are full. The
+// response is cached for ttl.
+func (w *cachedWriter) buffer(data []byte, ttl time.Duration) {
+	if w.failed {
+		return
+	}
+	w.buffered, w.ttl = true, ttl
+	w.size += int64(len(data))
+	if w.maxBodySize > 0 && w.size > w.maxBodySize {
+		w.abandon()
+		return
+	}
+	w.body = append(w.body, data...)
+	for len(w.body) > w.chunkSize {
+		chunk := responseChunk{w.body[:w.chunkSize], w.created}
+		if err := w.store.Set(chunkKey(w.key, w.chunks), chunk, w.chunkExpire()); err != nil {
+			w.abandon()
+			return
 		}
+		w.chunks++
+		// the stored chunk may be kept as is by in-memory stores
+		w.body = append([]byte(nil), w.body[w.chunkSize:]...)
+	}
+}
 
-		//cache responses with a status code < 300
-		if w.Status() < 300 {
-			// Remove the disallowed headers prior to caching
-			cleanedHeaders := cloneHeadersForCache(w.Header())
+// commit stores the response once the handler is done. The entry of a chunked
+// response is stored after its chunks, so that it is never found without them.
+func (w *cachedWriter) commit() {
+	// a partial response isn't the page
+	if !w.buffered || w.failed || w.Status() == http.StatusPartialContent {
+		w.abandon()
+		return
+	}
+	val := responseCache{
+		Status:  w.Status(),
+		Header:  cloneHeadersForCache(w.Header()),
+		Data:    w.body,
+		Created: w.created,
+	}
+	if w.shouldCache != nil {
+		body := w.body
+		if w.chunks > 0 {
+			body = nil
+		}
+		if !w.shouldCache(val.Status, w.Header(), body) {
+			w.abandon()
+			return
+		}
+	}
+	if w.chunks > 0 {
+		if err := w.store.Set(chunkKey(w.key, w.chunks), responseChunk{w.body, w.created}, w.chunkExpire()); err != nil {
+			w.abandon()
+			return
+		}
+		w.chunks++
+		val.Data, val.Chunks, val.Size = nil, w.chunks, w.size
+	}
+	if err := w.store.Set(w.key, val, w.ttl); err != nil {
+		w.abandon()
+	}
+}
 
-			// Set the response in the cache
-			val := responseCache{
-				w.Status(),
-				cleanedHeaders,
-				data,
-			}
+// chunkExpire is the expiration of the chunks of the response. Sliding only
+// pushes back the expiration of the entry, so its chunks have to last as long
+// as it may.
+func (w *cachedWriter) chunkExpire() time.Duration {
+	if w.maxAge > 0 {
+		return w.maxAge
+	}
+	return w.ttl
+}
 
-			err = store.Set(w.key, val, w.expire)
-			if err != nil {
-				// need logger
-			}
+// abandon gives up caching the response, deleting the chunks stored so far
+func (w *cachedWriter) abandon() {
+	if w.chunks > 0 {
+		keys := make([]string, w.chunks)
+		for i := range keys {
+			keys[i] = chunkKey(w.key, i)
 		}
+		persistence.DeleteMulti(w.store, keys...)
 	}
-	return ret, err
+	w.failed = true
+	w.body, w.chunks = nil, 0
 }
 
 func cloneHeadersForCache(headers http.Header) http.Header {
@@ -132,22 +259,235 @@ func cloneHeadersForCache(headers http.Header) http.Header {
 
 func (w *cachedWriter) WriteString(data string) (n int, err error) {
 	ret, err := w.ResponseWriter.WriteString(data)
-	//cache responses with a status code < 300
-	if err == nil && w.Status() < 300 {
-		// Remove the disallowed headers prior to caching
-		cleanedHeaders := cloneHeadersForCache(w.Header())
-
-		store := w.store
-		val := responseCache{
-			w.Status(),
-			cleanedHeaders,
-			[]byte(data),
-		}
-		store.Set(w.key, val, w.expire)
+	if err != nil {
+		w.failed = true
+	} else if ttl, ok := statusExpire(w.statuses, w.Status(), w.expire); ok {
+		w.buffer([]byte(data[:ret]), ttl)
 	}
 	return ret, err
 }
 
+// Option configures the CachePage family of decorators
+type Option func(*pageConfig)
+
+type pageConfig struct {
+	// maxAge enables sliding expiration when positive
+	maxAge    time.Duration
+	chunkSize int
+	statuses  []statusRule
+
+	requestPredicates  []ShouldCacheRequest
+	responsePredicates []ShouldCacheResponse
+	maxBodySize        int64
+}
+
+// statusRule sets whether, and for how long, responses with a status code
+// from min to max are cached
+type statusRule struct {
+	min, max int
+	ttl      time.Duration
+	cache    bool
+}
+
+func newPageConfig(opts []Option) *pageConfig {
+	cfg := &pageConfig{chunkSize: DefaultChunkSize}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// WithSlidingExpiration turns the expire duration of the decorator into an
+// idle timeout: every hit pushes the expiration of the entry back by expire,
+// until maxAge after the handler produced it. The expiration is refreshed with
+// Touch when the store supports it, or by rewriting the entry otherwise.
+func WithSlidingExpiration(maxAge time.Duration) Option {
+	return func(cfg *pageConfig) {
+		cfg.maxAge = maxAge
+	}
+}
+
+// WithChunkSize sets the size of the chunks of the responses larger than
+// size, DefaultChunkSize by default. Such responses are stored as several
+// entries while the handler writes them, and streamed back from the store on
+// hits, so that neither holds the whole body in memory. The chunk size must
+// fit in a single entry of the store, like the 1MB of memcached.
+func WithChunkSize(size int) Option {
+	return func(cfg *pageConfig) {
+		if size > 0 {
+			cfg.chunkSize = size
+		}
+	}
+}
+
+// WithStatusTTL caches the responses with a status code from min to max, both
+// included, for ttl rather than for the expire duration of the decorator. ttl
+// follows the conventions of the stores, persistence.DEFAULT and
+// persistence.FOREVER included. Once WithStatusTTL is used, only the responses
+// matching a rule are cached; without it, responses with a status code below
+// 300 are, for expire. The last matching rule wins, so that a single code can
+// be set apart from its range:
+//
+//	CachePage(store, 10*time.Minute, handler,
+//		WithStatusTTL(200, 299, 10*time.Minute),
+//		WithStatusTTL(301, 301, time.Hour),
+//		WithStatusTTL(404, 404, 30*time.Second),
+//	)
+func WithStatusTTL(min, max int, ttl time.Duration) Option {
+	return func(cfg *pageConfig) {
+		cfg.statuses = append(cfg.statuses, statusRule{min: min, max: max, ttl: ttl, cache: true})
+	}
+}
+
+// WithoutStatus never caches the responses with a status code from min to
+// max, both included, whatever the rules set before
+func WithoutStatus(min, max int) Option {
+	return func(cfg *pageConfig) {
+		cfg.statuses = append(cfg.statuses, statusRule{min: min, max: max})
+	}
+}
+
+// statusExpire tells whether a response with status is cached according to
+// rules, and for how long. Responses with a status code below 300 are cached
+// for expire unless WithStatusTTL was used.
+func statusExpire(rules []statusRule, status int, expire time.Duration) (time.Duration, bool) {
+	ttls := false
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		if rule.min <= status && status <= rule.max {
+			return rule.ttl, rule.cache
+		}
+		ttls = ttls || rule.cache
+	}
+	return expire, !ttls && status < 300
+}
+
+// newWriter returns the writer caching the response of a miss
+func (cfg *pageConfig) newWriter(store persistence.CacheStore, expire time.Duration, writer gin.ResponseWriter, key string) *cachedWriter {
+	w := newCachedWriter(store, expire, writer, key)
+	w.chunkSize = cfg.chunkSize
+	w.statuses = cfg.statuses
+	w.maxAge = cfg.maxAge
+	w.maxBodySize = cfg.maxBodySize
+	if len(cfg.responsePredicates) > 0 {
+		w.shouldCache = cfg.shouldCacheResponse
+	}
+	return w
+}
+
+// slide pushes back the expiration of a cached entry that was just hit. It
+// returns false, after deleting the entry, if the entry outlived maxAge.
+func (cfg *pageConfig) slide(store persistence.CacheStore, key string, expire time.Duration, cache *responseCache) bool {
+	if cfg.maxAge <= 0 {
+		return true
+	}
+	remaining := cfg.maxAge - time.Since(cache.Created)
+	if remaining <= 0 {
+		store.Delete(key)
+		return false
+	}
+
+	ttl := expire
+	if ttl <= 0 || remaining < ttl {
+		// some stores only have a one second resolution, and treat 0 as forever
+		ttl = (remaining + time.Second - 1) / time.Second * time.Second
+	}
+	if err := persistence.Touch(store, key, ttl); err == persistence.ErrNotSupport {
+		store.Set(key, *cache, ttl)
+	}
+	return true
+}
+
+// setAgeHeader sets the Age header of a cached response from the time it was
+// created, or from the time its entry has left in the store for responses
+// cached without a creation time
+func setAgeHeader(c *gin.Context, store persistence.CacheStore, key string, expire time.Duration, cache *responseCache) {
+	if !cache.Created.IsZero() {
+		c.Writer.Header().Set("Age", strconv.Itoa(int(time.Since(cache.Created)/time.Second)))
+		return
+	}
+	if expire <= 0 {
+		return
+	}
+	ttl, err := persistence.TTL(store, key)
+	if err != nil || ttl < 0 || ttl > expire {
+		return
+	}
+	c.Writer.Header().Set("Age", strconv.Itoa(int((expire-ttl)/time.Second)))
+}
+
+// loadChunk gets a chunk of the response cached under key, and fails with
+// ErrCacheMiss if the chunk belongs to another response
+func loadChunk(store persistence.CacheStore, key string, i int, cache *responseCache) ([]byte, error) {
+	var chunk responseChunk
+	if err := store.Get(chunkKey(key, i), &chunk); err != nil {
+		return nil, err
+	}
+	if !chunk.Created.Equal(cache.Created) {
+		return nil, persistence.ErrCacheMiss
+	}
+	return chunk.Data, nil
+}
+
+// loadFirstChunk gets the first chunk of a chunked response into its Data, so
+// that a response whose chunks were evicted is a miss rather than a truncated
+// hit. It drops such responses from the store.
+func loadFirstChunk(store persistence.CacheStore, key string, cache *responseCache) error {
+	if cache.Chunks == 0 {
+		return nil
+	}
+	data, err := loadChunk(store, key, 0, cache)
+	if err == persistence.ErrCacheMiss {
+		store.Delete(key)
+	}
+	cache.Data = data
+	return err
+}
+
+// writeCachedBody writes the body of a cached response, loaded with
+// loadFirstChunk
+func writeCachedBody(c *gin.Context, store persistence.CacheStore, key string, cache *responseCache) {
+	if cache.Chunks > 0 {
+		c.Writer.Header().Set("Content-Length", strconv.FormatInt(cache.Size, 10))
+	}
+	writeCachedRange(c, c.Writer, store, key, cache, 0, cache.size())
+}
+
+// writeCachedRange writes the bytes of the body of a cached response from
+// start up to end to w. The chunks of large responses are read from the store
+// one at a time, and no more are read once the client is gone. A chunk
+// evicted meanwhile truncates the response, which is dropped from the store.
+func writeCachedRange(c *gin.Context, w io.Writer, store persistence.CacheStore, key string, cache *responseCache, start, end int64) {
+	if cache.Chunks == 0 {
+		w.Write(cache.Data[start:end])
+		return
+	}
+	// every chunk but the last one is as large as the first
+	chunkSize := int64(len(cache.Data))
+	for i := start / chunkSize; i < int64(cache.Chunks) && i*chunkSize < end; i++ {
+		data := cache.Data
+		if i > 0 {
+			c.Writer.Flush()
+			if c.Request.Context().Err() != nil {
+				return
+			}
+			var err error
+			if data, err = loadChunk(store, key, int(i), cache); err != nil {
+				if err != persistence.ErrCacheMiss {
+					log.Println(err.Error())
+				}
+				store.Delete(key)
+				return
+			}
+		}
+		offset := i * chunkSize
+		lo, hi := max(start-offset, 0), min(end-offset, int64(len(data)))
+		if _, err := w.Write(data[lo:hi]); err != nil {
+			return
+		}
+	}
+}
+
 // Cache Middleware
 func Cache(store *persistence.CacheStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -161,7 +501,11 @@ func SiteCache(store persistence.CacheStore, expire time.Duration) gin.HandlerFu
 		var cache responseCache
 		url := c.Request.URL
 		key := CreateKey(url.RequestURI())
-		if err := store.Get(key, &cache); err != nil {
+		err := store.Get(key, &cache)
+		if err == nil {
+			err = loadFirstChunk(store, key, &cache)
+		}
+		if err != nil {
 			c.Next()
 		} else {
 			cleanedHeaders := cloneHeadersForCache(cache.Header)
@@ -171,95 +515,40 @@ func SiteCache(store persistence.CacheStore, expire time.Duration) gin.HandlerFu
 					c.Writer.Header().Set(k, v)
 				}
 			}
-			c.Writer.Write(cache.Data)
+			setAgeHeader(c, store, key, expire, &cache)
+			writeCachedBody(c, store, key, &cache)
 		}
 	}
 }
 
 // CachePage Decorator
-func CachePage(store persistence.CacheStore, expire time.Duration, handle gin.HandlerFunc) gin.HandlerFunc {
+func CachePage(store persistence.CacheStore, expire time.Duration, handle gin.HandlerFunc, opts ...Option) gin.HandlerFunc {
 	keyCreator := func(c *gin.Context) string {
 		url := c.Request.URL
 		return CreateKey(url.RequestURI())
 	}
 
-	return CachePageWithKeyCreator(store, keyCreator, expire, handle)
+	return CachePageWithKeyCreator(store, keyCreator, expire, handle, opts...)
 }
 
 // CachePage Decorator
-func CachePageWithKeyCreator(store persistence.CacheStore, keyCreator func(c *gin.Context) string, expire time.Duration, handle gin.HandlerFunc) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var cache responseCache
-		key := keyCreator(c)
-		if err := store.Get(key, &cache); err != nil {
-			if err != persistence.ErrCacheMiss {
-				log.Println(err.Error())
-			} else {
-				c.Writer.Header().Set("X-Cache-Status", "MISS")
-			}
-			// replace writer
-			writer := newCachedWriter(store, expire, c.Writer, key)
-			c.Writer = writer
-			handle(c)
-
-			// Drop caches of aborted contexts
-			if c.IsAborted() {
-				store.Delete(key)
-			}
-		} else {
-			// Remove disallowed headers from the cache result
-			cleanedHeaders := cloneHeadersForCache(cache.Header)
-
-			// Output the cached result
-			c.Writer.WriteHeader(cache.Status)
-			for k, vals := range cleanedHeaders {
-				for _, v := range vals {
-					c.Writer.Header().Set(k, v)
-				}
-			}
-
-			c.Writer.Header().Set("X-Cache-Status", "HIT")
-			c.Writer.Write(cache.Data)
-		}
-	}
+func CachePageWithKeyCreator(store persistence.CacheStore, keyCreator func(c *gin.Context) string, expire time.Duration, handle gin.HandlerFunc, opts ...Option) gin.HandlerFunc {
+	return cachePage(store, keyCreator, expire, handle, true, newPageConfig(opts))
 }
 
 // CachePageWithoutQuery add ability to ignore GET query parameters.
-func CachePageWithoutQuery(store persistence.CacheStore, expire time.Duration, handle gin.HandlerFunc) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		var cache responseCache
-		key := CreateKey(c.Request.URL.Path)
-		if err := store.Get(key, &cache); err != nil {
-			if err != persistence.ErrCacheMiss {
-				log.Println(err.Error())
-			} else {
-				c.Writer.Header().Set("X-Cache-Status", "MISS")
-			}
-			// replace writer
-			writer := newCachedWriter(store, expire, c.Writer, key)
-			c.Writer = writer
-			handle(c)
-		} else {
-			// Remove disallowed headers from the cache result
-			cleanedHeaders := cloneHeadersForCache(cache.Header)
-
-			c.Writer.WriteHeader(cache.Status)
-			for k, vals := range cleanedHeaders {
-				for _, v := range vals {
-					c.Writer.Header().Set(k, v)
-				}
-			}
-
-			c.Writer.Header().Set("X-Cache-Status", "HIT")
-			c.Writer.Write(cache.Data)
-		}
+func CachePageWithoutQuery(store persistence.CacheStore, expire time.Duration, handle gin.HandlerFunc, opts ...Option) gin.HandlerFunc {
+	keyCreator := func(c *gin.Context) string {
+		return CreateKey(c.Request.URL.Path)
 	}
+
+	return CachePageWithKeyCreator(store, keyCreator, expire, handle, opts...)
 }
 
 // CachePageAtomic Decorator
-func CachePageAtomic(store persistence.CacheStore, expire time.Duration, handle gin.HandlerFunc) gin.HandlerFunc {
+func CachePageAtomic(store persistence.CacheStore, expire time.Duration, handle gin.HandlerFunc, opts ...Option) gin.HandlerFunc {
 	var m sync.Mutex
-	p := CachePage(store, expire, handle)
+	p := CachePage(store, expire, handle, opts...)
 	return func(c *gin.Context) {
 		m.Lock()
 		defer m.Unlock()
@@ -267,31 +556,85 @@ func CachePageAtomic(store persistence.CacheStore, expire time.Duration, handle
 	}
 }
 
-func CachePageWithoutHeader(store persistence.CacheStore, expire time.Duration, handle gin.HandlerFunc) gin.HandlerFunc {
+func CachePageWithoutHeader(store persistence.CacheStore, expire time.Duration, handle gin.HandlerFunc, opts ...Option) gin.HandlerFunc {
+	keyCreator := func(c *gin.Context) string {
+		url := c.Request.URL
+		return CreateKey(url.RequestURI())
+	}
+
+	return cachePage(store, keyCreator, expire, handle, false, newPageConfig(opts))
+}
+
+// cachePage implements the CachePage family. Hits replay the cached headers
+// only when withHeaders is set.
+func cachePage(store persistence.CacheStore, keyCreator func(c *gin.Context) string, expire time.Duration, handle gin.HandlerFunc, withHeaders bool, cfg *pageConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if !cfg.shouldCacheRequest(c) {
+			c.Writer.Header().Set("X-Cache-Status", "BYPASS")
+			handle(c)
+			return
+		}
+
 		var cache responseCache
-		url := c.Request.URL
-		key := CreateKey(url.RequestURI())
-		if err := store.Get(key, &cache); err != nil {
+		key := keyCreator(c)
+		err := store.Get(key, &cache)
+		// the entry lasts as long as the rules for its status say
+		ttl, _ := statusExpire(cfg.statuses, cache.Status, expire)
+		if err == nil && !cfg.slide(store, key, ttl, &cache) {
+			err = persistence.ErrCacheMiss
+		}
+		if err == nil {
+			err = loadFirstChunk(store, key, &cache)
+		}
+		if err != nil {
 			if err != persistence.ErrCacheMiss {
 				log.Println(err.Error())
 			} else {
 				c.Writer.Header().Set("X-Cache-Status", "MISS")
 			}
+			// the whole page is rendered and cached, range requests are only
+			// answered from the cache
+			c.Request.Header.Del("Range")
+			c.Request.Header.Del("If-Range")
+
 			// replace writer
-			writer := newCachedWriter(store, expire, c.Writer, key)
+			writer := cfg.newWriter(store, expire, c.Writer, key)
 			c.Writer = writer
 			handle(c)
 
-			// Drop caches of aborted contexts
-			if c.IsAborted() {
+			switch {
+			case c.IsAborted():
+				// Drop caches of aborted contexts
+				writer.abandon()
 				store.Delete(key)
+			case c.Request.Context().Err() != nil:
+				// the client went away, maybe before the whole response was
+				// written
+				writer.abandon()
+			default:
+				writer.commit()
+			}
+		} else if withHeaders {
+			// Remove disallowed headers from the cache result
+			cleanedHeaders := cloneHeadersForCache(cache.Header)
+
+			// Output the cached result
+			c.Writer.WriteHeader(cache.Status)
+			for k, vals := range cleanedHeaders {
+				for _, v := range vals {
+					c.Writer.Header().Set(k, v)
+				}
 			}
+
+			c.Writer.Header().Set("X-Cache-Status", "HIT")
+			setAgeHeader(c, store, key, ttl, &cache)
+			serveCachedBody(c, store, key, &cache)
 		} else {
 			c.Writer.Header().Set("X-Cache-Status", "HIT")
+			setAgeHeader(c, store, key, ttl, &cache)
 
 			c.Writer.WriteHeader(cache.Status)
-			c.Writer.Write(cache.Data)
+			serveCachedBody(c, store, key, &cache)
 		}
 	}
 }
@@ -3,13 +3,17 @@ package cache
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/gin-contrib/cache/persistence"
+	cachetesting "github.com/gin-contrib/cache/persistence/testing"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
@@ -57,6 +61,23 @@ func TestCachePage(t *testing.T) {
 	assert.Equal(t, w2.Header().Get("X-Cache-Status"), "HIT")
 }
 
+func TestCachePageAgeHeader(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+
+	router := gin.New()
+	router.GET("/cache_ping", CachePage(store, time.Second*10, func(c *gin.Context) {
+		c.String(200, "pong "+fmt.Sprint(time.Now().UnixNano()))
+	}))
+
+	w1 := performRequest("GET", "/cache_ping", router)
+	time.Sleep(time.Millisecond * 1100)
+	w2 := performRequest("GET", "/cache_ping", router)
+
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, "", w1.Header().Get("Age"))
+	assert.Equal(t, "1", w2.Header().Get("Age"))
+}
+
 func TestCachePageExpire(t *testing.T) {
 	store := persistence.NewInMemoryStore(60 * time.Second)
 
@@ -77,10 +98,78 @@ func TestCachePageExpire(t *testing.T) {
 	assert.Equal(t, w2.Header().Get("X-Cache-Status"), "MISS")
 }
 
+func TestCachePageSlidingExpiration(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+
+	router := gin.New()
+	router.GET("/cache_ping", CachePage(store, time.Second, func(c *gin.Context) {
+		c.String(200, "pong "+fmt.Sprint(time.Now().UnixNano()))
+	}, WithSlidingExpiration(time.Second*2)))
+
+	w1 := performRequest("GET", "/cache_ping", router)
+	time.Sleep(time.Millisecond * 600)
+	w2 := performRequest("GET", "/cache_ping", router)
+	time.Sleep(time.Millisecond * 600)
+	w3 := performRequest("GET", "/cache_ping", router)
+	time.Sleep(time.Millisecond * 900)
+	w4 := performRequest("GET", "/cache_ping", router)
+
+	// the hits keep the entry alive past its idle timeout...
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, w1.Body.String(), w3.Body.String())
+	assert.Equal(t, "HIT", w3.Header().Get("X-Cache-Status"))
+	// ...but not past its max age
+	assert.NotEqual(t, w1.Body.String(), w4.Body.String())
+	assert.Equal(t, "MISS", w4.Header().Get("X-Cache-Status"))
+}
+
+func TestCachePageSlidingExpirationWithoutTouch(t *testing.T) {
+	// hide the TTLCacheStore methods, so that the entries are rewritten
+	store := struct{ persistence.CacheStore }{persistence.NewInMemoryStore(60 * time.Second)}
+
+	router := gin.New()
+	router.GET("/cache_ping", CachePageWithoutHeader(store, time.Second, func(c *gin.Context) {
+		c.String(200, "pong "+fmt.Sprint(time.Now().UnixNano()))
+	}, WithSlidingExpiration(time.Minute)))
+
+	w1 := performRequest("GET", "/cache_ping", router)
+	time.Sleep(time.Millisecond * 700)
+	w2 := performRequest("GET", "/cache_ping", router)
+	time.Sleep(time.Millisecond * 700)
+	w3 := performRequest("GET", "/cache_ping", router)
+
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, w1.Body.String(), w3.Body.String())
+	assert.Equal(t, "HIT", w3.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "1", w3.Header().Get("Age"))
+}
+
+func TestCachePageCircuitBreakerOpen(t *testing.T) {
+	failing := cachetesting.NewFaultyStore(persistence.NewInMemoryStore(60 * time.Second))
+	failing.Inject(cachetesting.Fault{Err: errors.New("store down")})
+	store := persistence.NewCircuitBreakerStore(failing, persistence.CircuitBreakerOptions{FailureThreshold: 1})
+
+	router := gin.New()
+	router.GET("/cache_ping", CachePage(store, time.Second*3, func(c *gin.Context) {
+		c.String(200, "pong "+fmt.Sprint(time.Now().UnixNano()))
+	}))
+
+	w1 := performRequest("GET", "/cache_ping", router)
+	assert.Equal(t, persistence.BreakerOpen, store.State())
+	w2 := performRequest("GET", "/cache_ping", router)
+
+	// the handler serves the pages while the store is left alone
+	assert.Equal(t, 200, w2.Code)
+	assert.NotEqual(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, "MISS", w2.Header().Get("X-Cache-Status"))
+	// the Set of the first request, the Get and Set of the second
+	assert.Equal(t, uint64(3), store.Stats().ShortCircuits)
+}
+
 func TestCachePageAtomic(t *testing.T) {
-	// memoryDelayStore is a wrapper of a InMemoryStore
-	// designed to simulate data race (by doing a delayed write)
-	store := newDelayStore(60 * time.Second)
+	// delay the writes to simulate a data race
+	store := cachetesting.NewFaultyStore(persistence.NewInMemoryStore(60 * time.Second))
+	store.Inject(cachetesting.Fault{Operations: []string{"Set", "Add"}, Latency: time.Millisecond * 3})
 
 	router := gin.New()
 	router.GET("/atomic", CachePageAtomic(store, time.Second*5, func(c *gin.Context) {
@@ -298,6 +387,88 @@ func TestCachePageStatus207(t *testing.T) {
 	assert.Equal(t, w2.Header().Get("X-Cache-Status"), "HIT")
 }
 
+func TestCachePageStatusTTL(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+
+	router := gin.New()
+	router.GET("/products/:id", CachePage(store, time.Minute, func(c *gin.Context) {
+		if c.Param("id") == "old" {
+			c.Redirect(301, "/products/new")
+			return
+		}
+		c.String(404, fmt.Sprint(time.Now().UnixNano()))
+	}, WithStatusTTL(200, 299, 10*time.Minute), WithStatusTTL(301, 301, time.Hour), WithStatusTTL(404, 404, 30*time.Second)))
+
+	w1 := performRequest("GET", "/products/missing", router)
+	w2 := performRequest("GET", "/products/missing", router)
+
+	assert.Equal(t, 404, w2.Code)
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, "HIT", w2.Header().Get("X-Cache-Status"))
+	ttl, err := persistence.TTL(store, CreateKey("/products/missing"))
+	assert.Nil(t, err)
+	assert.InDelta(t, 30*time.Second, ttl, float64(time.Second))
+
+	performRequest("GET", "/products/old", router)
+	w3 := performRequest("GET", "/products/old", router)
+
+	assert.Equal(t, 301, w3.Code)
+	assert.Equal(t, "/products/new", w3.Header().Get("Location"))
+	assert.Equal(t, "HIT", w3.Header().Get("X-Cache-Status"))
+	ttl, err = persistence.TTL(store, CreateKey("/products/old"))
+	assert.Nil(t, err)
+	assert.InDelta(t, time.Hour, ttl, float64(time.Second))
+}
+
+func TestCachePageWithoutStatus(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+
+	router := gin.New()
+	router.GET("/cache_status/:code", CachePage(store, time.Minute, func(c *gin.Context) {
+		code, _ := strconv.Atoi(c.Param("code"))
+		c.String(code, fmt.Sprint(time.Now().UnixNano()))
+	}, WithStatusTTL(200, 599, persistence.DEFAULT), WithoutStatus(500, 599)))
+
+	for _, test := range []struct {
+		path   string
+		cached bool
+	}{
+		{"/cache_status/200", true},
+		{"/cache_status/410", true},
+		{"/cache_status/500", false},
+		{"/cache_status/503", false},
+	} {
+		w1 := performRequest("GET", test.path, router)
+		w2 := performRequest("GET", test.path, router)
+		assert.Equal(t, test.cached, w1.Body.String() == w2.Body.String(), test.path)
+	}
+}
+
+func TestStatusExpire(t *testing.T) {
+	rules := []statusRule{{min: 200, max: 299, ttl: time.Minute, cache: true}, {min: 204, max: 204}}
+	for _, test := range []struct {
+		rules  []statusRule
+		status int
+		ttl    time.Duration
+		cached bool
+	}{
+		{nil, 200, time.Hour, true},
+		{nil, 404, time.Hour, false},
+		{rules, 200, time.Minute, true},
+		{rules, 204, 0, false},
+		{rules, 301, 0, false},
+		// rules that only exclude codes keep the default ones
+		{rules[1:], 200, time.Hour, true},
+		{rules[1:], 204, 0, false},
+	} {
+		ttl, cached := statusExpire(test.rules, test.status, time.Hour)
+		assert.Equal(t, test.cached, cached, test.status)
+		if cached {
+			assert.Equal(t, test.ttl, ttl, test.status)
+		}
+	}
+}
+
 func TestCachePageWithoutQuery(t *testing.T) {
 	store := persistence.NewInMemoryStore(60 * time.Second)
 
@@ -402,29 +573,105 @@ func TestCacheDisallowedHeadersAddedBeforeCache(t *testing.T) {
 	assert.NotEqual(t, w2.Header().Get("Authorization"), w2.Body.String())
 }
 
-func performRequest(method, target string, router *gin.Engine) *httptest.ResponseRecorder {
-	r := httptest.NewRequest(method, target, nil)
-	w := httptest.NewRecorder()
-	router.ServeHTTP(w, r)
-	return w
-}
+func TestCachePageChunked(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+	key := CreateKey("/report")
 
-type memoryDelayStore struct {
-	*persistence.InMemoryStore
+	router := gin.New()
+	router.GET("/report", CachePage(store, time.Minute, func(c *gin.Context) {
+		for i := 0; i < 10; i++ {
+			// nothing is visible in the cache before the response is complete
+			var cache responseCache
+			assert.Equal(t, persistence.ErrCacheMiss, store.Get(key, &cache))
+
+			c.Writer.Write(bytes.Repeat([]byte{byte('a' + i)}, 500))
+			c.Writer.Flush()
+		}
+	}, WithChunkSize(1024)))
+
+	w1 := performRequest("GET", "/report", router)
+	w2 := performRequest("GET", "/report", router)
+
+	assert.Equal(t, 5000, w1.Body.Len())
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, "HIT", w2.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "5000", w2.Header().Get("Content-Length"))
+
+	var cache responseCache
+	assert.Nil(t, store.Get(key, &cache))
+	assert.Equal(t, 5, cache.Chunks)
+	assert.Empty(t, cache.Data)
 }
 
-func newDelayStore(defaultExpiration time.Duration) *memoryDelayStore {
-	v := &memoryDelayStore{}
-	v.InMemoryStore = persistence.NewInMemoryStore(defaultExpiration)
-	return v
+func TestCachePageChunkEvicted(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+	key := CreateKey("/report")
+
+	router := gin.New()
+	router.GET("/report", CachePage(store, time.Minute, func(c *gin.Context) {
+		c.String(200, "%d %s", time.Now().UnixNano(), bytes.Repeat([]byte("x"), 3000))
+	}, WithChunkSize(1024)))
+
+	w1 := performRequest("GET", "/report", router)
+
+	// without its first chunk, the response is a miss
+	store.Delete(chunkKey(key, 0))
+	w2 := performRequest("GET", "/report", router)
+	assert.Equal(t, "MISS", w2.Header().Get("X-Cache-Status"))
+	assert.NotEqual(t, w1.Body.String(), w2.Body.String())
+
+	// a later chunk is only found missing once the response is sent
+	store.Delete(chunkKey(key, 2))
+	w3 := performRequest("GET", "/report", router)
+	assert.Equal(t, "HIT", w3.Header().Get("X-Cache-Status"))
+	assert.Equal(t, 2048, w3.Body.Len())
+	w4 := performRequest("GET", "/report", router)
+	assert.Equal(t, "MISS", w4.Header().Get("X-Cache-Status"))
 }
 
-func (c *memoryDelayStore) Set(key string, value interface{}, expires time.Duration) error {
-	time.Sleep(time.Millisecond * 3)
-	return c.InMemoryStore.Set(key, value, expires)
+func TestCachePageStreamClientGone(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+	key := CreateKey("/stream")
+	done := make(chan struct{})
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Next()
+		close(done)
+	})
+	router.GET("/stream", CachePage(store, time.Minute, func(c *gin.Context) {
+		sent := 0
+		c.Stream(func(w io.Writer) bool {
+			w.Write(bytes.Repeat([]byte("x"), 1024))
+			sent++
+			time.Sleep(time.Millisecond * 5)
+			return sent < 2000
+		})
+	}, WithChunkSize(1024)))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/stream")
+	if err != nil {
+		t.Fatalf("Error requesting the stream: %s", err)
+	}
+	io.ReadFull(resp.Body, make([]byte, 4096))
+	resp.Body.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Expected the handler to stop once the client is gone")
+	}
+	var cache responseCache
+	assert.Equal(t, persistence.ErrCacheMiss, store.Get(key, &cache))
+	var chunk responseChunk
+	assert.Equal(t, persistence.ErrCacheMiss, store.Get(chunkKey(key, 0), &chunk))
 }
 
-func (c *memoryDelayStore) Add(key string, value interface{}, expires time.Duration) error {
-	time.Sleep(time.Millisecond * 3)
-	return c.InMemoryStore.Add(key, value, expires)
+func performRequest(method, target string, router *gin.Engine) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
 }
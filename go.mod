@@ -1,25 +1,46 @@
 module github.com/gin-contrib/cache
 
+go 1.21
+
 require (
 	github.com/bradfitz/gomemcache v0.0.0-20180710155616-bc664df96737
+	github.com/gin-gonic/gin v1.3.0
+	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/memcachier/mc v2.0.1+incompatible
+	github.com/robfig/go-cache v0.0.0-20130306151617-9fc39e0dbf62
+	github.com/stretchr/testify v1.2.2
+	go.etcd.io/bbolt v1.3.6
+	modernc.org/sqlite v1.28.0
+)
+
+require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/gin-contrib/sse v0.0.0-20170109093832-22d885f9ecc7 // indirect
-	github.com/gin-gonic/gin v1.3.0
 	github.com/golang/protobuf v1.2.0 // indirect
-	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/google/uuid v1.3.0 // indirect
 	github.com/json-iterator/go v1.1.5 // indirect
-	github.com/mattn/go-isatty v0.0.4 // indirect
-	github.com/memcachier/mc v2.0.1+incompatible
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
+	github.com/mattn/go-isatty v0.0.16 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/robfig/go-cache v0.0.0-20130306151617-9fc39e0dbf62
-	github.com/stretchr/testify v1.2.2
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/ugorji/go/codec v0.0.0-20181022190402-e5e69e061d4f // indirect
-	golang.org/x/net v0.0.0-20181220203305-927f97764cc3 // indirect
-	golang.org/x/sync v0.0.0-20181221193216-37e7f081c4d4 // indirect
-	golang.org/x/sys v0.0.0-20181228144115-9a3f9b0469bb // indirect
+	golang.org/x/mod v0.3.0 // indirect
+	golang.org/x/sys v0.9.0 // indirect
+	golang.org/x/tools v0.0.0-20201124115921-2c860bdd6e78 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
 	gopkg.in/go-playground/validator.v8 v8.18.2 // indirect
 	gopkg.in/yaml.v2 v2.2.1 // indirect
+	lukechampine.com/uint128 v1.2.0 // indirect
+	modernc.org/cc/v3 v3.40.0 // indirect
+	modernc.org/ccgo/v3 v3.16.13 // indirect
+	modernc.org/libc v1.29.0 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.7.2 // indirect
+	modernc.org/opt v0.1.3 // indirect
+	modernc.org/strutil v1.1.3 // indirect
+	modernc.org/token v1.0.1 // indirect
 )
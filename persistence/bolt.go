@@ -0,0 +1,385 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/utils"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// boltItems maps the keys to their expiration, as big endian nanoseconds
+	// since the epoch or 0, followed by their value
+	boltItems = []byte("items")
+	// boltExpirations holds the expiration followed by the key of the items
+	// that expire, so that they are sorted by expiration for the sweeper
+	boltExpirations = []byte("expirations")
+)
+
+var errBoltCorrupted = errors.New("cache: corrupted bolt cache item.")
+
+// BoltOptions configures a BoltStore
+type BoltOptions struct {
+	// SweepInterval is how often the expired items are deleted, a minute by
+	// default. A negative interval disables the sweeper.
+	SweepInterval time.Duration
+}
+
+// BoltStore represents the cache with persistence in a bbolt database, an
+// embedded B+tree stored in a single file. The file can't be opened by another
+// process while the store is open.
+type BoltStore struct {
+	db                *bolt.DB
+	defaultExpiration time.Duration
+
+	stopSweeper chan struct{}
+	sweeperDone chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewBoltStore returns a BoltStore keeping its items in the database file at
+// path, which is created if needed. Call Close to release the file.
+func NewBoltStore(path string, options BoltOptions, defaultExpiration time.Duration) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltItems); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltExpirations)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	c := &BoltStore{
+		db:                db,
+		defaultExpiration: defaultExpiration,
+		stopSweeper:       make(chan struct{}),
+		sweeperDone:       make(chan struct{}),
+	}
+
+	interval := options.SweepInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	if interval > 0 {
+		go c.sweep(interval)
+	} else {
+		close(c.sweeperDone)
+	}
+	return c, nil
+}
+
+// Close stops the sweeper and closes the database
+func (c *BoltStore) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stopSweeper)
+	})
+	<-c.sweeperDone
+	return c.db.Close()
+}
+
+func (c *BoltStore) sweep(interval time.Duration) {
+	defer close(c.sweeperDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.DeleteExpired(); err != nil {
+				log.Println(err.Error())
+			}
+		case <-c.stopSweeper:
+			return
+		}
+	}
+}
+
+// DeleteExpired deletes the expired items, and returns how many there were
+func (c *BoltStore) DeleteExpired() (int, error) {
+	n := 0
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		items, expirations := tx.Bucket(boltItems), tx.Bucket(boltExpirations)
+		now := uint64(time.Now().UnixNano())
+		// deleting while iterating would make the cursor skip items
+		var expired [][]byte
+		cursor := expirations.Cursor()
+		for k, _ := cursor.First(); k != nil && binary.BigEndian.Uint64(k) <= now; k, _ = cursor.Next() {
+			expired = append(expired, append([]byte(nil), k...))
+		}
+		for _, k := range expired {
+			if err := items.Delete(k[8:]); err != nil {
+				return err
+			}
+			if err := expirations.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// Get (see CacheStore interface)
+func (c *BoltStore) Get(key string, value interface{}) error {
+	var b []byte
+	err := c.db.View(func(tx *bolt.Tx) error {
+		item, _, err := boltLookup(tx, key)
+		// the slices of bolt are only valid during the transaction
+		b = append(b, item...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return utils.Deserialize(b, value)
+}
+
+// Set (see CacheStore interface)
+func (c *BoltStore) Set(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool {
+		return true
+	})
+}
+
+// Add (see CacheStore interface)
+func (c *BoltStore) Add(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool {
+		return !found
+	})
+}
+
+// Replace (see CacheStore interface)
+func (c *BoltStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool {
+		return found
+	})
+}
+
+// Delete (see CacheStore interface)
+func (c *BoltStore) Delete(key string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		_, expiration, err := boltLookup(tx, key)
+		if err != nil {
+			return err
+		}
+		return boltRemove(tx, key, expiration)
+	})
+}
+
+// Increment (see CacheStore interface)
+func (c *BoltStore) Increment(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(current uint64) uint64 {
+		return current + delta
+	})
+}
+
+// Decrement (see CacheStore interface)
+func (c *BoltStore) Decrement(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(current uint64) uint64 {
+		if delta > current {
+			return 0
+		}
+		return current - delta
+	})
+}
+
+// Flush (see CacheStore interface)
+func (c *BoltStore) Flush() error {
+	// dropping the buckets is cheaper than deleting the items one by one
+	return c.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltItems, boltExpirations} {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *BoltStore) TTL(key string) (time.Duration, error) {
+	var expiration uint64
+	err := c.db.View(func(tx *bolt.Tx) (err error) {
+		_, expiration, err = boltLookup(tx, key)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if expiration == 0 {
+		return FOREVER, nil
+	}
+	return time.Until(time.Unix(0, int64(expiration))), nil
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *BoltStore) Touch(key string, expires time.Duration) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		item, expiration, err := boltLookup(tx, key)
+		if err != nil {
+			return err
+		}
+		return boltPut(tx, key, item, expiration, c.expiration(expires))
+	})
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (c *BoltStore) GetMulti(values map[string]interface{}) error {
+	errs := MultiError{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		for key, value := range values {
+			item, _, err := boltLookup(tx, key)
+			if err == nil {
+				err = utils.Deserialize(append([]byte(nil), item...), value)
+			}
+			if err != nil {
+				errs[key] = err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return errs.errOrNil()
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *BoltStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	return setEach(c, values, expires)
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (c *BoltStore) DeleteMulti(keys ...string) error {
+	return deleteEach(c, keys)
+}
+
+// store writes value under key if ok, called with whether key holds a live
+// item, returns true
+func (c *BoltStore) store(key string, value interface{}, expires time.Duration, ok func(found bool) bool) error {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		_, expiration, err := boltLookup(tx, key)
+		if err != nil && err != ErrCacheMiss {
+			return err
+		}
+		if !ok(err == nil) {
+			return ErrNotStored
+		}
+		if err == ErrCacheMiss {
+			// an expired item may still be there
+			expiration = boltExpiration(tx, key)
+		}
+		return boltPut(tx, key, b, expiration, c.expiration(expires))
+	})
+}
+
+// count updates the counter stored under key in a single transaction,
+// keeping its expiration
+func (c *BoltStore) count(key string, next func(current uint64) uint64) (uint64, error) {
+	var n uint64
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		item, expiration, err := boltLookup(tx, key)
+		if err != nil {
+			return err
+		}
+		current, err := strconv.ParseUint(string(item), 10, 64)
+		if err != nil {
+			return err
+		}
+		n = next(current)
+		return boltPut(tx, key, []byte(strconv.FormatUint(n, 10)), expiration, expiration)
+	})
+	return n, err
+}
+
+// expiration resolves DEFAULT and FOREVER to the expiration of an item
+func (c *BoltStore) expiration(expires time.Duration) uint64 {
+	if expires == DEFAULT {
+		expires = c.defaultExpiration
+	}
+	if expires > 0 {
+		return uint64(time.Now().Add(expires).UnixNano())
+	}
+	return 0
+}
+
+// boltLookup returns the value and expiration of the live item under key
+func boltLookup(tx *bolt.Tx, key string) ([]byte, uint64, error) {
+	item := tx.Bucket(boltItems).Get([]byte(key))
+	if item == nil {
+		return nil, 0, ErrCacheMiss
+	}
+	if len(item) < 8 {
+		return nil, 0, errBoltCorrupted
+	}
+	expiration := binary.BigEndian.Uint64(item)
+	if expiration != 0 && expiration <= uint64(time.Now().UnixNano()) {
+		return nil, 0, ErrCacheMiss
+	}
+	return item[8:], expiration, nil
+}
+
+// boltExpiration returns the expiration of the item under key, even if it
+// has expired, or 0
+func boltExpiration(tx *bolt.Tx, key string) uint64 {
+	item := tx.Bucket(boltItems).Get([]byte(key))
+	if len(item) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(item)
+}
+
+// boltPut writes the item under key, moving its entry in the expiration index
+// from old to expiration
+func boltPut(tx *bolt.Tx, key string, value []byte, old, expiration uint64) error {
+	item := make([]byte, 8+len(value))
+	binary.BigEndian.PutUint64(item, expiration)
+	copy(item[8:], value)
+
+	if old != 0 && old != expiration {
+		if err := tx.Bucket(boltExpirations).Delete(boltExpirationKey(key, old)); err != nil {
+			return err
+		}
+	}
+	if expiration != 0 && old != expiration {
+		if err := tx.Bucket(boltExpirations).Put(boltExpirationKey(key, expiration), nil); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(boltItems).Put([]byte(key), item)
+}
+
+// boltRemove deletes the item under key, which expires at expiration
+func boltRemove(tx *bolt.Tx, key string, expiration uint64) error {
+	if expiration != 0 {
+		if err := tx.Bucket(boltExpirations).Delete(boltExpirationKey(key, expiration)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(boltItems).Delete([]byte(key))
+}
+
+func boltExpirationKey(key string, expiration uint64) []byte {
+	b := make([]byte, 8+len(key))
+	binary.BigEndian.PutUint64(b, expiration)
+	copy(b[8:], key)
+	return b
+}
@@ -0,0 +1,71 @@
+package persistence
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var newBoltStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "cache.db"), BoltOptions{}, defaultExpiration)
+	if err != nil {
+		t.Fatalf("Error opening the bolt store: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestBoltCache_Restart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	cache, err := NewBoltStore(path, BoltOptions{}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error opening the bolt store: %s", err)
+	}
+	cache.Set("kept", "value", DEFAULT)
+	cache.Set("counter", 41, DEFAULT)
+	if err = cache.Close(); err != nil {
+		t.Fatalf("Error closing the bolt store: %s", err)
+	}
+
+	if cache, err = NewBoltStore(path, BoltOptions{}, time.Hour); err != nil {
+		t.Fatalf("Error opening the bolt store again: %s", err)
+	}
+	defer cache.Close()
+	var value string
+	if err = cache.Get("kept", &value); err != nil || value != "value" {
+		t.Errorf("Expected the item to survive a restart, got %q, %v", value, err)
+	}
+	if n, err := cache.Increment("counter", 1); err != nil || n != 42 {
+		t.Errorf("Expected the counter to survive a restart, got %d, %v", n, err)
+	}
+}
+
+func TestBoltCache_DeleteExpired(t *testing.T) {
+	cache, err := NewBoltStore(filepath.Join(t.TempDir(), "cache.db"), BoltOptions{SweepInterval: -1}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error opening the bolt store: %s", err)
+	}
+	defer cache.Close()
+	cache.Set("kept", "value", DEFAULT)
+	cache.Set("forever", "value", FOREVER)
+	for _, key := range []string{"a", "b", "c"} {
+		cache.Set(key, "value", time.Second)
+	}
+	// moving an item in the index leaves no stale entry behind
+	cache.Touch("a", 2*time.Second)
+	time.Sleep(1100 * time.Millisecond)
+
+	if n, err := cache.DeleteExpired(); err != nil || n != 2 {
+		t.Errorf("Expected to delete 2 expired items, got %d, %v", n, err)
+	}
+	time.Sleep(time.Second)
+	if n, err := cache.DeleteExpired(); err != nil || n != 1 {
+		t.Errorf("Expected to delete 1 expired item, got %d, %v", n, err)
+	}
+	var value string
+	for _, key := range []string{"kept", "forever"} {
+		if err := cache.Get(key, &value); err != nil {
+			t.Errorf("Expected %s to be kept, got %v", key, err)
+		}
+	}
+}
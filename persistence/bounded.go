@@ -0,0 +1,562 @@
+package persistence
+
+import (
+	"container/heap"
+	"container/list"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-contrib/cache/utils"
+)
+
+// EvictionPolicy chooses the entries a BoundedStore drops when it is full
+type EvictionPolicy int
+
+const (
+	// LRU evicts the least recently used entry
+	LRU EvictionPolicy = iota
+	// LFU evicts the least frequently used entry, and the least recently used
+	// one among entries used as often
+	LFU
+)
+
+// EvictionReason tells why a BoundedStore dropped an entry
+type EvictionReason int
+
+const (
+	// EvictedForSpace entries were dropped to make room for other entries
+	EvictedForSpace EvictionReason = iota
+	// EvictedExpired entries were dropped because they expired
+	EvictedExpired
+)
+
+// defaultBoundedShards is the number of shards of a BoundedStore when the
+// options don't tell
+const defaultBoundedShards = 16
+
+// BoundedOptions configures a BoundedStore. Zero limits mean no limit.
+type BoundedOptions struct {
+	// MaxEntries bounds the number of entries
+	MaxEntries int
+	// MaxBytes bounds the total size of the keys and serialized values
+	MaxBytes int64
+	// Policy chooses the entries evicted when a limit is reached
+	Policy EvictionPolicy
+	// Shards is the number of independently locked partitions of the store,
+	// 16 by default, and never more than MaxEntries or MaxBytes. The limits
+	// are split evenly between the shards, so a single value can't be larger
+	// than MaxBytes / Shards.
+	Shards int
+	// OnEvict is called, outside of any lock, for every entry dropped because
+	// of a limit or its expiration. Deleted entries are not reported.
+	OnEvict func(key string, reason EvictionReason)
+}
+
+// BoundedStats reports the activity of a BoundedStore
+type BoundedStats struct {
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+	Entries     int
+	Bytes       int64
+}
+
+// BoundedStore represents the cache with memory persistence, bounded in number
+// of entries and size. Unlike InMemoryStore, values are stored serialized, so
+// that their size is known.
+type BoundedStore struct {
+	// updated atomically, first for the alignment of 32 bit platforms
+	hits, misses, evictions, expirations uint64
+
+	shards            []*boundedShard
+	defaultExpiration time.Duration
+	onEvict           func(key string, reason EvictionReason)
+}
+
+// NewBoundedStore returns a BoundedStore
+func NewBoundedStore(options BoundedOptions, defaultExpiration time.Duration) *BoundedStore {
+	n := options.Shards
+	if n <= 0 {
+		n = defaultBoundedShards
+	}
+	if options.MaxEntries > 0 && n > options.MaxEntries {
+		// every shard must be able to hold an entry
+		n = options.MaxEntries
+	}
+	if options.MaxBytes > 0 && int64(n) > options.MaxBytes {
+		// a share of 0 bytes would be no limit at all
+		n = int(options.MaxBytes)
+	}
+
+	c := &BoundedStore{
+		shards:            make([]*boundedShard, n),
+		defaultExpiration: defaultExpiration,
+		onEvict:           options.OnEvict,
+	}
+	for i := range c.shards {
+		s := &boundedShard{
+			items:      make(map[string]*boundedEntry),
+			maxEntries: split(int64(options.MaxEntries), n, i),
+			maxBytes:   split(options.MaxBytes, n, i),
+		}
+		if options.Policy == LFU {
+			s.queue = &lfuQueue{}
+		} else {
+			s.queue = &lruQueue{list.New()}
+		}
+		c.shards[i] = s
+	}
+	return c
+}
+
+// split returns the share of limit going to the i-th of n shards
+func split(limit int64, n int, i int) int64 {
+	share := limit / int64(n)
+	if int64(i) < limit%int64(n) {
+		share++
+	}
+	return share
+}
+
+// Get (see CacheStore interface)
+func (c *BoundedStore) Get(key string, value interface{}) error {
+	_, err := c.GetWithVersion(key, value)
+	return err
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (c *BoundedStore) GetWithVersion(key string, value interface{}) (Version, error) {
+	var item []byte
+	var version uint64
+	err := c.update(key, func(s *boundedShard, e *boundedEntry) error {
+		if e == nil {
+			return ErrCacheMiss
+		}
+		s.queue.touch(e)
+		item, version = e.value, e.version
+		return nil
+	})
+	if err != nil {
+		atomic.AddUint64(&c.misses, 1)
+		return Version{}, err
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return Version{cas: version}, utils.Deserialize(item, value)
+}
+
+// Set (see CacheStore interface)
+func (c *BoundedStore) Set(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(e *boundedEntry) error {
+		return nil
+	})
+}
+
+// Add (see CacheStore interface)
+func (c *BoundedStore) Add(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(e *boundedEntry) error {
+		if e != nil {
+			return ErrNotStored
+		}
+		return nil
+	})
+}
+
+// Replace (see CacheStore interface)
+func (c *BoundedStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(e *boundedEntry) error {
+		if e == nil {
+			return ErrNotStored
+		}
+		return nil
+	})
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (c *BoundedStore) CompareAndSet(key string, value interface{}, version Version, expires time.Duration) error {
+	return c.store(key, value, expires, func(e *boundedEntry) error {
+		if e == nil {
+			return ErrCacheMiss
+		}
+		if version.cas == 0 || e.version != version.cas {
+			return ErrCASConflict
+		}
+		return nil
+	})
+}
+
+// Delete (see CacheStore interface)
+func (c *BoundedStore) Delete(key string) error {
+	return c.update(key, func(s *boundedShard, e *boundedEntry) error {
+		if e == nil {
+			return ErrCacheMiss
+		}
+		s.unlink(e)
+		return nil
+	})
+}
+
+// Increment (see CacheStore interface)
+func (c *BoundedStore) Increment(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(current uint64) uint64 {
+		return current + delta
+	})
+}
+
+// Decrement (see CacheStore interface)
+func (c *BoundedStore) Decrement(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(current uint64) uint64 {
+		if delta > current {
+			return 0
+		}
+		return current - delta
+	})
+}
+
+// Flush (see CacheStore interface)
+func (c *BoundedStore) Flush() error {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for _, e := range s.items {
+			s.unlink(e)
+		}
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *BoundedStore) TTL(key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := c.update(key, func(s *boundedShard, e *boundedEntry) error {
+		if e == nil {
+			return ErrCacheMiss
+		}
+		ttl = FOREVER
+		if !e.expiration.IsZero() {
+			ttl = e.expiration.Sub(time.Now())
+		}
+		return nil
+	})
+	return ttl, err
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *BoundedStore) Touch(key string, expires time.Duration) error {
+	return c.update(key, func(s *boundedShard, e *boundedEntry) error {
+		if e == nil {
+			return ErrCacheMiss
+		}
+		e.expiration = c.expiration(expires)
+		return nil
+	})
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (c *BoundedStore) GetMulti(values map[string]interface{}) error {
+	return getEach(c, values)
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *BoundedStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	return setEach(c, values, expires)
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (c *BoundedStore) DeleteMulti(keys ...string) error {
+	return deleteEach(c, keys)
+}
+
+// Stats returns the counters of the store
+func (c *BoundedStore) Stats() BoundedStats {
+	stats := BoundedStats{
+		Hits:        atomic.LoadUint64(&c.hits),
+		Misses:      atomic.LoadUint64(&c.misses),
+		Evictions:   atomic.LoadUint64(&c.evictions),
+		Expirations: atomic.LoadUint64(&c.expirations),
+	}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Entries += len(s.items)
+		stats.Bytes += s.bytes
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+// store serializes value and stores it under key if check, called with the
+// live entry for key or nil, doesn't return an error.
+func (c *BoundedStore) store(key string, value interface{}, expires time.Duration, check func(e *boundedEntry) error) error {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	expiration := c.expiration(expires)
+	return c.update(key, func(s *boundedShard, e *boundedEntry) error {
+		if err := check(e); err != nil {
+			return err
+		}
+		return s.store(key, b, expiration, e)
+	})
+}
+
+// count updates the counter stored under key, keeping its expiration
+func (c *BoundedStore) count(key string, next func(current uint64) uint64) (uint64, error) {
+	var n uint64
+	err := c.update(key, func(s *boundedShard, e *boundedEntry) error {
+		if e == nil {
+			return ErrCacheMiss
+		}
+		current, err := strconv.ParseUint(string(e.value), 10, 64)
+		if err != nil {
+			return err
+		}
+		n = next(current)
+		return s.store(key, []byte(strconv.FormatUint(n, 10)), e.expiration, e)
+	})
+	return n, err
+}
+
+// update calls f with the shard of key locked, and the live entry for key or
+// nil. The evictions f caused are reported once the shard is unlocked.
+func (c *BoundedStore) update(key string, f func(s *boundedShard, e *boundedEntry) error) error {
+	s := c.shards[fnv32(key)%uint32(len(c.shards))]
+	s.mu.Lock()
+	err := f(s, s.lookup(key))
+	evicted := s.evicted
+	s.evicted = nil
+	s.mu.Unlock()
+
+	for _, e := range evicted {
+		if e.reason == EvictedExpired {
+			atomic.AddUint64(&c.expirations, 1)
+		} else {
+			atomic.AddUint64(&c.evictions, 1)
+		}
+		if c.onEvict != nil {
+			c.onEvict(e.key, e.reason)
+		}
+	}
+	return err
+}
+
+// expiration resolves DEFAULT and FOREVER to the time the item expires, the
+// zero time meaning never
+func (c *BoundedStore) expiration(expires time.Duration) time.Time {
+	if expires == DEFAULT {
+		expires = c.defaultExpiration
+	}
+	if expires > 0 {
+		return time.Now().Add(expires)
+	}
+	return time.Time{}
+}
+
+// fnv32 implements the 32 bit FNV-1a hash, without the allocations of hash/fnv
+func fnv32(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// boundedShard is a partition of a BoundedStore, guarded by its own lock
+type boundedShard struct {
+	mu         sync.Mutex
+	items      map[string]*boundedEntry
+	queue      evictionQueue
+	maxEntries int64
+	maxBytes   int64
+	bytes      int64
+	version    uint64
+	// evicted collects the evictions of the current operation
+	evicted []boundedEviction
+}
+
+type boundedEntry struct {
+	key        string
+	value      []byte
+	expiration time.Time
+	version    uint64
+
+	// bookkeeping of the eviction queues
+	element *list.Element
+	index   int
+	hits    uint64
+	used    uint64
+}
+
+type boundedEviction struct {
+	key    string
+	reason EvictionReason
+}
+
+func (e *boundedEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+func (e *boundedEntry) expired(now time.Time) bool {
+	return !e.expiration.IsZero() && !e.expiration.After(now)
+}
+
+// lookup returns the live entry for key, dropping it if it has expired
+func (s *boundedShard) lookup(key string) *boundedEntry {
+	e, found := s.items[key]
+	if !found {
+		return nil
+	}
+	if e.expired(time.Now()) {
+		s.evict(e, EvictedExpired)
+		return nil
+	}
+	return e
+}
+
+// store sets value under key, replacing old if it isn't nil, and evicts
+// entries until the shard is within its limits again.
+func (s *boundedShard) store(key string, value []byte, expiration time.Time, old *boundedEntry) error {
+	e := &boundedEntry{key: key, value: value, expiration: expiration}
+	if s.maxBytes > 0 && e.size() > s.maxBytes {
+		// don't leave the previous value behind
+		if old != nil {
+			s.unlink(old)
+		}
+		return ErrNotStored
+	}
+	if old != nil {
+		// keep the usage of the entry, but make sure it isn't evicted to make
+		// room for itself
+		e.hits = old.hits
+		s.unlink(old)
+	}
+
+	now := time.Now()
+	for s.full(e.size()) {
+		victim := s.queue.victim()
+		if victim.expired(now) {
+			s.evict(victim, EvictedExpired)
+		} else {
+			s.evict(victim, EvictedForSpace)
+		}
+	}
+
+	s.version++
+	e.version = s.version
+	s.items[key] = e
+	s.bytes += e.size()
+	s.queue.push(e)
+	return nil
+}
+
+// full reports whether an entry of the given size doesn't fit in the shard
+func (s *boundedShard) full(size int64) bool {
+	return (s.maxEntries > 0 && int64(len(s.items)) >= s.maxEntries) ||
+		(s.maxBytes > 0 && s.bytes+size > s.maxBytes)
+}
+
+func (s *boundedShard) evict(e *boundedEntry, reason EvictionReason) {
+	s.unlink(e)
+	s.evicted = append(s.evicted, boundedEviction{e.key, reason})
+}
+
+func (s *boundedShard) unlink(e *boundedEntry) {
+	s.queue.remove(e)
+	delete(s.items, e.key)
+	s.bytes -= e.size()
+}
+
+// evictionQueue orders the entries of a shard by eviction priority
+type evictionQueue interface {
+	push(e *boundedEntry)
+	touch(e *boundedEntry)
+	remove(e *boundedEntry)
+	// victim returns the next entry to evict
+	victim() *boundedEntry
+}
+
+// lruQueue keeps the most recently used entries at the front of a list
+type lruQueue struct {
+	entries *list.List
+}
+
+func (q *lruQueue) push(e *boundedEntry) {
+	e.element = q.entries.PushFront(e)
+}
+
+func (q *lruQueue) touch(e *boundedEntry) {
+	q.entries.MoveToFront(e.element)
+}
+
+func (q *lruQueue) remove(e *boundedEntry) {
+	q.entries.Remove(e.element)
+}
+
+func (q *lruQueue) victim() *boundedEntry {
+	return q.entries.Back().Value.(*boundedEntry)
+}
+
+// lfuQueue is a min-heap of entries ordered by number of hits, then by last
+// use
+type lfuQueue struct {
+	entries []*boundedEntry
+	clock   uint64
+}
+
+func (q *lfuQueue) push(e *boundedEntry) {
+	q.clock++
+	e.used = q.clock
+	heap.Push(q, e)
+}
+
+func (q *lfuQueue) touch(e *boundedEntry) {
+	q.clock++
+	e.hits++
+	e.used = q.clock
+	heap.Fix(q, e.index)
+}
+
+func (q *lfuQueue) remove(e *boundedEntry) {
+	heap.Remove(q, e.index)
+}
+
+func (q *lfuQueue) victim() *boundedEntry {
+	return q.entries[0]
+}
+
+// Len, Less, Swap, Push and Pop implement heap.Interface
+
+func (q *lfuQueue) Len() int {
+	return len(q.entries)
+}
+
+func (q *lfuQueue) Less(i, j int) bool {
+	a, b := q.entries[i], q.entries[j]
+	if a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.used < b.used
+}
+
+func (q *lfuQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.entries[i].index = i
+	q.entries[j].index = j
+}
+
+func (q *lfuQueue) Push(x interface{}) {
+	e := x.(*boundedEntry)
+	e.index = len(q.entries)
+	q.entries = append(q.entries, e)
+}
+
+func (q *lfuQueue) Pop() interface{} {
+	last := len(q.entries) - 1
+	e := q.entries[last]
+	q.entries[last] = nil
+	q.entries = q.entries[:last]
+	return e
+}
@@ -0,0 +1,131 @@
+package persistence
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var newBoundedStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+	return NewBoundedStore(BoundedOptions{MaxEntries: 1000, MaxBytes: 16 << 20}, defaultExpiration)
+}
+
+var newBoundedLFUStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+	return NewBoundedStore(BoundedOptions{MaxEntries: 1000, Policy: LFU}, defaultExpiration)
+}
+
+func TestBoundedCache_LRUEviction(t *testing.T) {
+	var evicted []string
+	cache := NewBoundedStore(BoundedOptions{
+		MaxEntries: 2,
+		Shards:     1,
+		OnEvict: func(key string, reason EvictionReason) {
+			if reason != EvictedForSpace {
+				t.Errorf("Expected %s to be evicted for space, got reason %d", key, reason)
+			}
+			evicted = append(evicted, key)
+		},
+	}, time.Hour)
+
+	var value string
+	cache.Set("a", "a", DEFAULT)
+	cache.Set("b", "b", DEFAULT)
+	cache.Get("a", &value)
+	cache.Set("c", "c", DEFAULT)
+
+	if strings.Join(evicted, ",") != "b" {
+		t.Errorf("Expected the least recently used b to be evicted, got %v", evicted)
+	}
+	if err := cache.Get("a", &value); err != nil {
+		t.Errorf("Expected a to be kept, got: %s", err)
+	}
+	stats := cache.Stats()
+	if stats.Entries != 2 || stats.Evictions != 1 || stats.Hits != 2 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestBoundedCache_LFUEviction(t *testing.T) {
+	cache := NewBoundedStore(BoundedOptions{MaxEntries: 2, Shards: 1, Policy: LFU}, time.Hour)
+
+	var value string
+	cache.Set("a", "a", DEFAULT)
+	cache.Set("b", "b", DEFAULT)
+	cache.Get("a", &value)
+	cache.Get("a", &value)
+	cache.Get("b", &value)
+	// b is the most recently used entry, but it is used less than a
+	cache.Set("c", "c", DEFAULT)
+	// c has never been used since it was set
+	cache.Set("d", "d", DEFAULT)
+
+	for _, key := range []string{"b", "c"} {
+		if err := cache.Get(key, &value); err != ErrCacheMiss {
+			t.Errorf("Expected %s to be evicted, got: %v", key, err)
+		}
+	}
+	for _, key := range []string{"a", "d"} {
+		if err := cache.Get(key, &value); err != nil {
+			t.Errorf("Expected %s to be kept, got: %s", key, err)
+		}
+	}
+}
+
+func TestBoundedCache_MaxBytes(t *testing.T) {
+	cache := NewBoundedStore(BoundedOptions{MaxBytes: 100, Shards: 1}, time.Hour)
+
+	value := strings.Repeat("x", 40)
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cache.Set(key, []byte(value), DEFAULT); err != nil {
+			t.Errorf("Error setting %s: %s", key, err)
+		}
+	}
+	if stats := cache.Stats(); stats.Entries != 2 || stats.Bytes != 82 || stats.Evictions != 1 {
+		t.Errorf("Expected the oldest entry to make room, got stats %+v", stats)
+	}
+
+	if err := cache.Set("c", []byte(strings.Repeat("x", 100)), DEFAULT); err != ErrNotStored {
+		t.Errorf("Expected a value larger than the cache not to be stored, got: %v", err)
+	}
+	var b []byte
+	if err := cache.Get("c", &b); err != ErrCacheMiss {
+		t.Errorf("Expected the previous value to be dropped, got: %v", err)
+	}
+}
+
+func TestBoundedCache_MaxBytesBelowShards(t *testing.T) {
+	// fewer bytes than the default shards
+	cache := NewBoundedStore(BoundedOptions{MaxBytes: 10}, time.Hour)
+	for i := 0; i < 100; i++ {
+		cache.Set("k"+strconv.Itoa(i), []byte("x"), DEFAULT)
+	}
+	if stats := cache.Stats(); stats.Bytes > 10 {
+		t.Errorf("Expected at most 10 bytes, got stats %+v", stats)
+	}
+}
+
+func TestBoundedCache_Expired(t *testing.T) {
+	reasons := make(map[string]EvictionReason)
+	cache := NewBoundedStore(BoundedOptions{
+		MaxEntries: 2,
+		Shards:     1,
+		OnEvict: func(key string, reason EvictionReason) {
+			reasons[key] = reason
+		},
+	}, time.Hour)
+
+	cache.Set("short", 1, time.Second)
+	cache.Set("long", 1, DEFAULT)
+	time.Sleep(1100 * time.Millisecond)
+	// short is the victim for space, but it has expired anyway
+	cache.Get("long", new(int))
+	cache.Set("new", 1, DEFAULT)
+
+	if reason, found := reasons["short"]; !found || reason != EvictedExpired {
+		t.Errorf("Expected short to be reported as expired, got %v", reasons)
+	}
+	if stats := cache.Stats(); stats.Expirations != 1 || stats.Evictions != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
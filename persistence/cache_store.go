@@ -1,7 +1,10 @@
 package persistence
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"sort"
 	"time"
 )
 
@@ -15,6 +18,9 @@ var (
 	ErrCacheMiss    = errors.New("cache: key not found.")
 	ErrNotStored    = errors.New("cache: not stored.")
 	ErrNotSupport   = errors.New("cache: not support.")
+	ErrCASConflict  = errors.New("cache: compare-and-swap conflict.")
+	ErrCircuitOpen  = errors.New("cache: circuit breaker open.")
+	ErrTimeout      = errors.New("cache: operation timed out.")
 )
 
 // CacheStore is the interface of a cache backend
@@ -37,12 +43,195 @@ type CacheStore interface {
 	// Delete removes an item from the cache. Does nothing if the key is not in the cache.
 	Delete(key string) error
 
-	// Increment increments a real number, and returns error if the value is not real
+	// Increment increments a real number, and returns error if the value is not real.
+	// The expiration of the item is left unchanged.
 	Increment(key string, data uint64) (uint64, error)
 
-	// Decrement decrements a real number, and returns error if the value is not real
+	// Decrement decrements a real number, and returns error if the value is not real.
+	// The expiration of the item is left unchanged.
 	Decrement(key string, data uint64) (uint64, error)
 
 	// Flush seletes all items from the cache.
 	Flush() error
 }
+
+// TTLCacheStore is implemented by cache backends that can report and change
+// the expiration of an item without rewriting it. Use the TTL and Touch
+// functions to check for this capability.
+type TTLCacheStore interface {
+	CacheStore
+
+	// TTL returns how long the item has left before it expires, or FOREVER if
+	// it never expires. Returns ErrCacheMiss if the item is not in the cache,
+	// or ErrNotSupport if the backend can only change expirations.
+	TTL(key string) (time.Duration, error)
+
+	// Touch sets a new expiration for an existing item. Returns ErrCacheMiss
+	// if the item is not in the cache.
+	Touch(key string, expire time.Duration) error
+}
+
+// TTL returns how long the item has left in store, or ErrNotSupport if store
+// can't tell.
+func TTL(store CacheStore, key string) (time.Duration, error) {
+	if ttlStore, ok := store.(TTLCacheStore); ok {
+		return ttlStore.TTL(key)
+	}
+	return 0, ErrNotSupport
+}
+
+// Touch sets a new expiration for the item in store, or returns ErrNotSupport
+// if store can't change it without rewriting the item.
+func Touch(store CacheStore, key string, expire time.Duration) error {
+	if ttlStore, ok := store.(TTLCacheStore); ok {
+		return ttlStore.Touch(key, expire)
+	}
+	return ErrNotSupport
+}
+
+// CASCacheStore is implemented by cache backends supporting optimistic
+// concurrency: a value read with GetWithVersion is only written back by
+// CompareAndSet if nobody changed it in between. Use the GetWithVersion and
+// CompareAndSet functions to check for this capability.
+type CASCacheStore interface {
+	CacheStore
+
+	// GetWithVersion retrieves an item like Get, along with its current version.
+	GetWithVersion(key string, value interface{}) (Version, error)
+
+	// CompareAndSet sets an item to the cache only if it still has the given
+	// version. Returns ErrCASConflict if the item changed since it was read, or
+	// ErrCacheMiss if it is no longer in the cache.
+	CompareAndSet(key string, value interface{}, version Version, expire time.Duration) error
+}
+
+// Version identifies the state of an item when it was read by GetWithVersion.
+// It is opaque, and only meaningful to the CompareAndSet of the same store.
+type Version struct {
+	cas uint64
+	// token holds the state of stores that can't express it as a number
+	token interface{}
+}
+
+// GetWithVersion retrieves an item and its version from store, or returns
+// ErrNotSupport if store doesn't support compare-and-swap.
+func GetWithVersion(store CacheStore, key string, value interface{}) (Version, error) {
+	if casStore, ok := store.(CASCacheStore); ok {
+		return casStore.GetWithVersion(key, value)
+	}
+	return Version{}, ErrNotSupport
+}
+
+// CompareAndSet sets an item to store if it still has version, or returns
+// ErrNotSupport if store doesn't support compare-and-swap.
+func CompareAndSet(store CacheStore, key string, value interface{}, version Version, expire time.Duration) error {
+	if casStore, ok := store.(CASCacheStore); ok {
+		return casStore.CompareAndSet(key, value, version, expire)
+	}
+	return ErrNotSupport
+}
+
+// BatchCacheStore is implemented by cache backends that can operate on many
+// keys at once. Use the GetMulti, SetMulti and DeleteMulti functions to fall
+// back to single calls for backends that do not implement it.
+type BatchCacheStore interface {
+	CacheStore
+
+	// GetMulti retrieves the items for all the keys of values, decoding each
+	// item into the pointer stored under its key. Keys that could not be
+	// retrieved are reported in a MultiError.
+	GetMulti(values map[string]interface{}) error
+
+	// SetMulti sets all the items of values to the cache, replacing any
+	// existing items. Keys that could not be stored are reported in a MultiError.
+	SetMulti(values map[string]interface{}, expire time.Duration) error
+
+	// DeleteMulti removes the items for keys from the cache. Keys that were not
+	// in the cache are reported as ErrCacheMiss in a MultiError.
+	DeleteMulti(keys ...string) error
+}
+
+// MultiError is returned by the batch operations when some of the keys failed.
+// It maps each failed key to its error.
+type MultiError map[string]error
+
+func (m MultiError) Error() string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "cache: %d keys failed:", len(m))
+	for _, key := range keys {
+		fmt.Fprintf(&buffer, " %s (%s)", key, m[key])
+	}
+	return buffer.String()
+}
+
+// errOrNil returns nil instead of an empty MultiError, so callers can compare
+// the result of a batch operation with nil.
+func (m MultiError) errOrNil() error {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// GetMulti retrieves many items from store, using a single call if store is
+// a BatchCacheStore.
+func GetMulti(store CacheStore, values map[string]interface{}) error {
+	if batch, ok := store.(BatchCacheStore); ok {
+		return batch.GetMulti(values)
+	}
+	return getEach(store, values)
+}
+
+// SetMulti sets many items to store, using a single call if store is a
+// BatchCacheStore.
+func SetMulti(store CacheStore, values map[string]interface{}, expire time.Duration) error {
+	if batch, ok := store.(BatchCacheStore); ok {
+		return batch.SetMulti(values, expire)
+	}
+	return setEach(store, values, expire)
+}
+
+// DeleteMulti removes many items from store, using a single call if store is
+// a BatchCacheStore.
+func DeleteMulti(store CacheStore, keys ...string) error {
+	if batch, ok := store.(BatchCacheStore); ok {
+		return batch.DeleteMulti(keys...)
+	}
+	return deleteEach(store, keys)
+}
+
+func getEach(store CacheStore, values map[string]interface{}) error {
+	errs := MultiError{}
+	for key, value := range values {
+		if err := store.Get(key, value); err != nil {
+			errs[key] = err
+		}
+	}
+	return errs.errOrNil()
+}
+
+func setEach(store CacheStore, values map[string]interface{}, expire time.Duration) error {
+	errs := MultiError{}
+	for key, value := range values {
+		if err := store.Set(key, value, expire); err != nil {
+			errs[key] = err
+		}
+	}
+	return errs.errOrNil()
+}
+
+func deleteEach(store CacheStore, keys []string) error {
+	errs := MultiError{}
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			errs[key] = err
+		}
+	}
+	return errs.errOrNil()
+}
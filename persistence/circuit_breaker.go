@@ -0,0 +1,328 @@
+package persistence
+
+import (
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a CircuitBreakerStore
+type BreakerState int
+
+const (
+	// BreakerClosed lets the operations through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen short-circuits the operations
+	BreakerOpen
+	// BreakerHalfOpen lets one operation through at a time to probe the store
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// CircuitBreakerOptions configures a CircuitBreakerStore
+type CircuitBreakerOptions struct {
+	// FailureThreshold is the number of consecutive failures opening the
+	// breaker, 5 by default. Misses and the other errors of the CacheStore
+	// contract aren't failures.
+	FailureThreshold int
+
+	// SlowThreshold makes the operations slower than it count as failures.
+	// Zero disables it.
+	SlowThreshold time.Duration
+
+	// OpenTimeout is how long the breaker stays open before probing the
+	// store, 30 seconds by default
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is the number of successful probes closing the breaker,
+	// 1 by default
+	HalfOpenProbes int
+
+	// OnStateChange is called when the state of the breaker changes
+	OnStateChange func(from, to BreakerState)
+}
+
+// CircuitBreakerStats counts what a CircuitBreakerStore did
+type CircuitBreakerStats struct {
+	State BreakerState
+	// Trips counts the times the breaker opened
+	Trips uint64
+	// ShortCircuits counts the operations not sent to the store
+	ShortCircuits uint64
+}
+
+// CircuitBreakerStore stops calling a store that keeps failing or is too slow,
+// so that the pages are served by their handlers instead of waiting for the
+// cache. While the breaker is open, Get is a miss, Set is dropped, and the
+// other operations fail with ErrCircuitOpen.
+type CircuitBreakerStore struct {
+	store            CacheStore
+	failureThreshold int
+	slowThreshold    time.Duration
+	openTimeout      time.Duration
+	halfOpenProbes   int
+	onStateChange    func(from, to BreakerState)
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int
+	successes int
+	openedAt  time.Time
+	probing   bool
+	stats     CircuitBreakerStats
+	// changes are reported to onStateChange once c.mu is released
+	changes []BreakerState
+}
+
+// NewCircuitBreakerStore returns a CircuitBreakerStore in front of store
+func NewCircuitBreakerStore(store CacheStore, options CircuitBreakerOptions) *CircuitBreakerStore {
+	c := &CircuitBreakerStore{
+		store:            store,
+		failureThreshold: options.FailureThreshold,
+		slowThreshold:    options.SlowThreshold,
+		openTimeout:      options.OpenTimeout,
+		halfOpenProbes:   options.HalfOpenProbes,
+		onStateChange:    options.OnStateChange,
+	}
+	if c.failureThreshold <= 0 {
+		c.failureThreshold = 5
+	}
+	if c.openTimeout <= 0 {
+		c.openTimeout = 30 * time.Second
+	}
+	if c.halfOpenProbes <= 0 {
+		c.halfOpenProbes = 1
+	}
+	return c
+}
+
+// State returns the state of the breaker
+func (c *CircuitBreakerStore) State() BreakerState {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.current(time.Now())
+}
+
+// Stats returns the state and counters of the breaker
+func (c *CircuitBreakerStore) Stats() CircuitBreakerStats {
+	c.mu.Lock()
+	defer c.unlock()
+	stats := c.stats
+	stats.State = c.current(time.Now())
+	return stats
+}
+
+// Get (see CacheStore interface)
+func (c *CircuitBreakerStore) Get(key string, value interface{}) error {
+	return c.call(ErrCacheMiss, func() error {
+		return c.store.Get(key, value)
+	})
+}
+
+// Set (see CacheStore interface)
+func (c *CircuitBreakerStore) Set(key string, value interface{}, expires time.Duration) error {
+	return c.call(nil, func() error {
+		return c.store.Set(key, value, expires)
+	})
+}
+
+// Add (see CacheStore interface)
+func (c *CircuitBreakerStore) Add(key string, value interface{}, expires time.Duration) error {
+	return c.call(ErrCircuitOpen, func() error {
+		return c.store.Add(key, value, expires)
+	})
+}
+
+// Replace (see CacheStore interface)
+func (c *CircuitBreakerStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return c.call(ErrCircuitOpen, func() error {
+		return c.store.Replace(key, value, expires)
+	})
+}
+
+// Delete (see CacheStore interface)
+func (c *CircuitBreakerStore) Delete(key string) error {
+	return c.call(ErrCircuitOpen, func() error {
+		return c.store.Delete(key)
+	})
+}
+
+// Increment (see CacheStore interface)
+func (c *CircuitBreakerStore) Increment(key string, delta uint64) (value uint64, err error) {
+	err = c.call(ErrCircuitOpen, func() (err error) {
+		value, err = c.store.Increment(key, delta)
+		return err
+	})
+	return value, err
+}
+
+// Decrement (see CacheStore interface)
+func (c *CircuitBreakerStore) Decrement(key string, delta uint64) (value uint64, err error) {
+	err = c.call(ErrCircuitOpen, func() (err error) {
+		value, err = c.store.Decrement(key, delta)
+		return err
+	})
+	return value, err
+}
+
+// Flush (see CacheStore interface)
+func (c *CircuitBreakerStore) Flush() error {
+	return c.call(ErrCircuitOpen, c.store.Flush)
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *CircuitBreakerStore) TTL(key string) (ttl time.Duration, err error) {
+	err = c.call(ErrCircuitOpen, func() (err error) {
+		ttl, err = TTL(c.store, key)
+		return err
+	})
+	return ttl, err
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *CircuitBreakerStore) Touch(key string, expires time.Duration) error {
+	return c.call(ErrCircuitOpen, func() error {
+		return Touch(c.store, key, expires)
+	})
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (c *CircuitBreakerStore) GetWithVersion(key string, value interface{}) (version Version, err error) {
+	err = c.call(ErrCacheMiss, func() (err error) {
+		version, err = GetWithVersion(c.store, key, value)
+		return err
+	})
+	return version, err
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (c *CircuitBreakerStore) CompareAndSet(key string, value interface{}, version Version, expires time.Duration) error {
+	return c.call(ErrCircuitOpen, func() error {
+		return CompareAndSet(c.store, key, value, version, expires)
+	})
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (c *CircuitBreakerStore) GetMulti(values map[string]interface{}) error {
+	misses := MultiError{}
+	for key := range values {
+		misses[key] = ErrCacheMiss
+	}
+	return c.call(misses.errOrNil(), func() error {
+		return GetMulti(c.store, values)
+	})
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *CircuitBreakerStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	return c.call(nil, func() error {
+		return SetMulti(c.store, values, expires)
+	})
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (c *CircuitBreakerStore) DeleteMulti(keys ...string) error {
+	return c.call(ErrCircuitOpen, func() error {
+		return DeleteMulti(c.store, keys...)
+	})
+}
+
+// call runs op if the breaker lets it through, and returns open otherwise
+func (c *CircuitBreakerStore) call(open error, op func() error) error {
+	if !c.allow() {
+		return open
+	}
+	start := time.Now()
+	err := op()
+	failed := isStoreFailure(err) || c.slowThreshold > 0 && time.Since(start) > c.slowThreshold
+	c.record(failed)
+	return err
+}
+
+// allow tells whether an operation can go to the store
+func (c *CircuitBreakerStore) allow() bool {
+	c.mu.Lock()
+	defer c.unlock()
+	switch c.current(time.Now()) {
+	case BreakerOpen:
+	case BreakerHalfOpen:
+		if !c.probing {
+			c.probing = true
+			return true
+		}
+	default:
+		return true
+	}
+	c.stats.ShortCircuits++
+	return false
+}
+
+// unlock releases c.mu, then reports the state changes
+func (c *CircuitBreakerStore) unlock() {
+	changes := c.changes
+	c.changes = nil
+	c.mu.Unlock()
+	if c.onStateChange != nil {
+		for i := 0; i+1 < len(changes); i += 2 {
+			c.onStateChange(changes[i], changes[i+1])
+		}
+	}
+}
+
+// record updates the breaker with the outcome of an operation
+func (c *CircuitBreakerStore) record(failed bool) {
+	c.mu.Lock()
+	defer c.unlock()
+	switch c.current(time.Now()) {
+	case BreakerHalfOpen:
+		c.probing = false
+		if failed {
+			c.trip()
+		} else if c.successes++; c.successes >= c.halfOpenProbes {
+			c.transition(BreakerClosed)
+		}
+	case BreakerClosed:
+		if !failed {
+			c.failures = 0
+		} else if c.failures++; c.failures >= c.failureThreshold {
+			c.trip()
+		}
+	}
+}
+
+// current returns the state of the breaker, moving it to half-open when it
+// has been open for long enough. It must be called with c.mu held, like the
+// methods below.
+func (c *CircuitBreakerStore) current(now time.Time) BreakerState {
+	if c.state == BreakerOpen && now.Sub(c.openedAt) >= c.openTimeout {
+		c.transition(BreakerHalfOpen)
+	}
+	return c.state
+}
+
+func (c *CircuitBreakerStore) trip() {
+	c.openedAt = time.Now()
+	c.stats.Trips++
+	c.transition(BreakerOpen)
+}
+
+func (c *CircuitBreakerStore) transition(state BreakerState) {
+	from := c.state
+	c.state = state
+	c.failures = 0
+	c.successes = 0
+	c.probing = false
+	if from != state {
+		c.changes = append(c.changes, from, state)
+	}
+}
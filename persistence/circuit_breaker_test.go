@@ -0,0 +1,111 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+var newCircuitBreakerStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+	return NewCircuitBreakerStore(NewInMemoryStore(defaultExpiration), CircuitBreakerOptions{})
+}
+
+func TestCircuitBreakerCache_Trip(t *testing.T) {
+	store := &downStore{CacheStore: NewInMemoryStore(time.Hour)}
+	var changes []string
+	cache := NewCircuitBreakerStore(store, CircuitBreakerOptions{
+		FailureThreshold: 2,
+		OpenTimeout:      200 * time.Millisecond,
+		OnStateChange: func(from, to BreakerState) {
+			changes = append(changes, from.String()+" -> "+to.String())
+		},
+	})
+
+	var value string
+	for i := 0; i < 10; i++ {
+		// misses don't trip the breaker
+		if err := cache.Get("key", &value); err != ErrCacheMiss {
+			t.Fatalf("Expected a miss, got %v", err)
+		}
+	}
+	store.down = true
+	for i := 0; i < 2; i++ {
+		if err := cache.Get("key", &value); err != errShardDown {
+			t.Errorf("Expected the error of the store, got %v", err)
+		}
+	}
+	if state := cache.State(); state != BreakerOpen {
+		t.Fatalf("Expected the breaker to be open, got %s", state)
+	}
+
+	// while open, Gets are misses and Sets are dropped
+	if err := cache.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected a miss, got %v", err)
+	}
+	if err := cache.Set("key", "value", DEFAULT); err != nil {
+		t.Errorf("Expected the set to be dropped, got %v", err)
+	}
+	if err := cache.Delete("key"); err != ErrCircuitOpen {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if stats := cache.Stats(); stats.Trips != 1 || stats.ShortCircuits != 3 {
+		t.Errorf("Expected 1 trip and 3 short circuits, got %+v", stats)
+	}
+
+	// a failed probe opens the breaker again
+	time.Sleep(250 * time.Millisecond)
+	if state := cache.State(); state != BreakerHalfOpen {
+		t.Fatalf("Expected the breaker to be half-open, got %s", state)
+	}
+	if err := cache.Set("key", "value", DEFAULT); err != errShardDown {
+		t.Errorf("Expected the probe to reach the store, got %v", err)
+	}
+	if state := cache.State(); state != BreakerOpen {
+		t.Fatalf("Expected the breaker to be open again, got %s", state)
+	}
+
+	// a successful probe closes it
+	store.down = false
+	time.Sleep(250 * time.Millisecond)
+	if err := cache.Set("key", "value", DEFAULT); err != nil {
+		t.Errorf("Expected the probe to succeed, got %v", err)
+	}
+	if state := cache.State(); state != BreakerClosed {
+		t.Errorf("Expected the breaker to be closed, got %s", state)
+	}
+
+	expected := []string{"closed -> open", "open -> half-open", "half-open -> open", "open -> half-open", "half-open -> closed"}
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected the changes %v, got %v", expected, changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Expected the changes %v, got %v", expected, changes)
+			break
+		}
+	}
+}
+
+// slowStore takes delay to answer Get
+type slowStore struct {
+	CacheStore
+	delay time.Duration
+}
+
+func (s *slowStore) Get(key string, value interface{}) error {
+	time.Sleep(s.delay)
+	return s.CacheStore.Get(key, value)
+}
+
+func TestCircuitBreakerCache_Slow(t *testing.T) {
+	cache := NewCircuitBreakerStore(&slowStore{NewInMemoryStore(time.Hour), 20 * time.Millisecond}, CircuitBreakerOptions{
+		FailureThreshold: 3,
+		SlowThreshold:    10 * time.Millisecond,
+	})
+	var value string
+	for i := 0; i < 3; i++ {
+		cache.Get("key", &value)
+	}
+	if state := cache.State(); state != BreakerOpen {
+		t.Errorf("Expected slow answers to open the breaker, got %s", state)
+	}
+}
@@ -0,0 +1,24 @@
+package persistence_test
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-contrib/cache/persistence/storetest"
+)
+
+func TestConformance(t *testing.T) {
+	names := make([]string, 0, len(persistence.StoreFactories))
+	for name := range persistence.StoreFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		factory := persistence.StoreFactories[name]
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			storetest.RunConformance(t, factory)
+		})
+	}
+}
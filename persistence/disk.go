@@ -0,0 +1,511 @@
+package persistence
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/utils"
+)
+
+const (
+	// diskFormat is the first byte of every file written by a DiskStore
+	diskFormat = 1
+	// diskHeaderSize is the size of the format, expiration and key length
+	// preceding the key and value in a file
+	diskHeaderSize = 1 + 8 + 4
+	// diskTempPrefix starts the names of the files being written
+	diskTempPrefix = ".tmp-"
+)
+
+var errDiskCorrupted = errors.New("cache: corrupted disk cache file.")
+
+// DiskOptions configures a DiskStore
+type DiskOptions struct {
+	// MaxBytes bounds the total size of the cache files. When it is reached,
+	// the least recently used items are removed. Zero means no limit.
+	MaxBytes int64
+}
+
+// DiskStore represents the cache with file system persistence. Each item is a
+// file named after the hash of its key, in a directory named after the first
+// two digits of the hash. The items left by a previous DiskStore in the same
+// directory are used again, but the directory can't be shared by running
+// processes. Expired items are removed when they are read, or to make room
+// for others.
+type DiskStore struct {
+	dir               string
+	maxBytes          int64
+	defaultExpiration time.Duration
+
+	// dirLocks serialize the reads and writes of the files of each directory,
+	// so that the items of the other directories don't wait for the disk
+	dirLocks [256]sync.Mutex
+
+	// mu guards the index
+	mu      sync.Mutex
+	entries map[string]*diskEntry
+	lru     *list.List
+	bytes   int64
+}
+
+// diskEntry indexes a cache file in memory
+type diskEntry struct {
+	key        string
+	size       int64
+	expiration time.Time
+	element    *list.Element
+}
+
+// NewDiskStore returns a DiskStore keeping its files under dir, which is
+// created if needed.
+func NewDiskStore(dir string, options DiskOptions, defaultExpiration time.Duration) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &DiskStore{
+		dir:               dir,
+		maxBytes:          options.MaxBytes,
+		defaultExpiration: defaultExpiration,
+		entries:           make(map[string]*diskEntry),
+		lru:               list.New(),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load indexes the files left in the directory, dropping the expired ones and
+// those that were not completely written
+func (c *DiskStore) load() error {
+	now := time.Now()
+	err := filepath.Walk(c.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), diskTempPrefix) {
+			return os.Remove(path)
+		}
+		key, expiration, err := readDiskHeader(path, info.Size())
+		if err != nil || path != c.path(key) {
+			if c.isItemPath(path) {
+				// an item whose write didn't reach the disk before a crash
+				return os.Remove(path)
+			}
+			// leave alone the files we didn't write
+			return nil
+		}
+		if !expiration.IsZero() && !expiration.After(now) {
+			return os.Remove(path)
+		}
+		c.index(key, info.Size(), expiration)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.shrink(0)
+	return nil
+}
+
+// Get (see CacheStore interface)
+func (c *DiskStore) Get(key string, value interface{}) error {
+	lock := c.dirLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	b, _, err := c.read(key)
+	if err != nil {
+		return err
+	}
+	return utils.Deserialize(b, value)
+}
+
+// Set (see CacheStore interface)
+func (c *DiskStore) Set(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool {
+		return true
+	})
+}
+
+// Add (see CacheStore interface)
+func (c *DiskStore) Add(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool {
+		return !found
+	})
+}
+
+// Replace (see CacheStore interface)
+func (c *DiskStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return c.store(key, value, expires, func(found bool) bool {
+		return found
+	})
+}
+
+// Delete (see CacheStore interface)
+func (c *DiskStore) Delete(key string) error {
+	lock := c.dirLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lookup(key) == nil {
+		return ErrCacheMiss
+	}
+	return c.remove(key)
+}
+
+// Increment (see CacheStore interface)
+func (c *DiskStore) Increment(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(current uint64) uint64 {
+		return current + delta
+	})
+}
+
+// Decrement (see CacheStore interface)
+func (c *DiskStore) Decrement(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(current uint64) uint64 {
+		if delta > current {
+			return 0
+		}
+		return current - delta
+	})
+}
+
+// Flush (see CacheStore interface)
+func (c *DiskStore) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if err := c.remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *DiskStore) TTL(key string) (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.lookup(key)
+	if e == nil {
+		return 0, ErrCacheMiss
+	}
+	if e.expiration.IsZero() {
+		return FOREVER, nil
+	}
+	return e.expiration.Sub(time.Now()), nil
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *DiskStore) Touch(key string, expires time.Duration) error {
+	lock := c.dirLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	b, _, err := c.read(key)
+	if err != nil {
+		return err
+	}
+	return c.write(key, b, c.expiration(expires), nil)
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (c *DiskStore) GetMulti(values map[string]interface{}) error {
+	return getEach(c, values)
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *DiskStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	return setEach(c, values, expires)
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (c *DiskStore) DeleteMulti(keys ...string) error {
+	return deleteEach(c, keys)
+}
+
+// Size returns the total size of the cache files
+func (c *DiskStore) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// DeleteExpired removes the files of the expired items, and returns how many
+// there were
+func (c *DiskStore) DeleteExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sweep()
+}
+
+// store writes value under key if ok, called with whether key holds a live
+// item, returns true
+func (c *DiskStore) store(key string, value interface{}, expires time.Duration, ok func(found bool) bool) error {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	lock := c.dirLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	return c.write(key, b, c.expiration(expires), ok)
+}
+
+// count updates the counter stored under key, keeping its expiration
+func (c *DiskStore) count(key string, next func(current uint64) uint64) (uint64, error) {
+	lock := c.dirLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	b, expiration, err := c.read(key)
+	if err != nil {
+		return 0, err
+	}
+	current, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n := next(current)
+	return n, c.write(key, []byte(strconv.FormatUint(n, 10)), expiration, nil)
+}
+
+// dirLock returns the lock of the directory of key
+func (c *DiskStore) dirLock(key string) *sync.Mutex {
+	sum := sha1.Sum([]byte(key))
+	return &c.dirLocks[sum[0]]
+}
+
+// lookup returns the index entry of key, removing it if it has expired. It
+// must be called with c.mu held, like shrink, sweep, remove, index and
+// unindex.
+func (c *DiskStore) lookup(key string) *diskEntry {
+	e, found := c.entries[key]
+	if !found {
+		return nil
+	}
+	if !e.expiration.IsZero() && !e.expiration.After(time.Now()) {
+		c.remove(key)
+		return nil
+	}
+	return e
+}
+
+// read returns the value and expiration stored under key. It must be called
+// with the lock of the directory of key held, like write.
+func (c *DiskStore) read(key string) ([]byte, time.Time, error) {
+	c.mu.Lock()
+	e := c.lookup(key)
+	c.mu.Unlock()
+	if e == nil {
+		return nil, time.Time{}, ErrCacheMiss
+	}
+	data, err := ioutil.ReadFile(c.path(key))
+	if err == nil && (len(data) < diskHeaderSize || data[0] != diskFormat) {
+		err = errDiskCorrupted
+	}
+	offset := 0
+	if err == nil {
+		if offset = diskHeaderSize + int(binary.BigEndian.Uint32(data[9:13])); offset > len(data) {
+			err = errDiskCorrupted
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		// the file is gone or damaged, forget about it
+		c.remove(key)
+		if os.IsNotExist(err) {
+			err = ErrCacheMiss
+		}
+		return nil, time.Time{}, err
+	}
+	// a no-op if the item was evicted meanwhile
+	c.lru.MoveToFront(e.element)
+	return data[offset:], e.expiration, nil
+}
+
+// write stores value under key if ok, called with whether key holds a live
+// item, returns true or is nil. It goes through a temporary file synced
+// before it is renamed, so that a crash never leaves a partially written item
+// behind.
+func (c *DiskStore) write(key string, value []byte, expiration time.Time, ok func(found bool) bool) error {
+	data := make([]byte, diskHeaderSize, diskHeaderSize+len(key)+len(value))
+	data[0] = diskFormat
+	if !expiration.IsZero() {
+		binary.BigEndian.PutUint64(data[1:9], uint64(expiration.UnixNano()))
+	}
+	binary.BigEndian.PutUint32(data[9:13], uint32(len(key)))
+	data = append(append(data, key...), value...)
+	size := int64(len(data))
+
+	c.mu.Lock()
+	if ok != nil && !ok(c.lookup(key) != nil) {
+		c.mu.Unlock()
+		return ErrNotStored
+	}
+	if c.maxBytes > 0 && size > c.maxBytes {
+		c.remove(key)
+		c.mu.Unlock()
+		return ErrNotStored
+	}
+	// make room before writing, counting the file being replaced as free
+	if e, found := c.entries[key]; found {
+		c.shrink(size - e.size)
+	} else {
+		c.shrink(size)
+	}
+	c.mu.Unlock()
+
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), diskTempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unindex(key)
+	c.index(key, size, expiration)
+	// the other items written meanwhile may have taken the room made above
+	c.shrink(0)
+	return nil
+}
+
+// shrink removes the expired items, then the least recently used ones, until
+// size more bytes fit within the limit. The item being written may be removed
+// too, but only when it doesn't fit next to any other item.
+func (c *DiskStore) shrink(size int64) {
+	if c.maxBytes <= 0 || c.bytes+size <= c.maxBytes {
+		return
+	}
+	c.sweep()
+	for c.bytes+size > c.maxBytes && c.lru.Len() > 0 {
+		c.remove(c.lru.Back().Value.(*diskEntry).key)
+	}
+}
+
+// sweep removes the expired items, and returns how many there were
+func (c *DiskStore) sweep() int {
+	now := time.Now()
+	n := 0
+	for key, e := range c.entries {
+		if !e.expiration.IsZero() && !e.expiration.After(now) {
+			c.remove(key)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *DiskStore) remove(key string) error {
+	c.unindex(key)
+	if err := os.Remove(c.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (c *DiskStore) index(key string, size int64, expiration time.Time) {
+	e := &diskEntry{key: key, size: size, expiration: expiration}
+	e.element = c.lru.PushFront(e)
+	c.entries[key] = e
+	c.bytes += size
+}
+
+func (c *DiskStore) unindex(key string) {
+	if e, found := c.entries[key]; found {
+		c.lru.Remove(e.element)
+		delete(c.entries, key)
+		c.bytes -= e.size
+	}
+}
+
+// path returns the file holding key
+func (c *DiskStore) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// isItemPath tells whether path is named like the file of an item, in which
+// case the file was written by a DiskStore
+func (c *DiskStore) isItemPath(path string) bool {
+	rel, err := filepath.Rel(c.dir, path)
+	if err != nil {
+		return false
+	}
+	dir, name := filepath.Split(rel)
+	if _, err := hex.DecodeString(name); err != nil || len(name) != 2*sha1.Size {
+		return false
+	}
+	return filepath.Clean(dir) == name[:2]
+}
+
+// expiration resolves DEFAULT and FOREVER to the time the item expires, the
+// zero time meaning never
+func (c *DiskStore) expiration(expires time.Duration) time.Time {
+	if expires == DEFAULT {
+		expires = c.defaultExpiration
+	}
+	if expires > 0 {
+		return time.Now().Add(expires)
+	}
+	return time.Time{}
+}
+
+// readDiskHeader returns the key and expiration of the item stored in the file
+// at path, which is size bytes long
+func readDiskHeader(path string, size int64) (string, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	defer f.Close()
+
+	header := make([]byte, diskHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || header[0] != diskFormat {
+		return "", time.Time{}, errDiskCorrupted
+	}
+	keyLength := int64(binary.BigEndian.Uint32(header[9:13]))
+	if keyLength > size-diskHeaderSize {
+		return "", time.Time{}, errDiskCorrupted
+	}
+	var expiration time.Time
+	if nanos := binary.BigEndian.Uint64(header[1:9]); nanos != 0 {
+		expiration = time.Unix(0, int64(nanos))
+	}
+	key := make([]byte, keyLength)
+	if _, err := io.ReadFull(f, key); err != nil {
+		return "", time.Time{}, errDiskCorrupted
+	}
+	return string(key), expiration, nil
+}
@@ -0,0 +1,142 @@
+package persistence
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var newDiskStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
+	store, err := NewDiskStore(t.TempDir(), DiskOptions{}, defaultExpiration)
+	if err != nil {
+		t.Fatalf("Error opening the disk store: %s", err)
+	}
+	return store
+}
+
+func TestDiskCache_Restart(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskStore(dir, DiskOptions{}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error opening the disk store: %s", err)
+	}
+	cache.Set("kept", "value", DEFAULT)
+	cache.Set("counter", 41, DEFAULT)
+	cache.Set("expired", "value", time.Second)
+	// files the store didn't write are left alone
+	foreign := filepath.Join(dir, "README")
+	ioutil.WriteFile(foreign, []byte("not a cache file"), 0644)
+	time.Sleep(1100 * time.Millisecond)
+
+	if cache, err = NewDiskStore(dir, DiskOptions{}, time.Hour); err != nil {
+		t.Fatalf("Error opening the disk store again: %s", err)
+	}
+	var value string
+	if err = cache.Get("kept", &value); err != nil || value != "value" {
+		t.Errorf("Expected the item to survive a restart, got %q, %v", value, err)
+	}
+	if n, err := cache.Increment("counter", 1); err != nil || n != 42 {
+		t.Errorf("Expected the counter to survive a restart, got %d, %v", n, err)
+	}
+	if err = cache.Get("expired", &value); err != ErrCacheMiss {
+		t.Errorf("Expected the expired item to be dropped, got: %v", err)
+	}
+	if _, err = os.Stat(foreign); err != nil {
+		t.Errorf("Expected the foreign file to be kept, got: %s", err)
+	}
+}
+
+func TestDiskCache_RestartAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDiskStore(dir, DiskOptions{}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error opening the disk store: %s", err)
+	}
+	cache.Set("kept", "value", DEFAULT)
+	cache.Set("truncated", "value", DEFAULT)
+	// the write of an item was lost in a crash
+	truncated := cache.path("truncated")
+	if err = os.Truncate(truncated, 3); err != nil {
+		t.Fatalf("Error truncating the item: %s", err)
+	}
+	foreign := filepath.Join(filepath.Dir(truncated), "notes.txt")
+	ioutil.WriteFile(foreign, []byte("not a cache file"), 0644)
+
+	if cache, err = NewDiskStore(dir, DiskOptions{}, time.Hour); err != nil {
+		t.Fatalf("Error opening the disk store again: %s", err)
+	}
+	if _, err = os.Stat(truncated); !os.IsNotExist(err) {
+		t.Errorf("Expected the truncated item to be removed, got: %v", err)
+	}
+	if _, err = os.Stat(foreign); err != nil {
+		t.Errorf("Expected the foreign file to be kept, got: %s", err)
+	}
+	var value string
+	if err = cache.Get("kept", &value); err != nil || value != "value" {
+		t.Errorf("Expected the item to survive a restart, got %q, %v", value, err)
+	}
+}
+
+func TestDiskCache_MaxBytes(t *testing.T) {
+	cache, err := NewDiskStore(t.TempDir(), DiskOptions{MaxBytes: 200}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error opening the disk store: %s", err)
+	}
+
+	value := []byte(strings.Repeat("x", 80))
+	cache.Set("a", value, DEFAULT)
+	cache.Set("b", value, DEFAULT)
+	// a becomes more recently used than b
+	cache.Get("a", new([]byte))
+	if err := cache.Set("c", value, DEFAULT); err != nil {
+		t.Errorf("Error setting c: %s", err)
+	}
+	if err := cache.Get("b", new([]byte)); err != ErrCacheMiss {
+		t.Errorf("Expected the least recently used item to be removed, got: %v", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if err := cache.Get(key, new([]byte)); err != nil {
+			t.Errorf("Expected %s to be kept, got: %s", key, err)
+		}
+	}
+	if size := cache.Size(); size > 200 {
+		t.Errorf("Expected at most 200 bytes on disk, got %d", size)
+	}
+
+	if err := cache.Set("d", []byte(strings.Repeat("x", 200)), DEFAULT); err != ErrNotStored {
+		t.Errorf("Expected an item larger than the limit not to be stored, got: %v", err)
+	}
+}
+
+func TestDiskCache_EvictExpiredFirst(t *testing.T) {
+	cache, err := NewDiskStore(t.TempDir(), DiskOptions{MaxBytes: 200}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error opening the disk store: %s", err)
+	}
+
+	value := []byte(strings.Repeat("x", 80))
+	cache.Set("a", value, DEFAULT)
+	cache.Set("b", value, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	// b expired, so it goes before a, the least recently used item
+	if err := cache.Set("c", value, DEFAULT); err != nil {
+		t.Errorf("Error setting c: %s", err)
+	}
+	for _, key := range []string{"a", "c"} {
+		if err := cache.Get(key, new([]byte)); err != nil {
+			t.Errorf("Expected %s to be kept, got: %s", key, err)
+		}
+	}
+
+	cache.Set("d", value, 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if n := cache.DeleteExpired(); n != 1 {
+		t.Errorf("Expected 1 expired item, got %d", n)
+	}
+	if size := cache.Size(); size > 200 {
+		t.Errorf("Expected at most 200 bytes on disk, got %d", size)
+	}
+}
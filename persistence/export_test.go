@@ -0,0 +1,39 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+// StoreFactories holds the stores of the tests by name, for the conformance
+// tests of the persistence_test package
+var StoreFactories = map[string]func(*testing.T, time.Duration) CacheStore{
+	"Basic":                 newBasicStore,
+	"InMemory":              newInMemoryStore,
+	"Bounded":               newBoundedStore,
+	"BoundedLFU":            newBoundedLFUStore,
+	"Disk":                  newDiskStore,
+	"Bolt":                  newBoltStore,
+	"SQL":                   newSQLStore,
+	"Tiered":                newTieredStore,
+	"Sharded":               newShardedStore,
+	"Replicated":            newReplicatedStore,
+	"CircuitBreaker":        newCircuitBreakerStore,
+	"Retry":                 newRetryStore,
+	"Redis":                 newRedisStore,
+	"RedisCluster":          newRedisClusterStore,
+	"RedisSentinel":         newRedisSentinelStore,
+	"Memcached":             newMemcachedStore,
+	"MemcachedBinary":       newMcStore,
+	"MemcachedBinaryConfig": newMcStoreWithConfig,
+}
+
+// basicStore hides the optional interfaces of the store it wraps, like a store
+// only implementing CacheStore
+type basicStore struct {
+	CacheStore
+}
+
+func newBasicStore(t *testing.T, defaultExpiration time.Duration) CacheStore {
+	return basicStore{newInMemoryStore(t, defaultExpiration)}
+}
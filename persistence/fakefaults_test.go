@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// fakeFaults injects network failures into the fake servers, so that tests can
+// check how the stores cope with a server going away or slowing down
+type fakeFaults struct {
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	drops   int
+	latency time.Duration
+}
+
+// DropConnections closes every open connection, as a server restart would
+func (f *fakeFaults) DropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+// DropNext makes the next n commands close their connection instead of being
+// answered
+func (f *fakeFaults) DropNext(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drops = n
+}
+
+// SetLatency delays the answer to every command by latency
+func (f *fakeFaults) SetLatency(latency time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = latency
+}
+
+// accept tracks an open connection, until release is called
+func (f *fakeFaults) accept(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns == nil {
+		f.conns = make(map[net.Conn]bool)
+	}
+	f.conns[conn] = true
+}
+
+func (f *fakeFaults) release(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, conn)
+	conn.Close()
+}
+
+// receive is called for every command received. It returns false when the
+// connection must be dropped instead of answering the command.
+func (f *fakeFaults) receive() bool {
+	f.mu.Lock()
+	latency, drop := f.latency, f.drops > 0
+	if drop {
+		f.drops--
+	}
+	f.mu.Unlock()
+	if drop {
+		return false
+	}
+	time.Sleep(latency)
+	return true
+}
@@ -0,0 +1,465 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemcached is an in-process server speaking enough of the memcached text
+// and binary protocols to exercise the memcached stores. Like memcached, it
+// tells the protocols apart by the first byte sent on each connection.
+type fakeMemcached struct {
+	fakeFaults
+	listener net.Listener
+
+	mu   sync.Mutex
+	data map[string]fakeMemcachedItem
+	cas  uint64
+}
+
+type fakeMemcachedItem struct {
+	value    []byte
+	flags    uint32
+	expireAt time.Time
+	cas      uint64
+}
+
+// fakeMemcachedStatus is the outcome of a command, named after the binary
+// protocol statuses
+type fakeMemcachedStatus uint16
+
+const (
+	fakeMemcachedOK         fakeMemcachedStatus = 0x00
+	fakeMemcachedNotFound   fakeMemcachedStatus = 0x01
+	fakeMemcachedExists     fakeMemcachedStatus = 0x02
+	fakeMemcachedNotStored  fakeMemcachedStatus = 0x05
+	fakeMemcachedNonNumeric fakeMemcachedStatus = 0x06
+	fakeMemcachedUnknown    fakeMemcachedStatus = 0x81
+)
+
+// fakeMemcachedHeader is the header of the binary protocol messages
+type fakeMemcachedHeader struct {
+	Magic    uint8
+	Op       uint8
+	KeyLen   uint16
+	ExtraLen uint8
+	DataType uint8
+	Status   uint16
+	BodyLen  uint32
+	Opaque   uint32
+	CAS      uint64
+}
+
+// opcodes of the binary protocol
+const (
+	mcOpGet      = 0x00
+	mcOpSet      = 0x01
+	mcOpAdd      = 0x02
+	mcOpReplace  = 0x03
+	mcOpDelete   = 0x04
+	mcOpIncr     = 0x05
+	mcOpDecr     = 0x06
+	mcOpQuit     = 0x07
+	mcOpFlush    = 0x08
+	mcOpNoop     = 0x0a
+	mcOpVersion  = 0x0b
+	mcOpGetK     = 0x0c
+	mcOpTouch    = 0x1c
+	mcOpGAT      = 0x1d
+	mcOpSASLList = 0x20
+)
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start fake memcached: %s", err)
+	}
+	s := &fakeMemcached{
+		listener: listener,
+		data:     make(map[string]fakeMemcachedItem),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeMemcached) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeMemcached) Close() {
+	s.listener.Close()
+	s.DropConnections()
+}
+
+// Has reports whether key holds a live value
+func (s *fakeMemcached) Has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.get(key)
+	return found
+}
+
+func (s *fakeMemcached) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeMemcached) handle(conn net.Conn) {
+	s.accept(conn)
+	defer s.release(conn)
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == 0x80 {
+		s.serveBinary(r, w)
+	} else {
+		s.serveText(r, w)
+	}
+}
+
+func (s *fakeMemcached) serveText(r *bufio.Reader, w *bufio.Writer) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if !s.receive() {
+			return
+		}
+		cmd, args := fields[0], fields[1:]
+		noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+		if noreply {
+			args = args[:len(args)-1]
+		}
+
+		var reply string
+		switch cmd {
+		case "get", "gets":
+			var b strings.Builder
+			for _, key := range args {
+				item, found := s.lookup(key)
+				if !found {
+					continue
+				}
+				if cmd == "gets" {
+					fmt.Fprintf(&b, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.value), item.cas)
+				} else {
+					fmt.Fprintf(&b, "VALUE %s %d %d\r\n", key, item.flags, len(item.value))
+				}
+				b.Write(item.value)
+				b.WriteString("\r\n")
+			}
+			reply = b.String() + "END"
+		case "set", "add", "replace", "cas":
+			if len(args) < 4 || (cmd == "cas" && len(args) < 5) {
+				reply = "ERROR"
+				break
+			}
+			flags, _ := strconv.ParseUint(args[1], 10, 32)
+			exptime, _ := strconv.ParseInt(args[2], 10, 64)
+			size, err := strconv.Atoi(args[3])
+			if err != nil || size < 0 {
+				reply = "CLIENT_ERROR bad data chunk"
+				break
+			}
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return
+			}
+			var cas uint64
+			if cmd == "cas" {
+				cas, _ = strconv.ParseUint(args[4], 10, 64)
+			}
+			status, _ := s.store(cmd, args[0], value[:size], uint32(flags), exptime, cas)
+			reply = map[fakeMemcachedStatus]string{
+				fakeMemcachedOK:        "STORED",
+				fakeMemcachedNotFound:  "NOT_FOUND",
+				fakeMemcachedExists:    "EXISTS",
+				fakeMemcachedNotStored: "NOT_STORED",
+			}[status]
+		case "delete":
+			reply = "DELETED"
+			if s.delete(args[0], 0) != fakeMemcachedOK {
+				reply = "NOT_FOUND"
+			}
+		case "incr", "decr":
+			delta, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				reply = "CLIENT_ERROR invalid numeric delta argument"
+				break
+			}
+			value, status := s.incr(args[0], delta, cmd == "incr")
+			switch status {
+			case fakeMemcachedOK:
+				reply = strconv.FormatUint(value, 10)
+			case fakeMemcachedNotFound:
+				reply = "NOT_FOUND"
+			default:
+				reply = "CLIENT_ERROR cannot increment or decrement non-numeric value"
+			}
+		case "touch":
+			exptime, _ := strconv.ParseInt(args[1], 10, 64)
+			reply = "TOUCHED"
+			if s.touch(args[0], exptime) != fakeMemcachedOK {
+				reply = "NOT_FOUND"
+			}
+		case "flush_all":
+			s.flush()
+			reply = "OK"
+		case "version":
+			reply = "VERSION 1.6.0-fake"
+		case "quit":
+			return
+		default:
+			reply = "ERROR"
+		}
+		if noreply {
+			continue
+		}
+		w.WriteString(reply + "\r\n")
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeMemcached) serveBinary(r *bufio.Reader, w *bufio.Writer) {
+	for {
+		var req fakeMemcachedHeader
+		if err := binary.Read(r, binary.BigEndian, &req); err != nil {
+			return
+		}
+		body := make([]byte, req.BodyLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		if !s.receive() {
+			return
+		}
+		extras := body[:req.ExtraLen]
+		key := string(body[req.ExtraLen : int(req.ExtraLen)+int(req.KeyLen)])
+		value := body[int(req.ExtraLen)+int(req.KeyLen):]
+
+		res := fakeMemcachedHeader{Magic: 0x81, Op: req.Op, Opaque: req.Opaque}
+		var resExtras, resKey, resValue []byte
+		switch req.Op {
+		case mcOpGet, mcOpGetK, mcOpGAT:
+			var item fakeMemcachedItem
+			found := false
+			if req.Op == mcOpGAT {
+				if s.touch(key, int64(binary.BigEndian.Uint32(extras))) == fakeMemcachedOK {
+					item, found = s.lookup(key)
+				}
+			} else {
+				item, found = s.lookup(key)
+			}
+			if !found {
+				res.Status = uint16(fakeMemcachedNotFound)
+				break
+			}
+			resExtras = make([]byte, 4)
+			binary.BigEndian.PutUint32(resExtras, item.flags)
+			if req.Op == mcOpGetK {
+				resKey = []byte(key)
+			}
+			resValue, res.CAS = item.value, item.cas
+		case mcOpSet, mcOpAdd, mcOpReplace:
+			cmd := map[uint8]string{mcOpSet: "set", mcOpAdd: "add", mcOpReplace: "replace"}[req.Op]
+			if req.CAS != 0 {
+				cmd = "cas"
+			}
+			flags := binary.BigEndian.Uint32(extras[0:4])
+			exptime := int64(binary.BigEndian.Uint32(extras[4:8]))
+			status, cas := s.store(cmd, key, value, flags, exptime, req.CAS)
+			// the binary protocol reports the failed add and replace with
+			// the state of the key rather than with not stored
+			if status == fakeMemcachedNotStored {
+				status = fakeMemcachedExists
+				if req.Op == mcOpReplace {
+					status = fakeMemcachedNotFound
+				}
+			}
+			res.Status, res.CAS = uint16(status), cas
+		case mcOpDelete:
+			res.Status = uint16(s.delete(key, req.CAS))
+		case mcOpIncr, mcOpDecr:
+			delta := binary.BigEndian.Uint64(extras[0:8])
+			initial := binary.BigEndian.Uint64(extras[8:16])
+			exptime := binary.BigEndian.Uint32(extras[16:20])
+			n, status := s.incr(key, delta, req.Op == mcOpIncr)
+			if status == fakeMemcachedNotFound && exptime != 0xffffffff {
+				// the counter is created with its initial value
+				status, _ = s.store("add", key, []byte(strconv.FormatUint(initial, 10)), 0, int64(exptime), 0)
+				n = initial
+			}
+			res.Status = uint16(status)
+			if status == fakeMemcachedOK {
+				resValue = make([]byte, 8)
+				binary.BigEndian.PutUint64(resValue, n)
+				item, _ := s.lookup(key)
+				res.CAS = item.cas
+			}
+		case mcOpTouch:
+			res.Status = uint16(s.touch(key, int64(binary.BigEndian.Uint32(extras))))
+		case mcOpFlush:
+			s.flush()
+		case mcOpNoop, mcOpQuit:
+		case mcOpVersion:
+			resValue = []byte("1.6.0-fake")
+		default:
+			// including the SASL commands, which tells the clients that the
+			// server doesn't require authentication
+			res.Status = uint16(fakeMemcachedUnknown)
+		}
+
+		res.ExtraLen, res.KeyLen = uint8(len(resExtras)), uint16(len(resKey))
+		res.BodyLen = uint32(len(resExtras) + len(resKey) + len(resValue))
+		binary.Write(w, binary.BigEndian, res)
+		w.Write(resExtras)
+		w.Write(resKey)
+		w.Write(resValue)
+		if w.Flush() != nil || req.Op == mcOpQuit {
+			return
+		}
+	}
+}
+
+// lookup returns a copy of the live item for key
+func (s *fakeMemcached) lookup(key string) (fakeMemcachedItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, found := s.get(key)
+	item.value = append([]byte(nil), item.value...)
+	return item, found
+}
+
+// get returns the live item for key; it must be called with s.mu held
+func (s *fakeMemcached) get(key string) (fakeMemcachedItem, bool) {
+	item, found := s.data[key]
+	if found && !item.expireAt.IsZero() && !item.expireAt.After(time.Now()) {
+		delete(s.data, key)
+		return fakeMemcachedItem{}, false
+	}
+	return item, found
+}
+
+// put stores item under key with a new cas; it must be called with s.mu held
+func (s *fakeMemcached) put(key string, item fakeMemcachedItem) uint64 {
+	s.cas++
+	item.cas = s.cas
+	s.data[key] = item
+	return item.cas
+}
+
+// store runs the set, add, replace and cas commands
+func (s *fakeMemcached) store(cmd, key string, value []byte, flags uint32, exptime int64, cas uint64) (fakeMemcachedStatus, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current, exists := s.get(key)
+	switch {
+	case cmd == "add" && exists, cmd == "replace" && !exists:
+		return fakeMemcachedNotStored, 0
+	case cmd == "cas" && !exists:
+		return fakeMemcachedNotFound, 0
+	case cmd == "cas" && current.cas != cas:
+		return fakeMemcachedExists, 0
+	}
+	item := fakeMemcachedItem{
+		value:    append([]byte(nil), value...),
+		flags:    flags,
+		expireAt: fakeMemcachedExpiration(exptime),
+	}
+	return fakeMemcachedOK, s.put(key, item)
+}
+
+func (s *fakeMemcached) delete(key string, cas uint64) fakeMemcachedStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, found := s.get(key)
+	switch {
+	case !found:
+		return fakeMemcachedNotFound
+	case cas != 0 && item.cas != cas:
+		return fakeMemcachedExists
+	}
+	delete(s.data, key)
+	return fakeMemcachedOK
+}
+
+// incr adds delta to the counter at key, or subtracts it down to zero,
+// keeping its expiration. Like memcached, increments wrap around.
+func (s *fakeMemcached) incr(key string, delta uint64, incr bool) (uint64, fakeMemcachedStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, found := s.get(key)
+	if !found {
+		return 0, fakeMemcachedNotFound
+	}
+	n, err := strconv.ParseUint(string(item.value), 10, 64)
+	if err != nil {
+		return 0, fakeMemcachedNonNumeric
+	}
+	switch {
+	case incr:
+		n += delta
+	case delta > n:
+		n = 0
+	default:
+		n -= delta
+	}
+	item.value = []byte(strconv.FormatUint(n, 10))
+	s.put(key, item)
+	return n, fakeMemcachedOK
+}
+
+func (s *fakeMemcached) touch(key string, exptime int64) fakeMemcachedStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, found := s.get(key)
+	if !found {
+		return fakeMemcachedNotFound
+	}
+	item.expireAt = fakeMemcachedExpiration(exptime)
+	s.data[key] = item
+	return fakeMemcachedOK
+}
+
+func (s *fakeMemcached) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = make(map[string]fakeMemcachedItem)
+}
+
+// fakeMemcachedExpiration converts an expiration time of the protocols:
+// zero never expires, up to 30 days is relative to now, and anything above is
+// a unix timestamp
+func fakeMemcachedExpiration(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now()
+	case exptime > 60*60*24*30:
+		return time.Unix(exptime, 0)
+	}
+	return time.Now().Add(time.Duration(exptime) * time.Second)
+}
@@ -0,0 +1,511 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server speaking enough RESP to exercise the redis
+// stores. Tests can answer commands themselves through intercept, for
+// instance to reply with cluster redirections.
+type fakeRedis struct {
+	fakeFaults
+	listener net.Listener
+
+	mu        sync.Mutex
+	data      map[string]fakeRedisItem
+	role      string
+	masters   map[string]string
+	slots     []fakeRedisSlots
+	intercept func(conn *fakeRedisConn, cmd string, args []string) interface{}
+	commands  []string
+	loaded    map[string]bool
+	// subscribers of each pub/sub channel
+	subscribers map[string][]*fakeRedisConn
+}
+
+// fakeRedisScripts emulates the Lua scripts of the redis stores, keyed by the
+// SHA1 of their source. They are called with the fake's lock held.
+var fakeRedisScripts = map[string]func(s *fakeRedis, keys, args []string) interface{}{
+	redisIncrScript.Hash(): func(s *fakeRedis, keys, args []string) interface{} {
+		if _, found := s.get(keys[0]); !found {
+			return nil
+		}
+		return s.incrBy(keys[0], args[0])
+	},
+	redisDecrScript.Hash(): func(s *fakeRedis, keys, args []string) interface{} {
+		item, found := s.get(keys[0])
+		if !found {
+			return nil
+		}
+		current, err := strconv.ParseInt(string(item.value), 10, 64)
+		if err != nil {
+			return fakeRedisError("ERR value is not an integer or out of range")
+		}
+		delta, _ := strconv.ParseInt(args[0], 10, 64)
+		if delta >= current {
+			return s.incrBy(keys[0], strconv.FormatInt(-current, 10))
+		}
+		return s.incrBy(keys[0], strconv.FormatInt(-delta, 10))
+	},
+}
+
+type fakeRedisItem struct {
+	value    []byte
+	expireAt time.Time
+}
+
+// fakeRedisSlots is a range of slots reported by CLUSTER SLOTS
+type fakeRedisSlots struct {
+	start, end int
+	address    string
+}
+
+// fakeRedisConn holds the per-connection state of the fake
+type fakeRedisConn struct {
+	// mu guards w, as published messages are written by other connections
+	mu sync.Mutex
+	w  *bufio.Writer
+
+	asking  bool
+	watched map[string]fakeRedisItem
+	queued  [][]string // commands of the open MULTI, if not nil
+}
+
+// reply types written by the fake, in addition to int64, []byte, nil and
+// []interface{}
+type (
+	fakeRedisStatus string
+	fakeRedisError  string
+)
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start fake redis: %s", err)
+	}
+	return newFakeRedisWithListener(listener)
+}
+
+func newFakeRedisWithListener(listener net.Listener) *fakeRedis {
+	s := &fakeRedis{
+		listener: listener,
+		data:     make(map[string]fakeRedisItem),
+		role:     "master",
+		masters:  make(map[string]string),
+		loaded:   make(map[string]bool),
+
+		subscribers: make(map[string][]*fakeRedisConn),
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeRedis) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRedis) Close() {
+	s.listener.Close()
+	s.DropConnections()
+}
+
+// Commands returns the commands received so far, as upper-case names
+func (s *fakeRedis) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+// Has reports whether key holds a live value
+func (s *fakeRedis) Has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.get(key)
+	return found
+}
+
+// Configure changes the fake's configuration under its lock
+func (s *fakeRedis) Configure(configure func(s *fakeRedis)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	configure(s)
+}
+
+func (s *fakeRedis) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeRedis) handle(conn net.Conn) {
+	s.accept(conn)
+	defer s.release(conn)
+	r := bufio.NewReader(conn)
+	state := &fakeRedisConn{w: bufio.NewWriter(conn)}
+	defer s.unsubscribe(state)
+	for {
+		command, err := readFakeRedisCommand(r)
+		if err != nil {
+			return
+		}
+		if len(command) == 0 {
+			continue
+		}
+		if !s.receive() {
+			return
+		}
+		if err := state.write(s.exec(state, strings.ToUpper(command[0]), command[1:])); err != nil {
+			return
+		}
+	}
+}
+
+func (c *fakeRedisConn) write(reply interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeFakeRedisReply(c.w, reply)
+	return c.w.Flush()
+}
+
+func (s *fakeRedis) unsubscribe(conn *fakeRedisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for channel, subscribers := range s.subscribers {
+		for i, subscriber := range subscribers {
+			if subscriber == conn {
+				s.subscribers[channel] = append(subscribers[:i:i], subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (s *fakeRedis) exec(conn *fakeRedisConn, cmd string, args []string) interface{} {
+	s.mu.Lock()
+	s.commands = append(s.commands, cmd)
+	intercept := s.intercept
+	s.mu.Unlock()
+
+	if intercept != nil {
+		if reply := intercept(conn, cmd, args); reply != nil {
+			return reply
+		}
+	}
+	if cmd == "ASKING" {
+		conn.asking = true
+		return fakeRedisStatus("OK")
+	}
+	conn.asking = false
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd {
+	case "WATCH":
+		if conn.watched == nil {
+			conn.watched = make(map[string]fakeRedisItem)
+		}
+		for _, key := range args {
+			conn.watched[key], _ = s.get(key)
+		}
+		return fakeRedisStatus("OK")
+	case "UNWATCH":
+		conn.watched = nil
+		return fakeRedisStatus("OK")
+	case "MULTI":
+		conn.queued = [][]string{}
+		return fakeRedisStatus("OK")
+	case "DISCARD":
+		conn.queued, conn.watched = nil, nil
+		return fakeRedisStatus("OK")
+	case "EXEC":
+		return s.execMulti(conn)
+	case "SUBSCRIBE":
+		// the client only ever subscribes to a single channel at a time
+		s.subscribers[args[0]] = append(s.subscribers[args[0]], conn)
+		return []interface{}{[]byte("subscribe"), []byte(args[0]), int64(1)}
+	}
+	if conn.queued != nil {
+		conn.queued = append(conn.queued, append([]string{cmd}, args...))
+		return fakeRedisStatus("QUEUED")
+	}
+	return s.run(cmd, args)
+}
+
+// execMulti runs the queued commands of conn, unless one of its watched keys
+// changed. It must be called with s.mu held.
+func (s *fakeRedis) execMulti(conn *fakeRedisConn) interface{} {
+	queued, watched := conn.queued, conn.watched
+	conn.queued, conn.watched = nil, nil
+	if queued == nil {
+		return fakeRedisError("ERR EXEC without MULTI")
+	}
+	for key, before := range watched {
+		now, _ := s.get(key)
+		if !bytes.Equal(now.value, before.value) || !now.expireAt.Equal(before.expireAt) {
+			return nil
+		}
+	}
+	replies := make([]interface{}, len(queued))
+	for i, command := range queued {
+		replies[i] = s.run(command[0], command[1:])
+	}
+	return replies
+}
+
+// run executes a command; it must be called with s.mu held
+func (s *fakeRedis) run(cmd string, args []string) interface{} {
+	switch cmd {
+	case "PING":
+		return fakeRedisStatus("PONG")
+	case "PUBLISH":
+		for _, subscriber := range s.subscribers[args[0]] {
+			subscriber.write([]interface{}{[]byte("message"), []byte(args[0]), []byte(args[1])})
+		}
+		return int64(len(s.subscribers[args[0]]))
+	case "AUTH", "SELECT":
+		return fakeRedisStatus("OK")
+	case "ROLE":
+		return []interface{}{[]byte(s.role)}
+	case "SENTINEL":
+		if len(args) == 2 && strings.ToLower(args[0]) == "get-master-addr-by-name" {
+			address, found := s.masters[args[1]]
+			if !found {
+				return nil
+			}
+			host, port, _ := net.SplitHostPort(address)
+			return []interface{}{[]byte(host), []byte(port)}
+		}
+	case "CLUSTER":
+		if len(args) == 1 && strings.ToUpper(args[0]) == "SLOTS" {
+			var ranges []interface{}
+			for _, r := range s.slots {
+				host, port, _ := net.SplitHostPort(r.address)
+				p, _ := strconv.ParseInt(port, 10, 64)
+				ranges = append(ranges, []interface{}{
+					int64(r.start), int64(r.end), []interface{}{[]byte(host), p},
+				})
+			}
+			return ranges
+		}
+	case "FLUSHALL", "FLUSHDB":
+		s.data = make(map[string]fakeRedisItem)
+		return fakeRedisStatus("OK")
+	case "GET":
+		if item, found := s.get(args[0]); found {
+			return item.value
+		}
+		return nil
+	case "MGET":
+		values := make([]interface{}, len(args))
+		for i, key := range args {
+			if item, found := s.get(key); found {
+				values[i] = item.value
+			}
+		}
+		return values
+	case "EXISTS":
+		_, found := s.get(args[0])
+		return fakeRedisBool(found)
+	case "DEL":
+		var deleted int64
+		for _, key := range args {
+			if _, found := s.get(key); found {
+				delete(s.data, key)
+				deleted++
+			}
+		}
+		return deleted
+	case "PTTL":
+		item, found := s.get(args[0])
+		switch {
+		case !found:
+			return int64(-2)
+		case item.expireAt.IsZero():
+			return int64(-1)
+		}
+		return int64(item.expireAt.Sub(time.Now()) / time.Millisecond)
+	case "PEXPIRE", "PERSIST":
+		item, found := s.get(args[0])
+		if !found || (cmd == "PERSIST" && item.expireAt.IsZero()) {
+			return int64(0)
+		}
+		item.expireAt = time.Time{}
+		if cmd == "PEXPIRE" {
+			ms, _ := strconv.ParseInt(args[1], 10, 64)
+			item.expireAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.data[args[0]] = item
+		return int64(1)
+	case "SETEX":
+		seconds, _ := strconv.Atoi(args[1])
+		s.data[args[0]] = fakeRedisItem{[]byte(args[2]), time.Now().Add(time.Duration(seconds) * time.Second)}
+		return fakeRedisStatus("OK")
+	case "SET":
+		return s.set(args)
+	case "INCRBY":
+		return s.incrBy(args[0], args[1])
+	case "DECRBY":
+		if strings.HasPrefix(args[1], "-") {
+			return s.incrBy(args[0], args[1][1:])
+		}
+		return s.incrBy(args[0], "-"+args[1])
+	case "SCRIPT":
+		if len(args) == 2 && strings.ToUpper(args[0]) == "LOAD" {
+			hash := fakeRedisHash(args[1])
+			s.loaded[hash] = true
+			return []byte(hash)
+		}
+	case "EVAL", "EVALSHA":
+		hash := args[0]
+		if cmd == "EVAL" {
+			hash = fakeRedisHash(args[0])
+			s.loaded[hash] = true
+		}
+		script, found := fakeRedisScripts[hash]
+		if !found || !s.loaded[hash] {
+			return fakeRedisError("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		numKeys, _ := strconv.Atoi(args[1])
+		return script(s, args[2:2+numKeys], args[2+numKeys:])
+	}
+	return fakeRedisError(fmt.Sprintf("ERR unknown command '%s'", cmd))
+}
+
+// get returns the live item for key; it must be called with s.mu held
+func (s *fakeRedis) get(key string) (fakeRedisItem, bool) {
+	item, found := s.data[key]
+	if found && !item.expireAt.IsZero() && !item.expireAt.After(time.Now()) {
+		delete(s.data, key)
+		return fakeRedisItem{}, false
+	}
+	return item, found
+}
+
+// incrBy adds delta to the counter stored at key, keeping its expiry
+func (s *fakeRedis) incrBy(key, delta string) interface{} {
+	item, _ := s.get(key)
+	current := int64(0)
+	if item.value != nil {
+		var err error
+		if current, err = strconv.ParseInt(string(item.value), 10, 64); err != nil {
+			return fakeRedisError("ERR value is not an integer or out of range")
+		}
+	}
+	n, err := strconv.ParseInt(delta, 10, 64)
+	if err != nil {
+		return fakeRedisError("ERR value is not an integer or out of range")
+	}
+	item.value = []byte(strconv.FormatInt(current+n, 10))
+	s.data[key] = item
+	return current + n
+}
+
+func fakeRedisHash(src string) string {
+	h := sha1.New()
+	io.WriteString(h, src)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *fakeRedis) set(args []string) interface{} {
+	item := fakeRedisItem{value: []byte(args[1])}
+	_, exists := s.get(args[0])
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			if exists {
+				return nil
+			}
+		case "XX":
+			if !exists {
+				return nil
+			}
+		case "EX", "PX":
+			i++
+			n, _ := strconv.ParseInt(args[i], 10, 64)
+			unit := time.Second
+			if strings.ToUpper(args[i-1]) == "PX" {
+				unit = time.Millisecond
+			}
+			item.expireAt = time.Now().Add(time.Duration(n) * unit)
+		}
+	}
+	s.data[args[0]] = item
+	return fakeRedisStatus("OK")
+}
+
+func fakeRedisBool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		// inline command
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	command := make([]string, n)
+	for i := range command {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimRight(header, "\r\n")[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		command[i] = string(buf[:size])
+	}
+	return command, nil
+}
+
+func writeFakeRedisReply(w *bufio.Writer, reply interface{}) {
+	switch reply := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case fakeRedisStatus:
+		fmt.Fprintf(w, "+%s\r\n", reply)
+	case fakeRedisError:
+		fmt.Fprintf(w, "-%s\r\n", reply)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", reply)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(reply))
+		w.Write(reply)
+		w.WriteString("\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(reply))
+		for _, value := range reply {
+			writeFakeRedisReply(w, value)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package persistence
 
 import (
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/robfig/go-cache"
@@ -10,11 +11,31 @@ import (
 //InMemoryStore represents the cache with memory persistence
 type InMemoryStore struct {
 	cache.Cache
+	defaultExpiration time.Duration
+
+	// go-cache doesn't expose the expiration of its items, so the writes
+	// record it here under mu, along with the version of each item
+	mu          sync.Mutex
+	expirations map[string]time.Time
+	versions    map[string]uint64
+	version     uint64
+	pruned      time.Time
+
+	// periodic snapshots, see NewInMemoryStoreWithSnapshots
+	snapshotPath   string
+	stopSnapshots  chan struct{}
+	snapshotsDone  chan struct{}
+	closeSnapshots sync.Once
 }
 
 // NewInMemoryStore returns a InMemoryStore
 func NewInMemoryStore(defaultExpiration time.Duration) *InMemoryStore {
-	return &InMemoryStore{*cache.New(defaultExpiration, time.Minute)}
+	return &InMemoryStore{
+		Cache:             *cache.New(defaultExpiration, time.Minute),
+		defaultExpiration: defaultExpiration,
+		expirations:       make(map[string]time.Time),
+		versions:          make(map[string]uint64),
+	}
 }
 
 // Get (see CacheStore interface)
@@ -23,7 +44,10 @@ func (c *InMemoryStore) Get(key string, value interface{}) error {
 	if !found {
 		return ErrCacheMiss
 	}
+	return assign(val, value)
+}
 
+func assign(val interface{}, value interface{}) error {
 	v := reflect.ValueOf(value)
 	if v.Type().Kind() == reflect.Ptr && v.Elem().CanSet() {
 		v.Elem().Set(reflect.ValueOf(val))
@@ -34,30 +58,48 @@ func (c *InMemoryStore) Get(key string, value interface{}) error {
 
 // Set (see CacheStore interface)
 func (c *InMemoryStore) Set(key string, value interface{}, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	// NOTE: go-cache understands the values of DEFAULT and FOREVER
 	c.Cache.Set(key, value, expires)
+	c.setExpiration(key, expires)
+	c.bumpVersion(key)
 	return nil
 }
 
 // Add (see CacheStore interface)
 func (c *InMemoryStore) Add(key string, value interface{}, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	err := c.Cache.Add(key, value, expires)
 	if err == cache.ErrKeyExists {
 		return ErrNotStored
 	}
+	if err == nil {
+		c.setExpiration(key, expires)
+		c.bumpVersion(key)
+	}
 	return err
 }
 
 // Replace (see CacheStore interface)
 func (c *InMemoryStore) Replace(key string, value interface{}, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if err := c.Cache.Replace(key, value, expires); err != nil {
 		return ErrNotStored
 	}
+	c.setExpiration(key, expires)
+	c.bumpVersion(key)
 	return nil
 }
 
 // Delete (see CacheStore interface)
 func (c *InMemoryStore) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.expirations, key)
+	delete(c.versions, key)
 	if found := c.Cache.Delete(key); !found {
 		return ErrCacheMiss
 	}
@@ -66,24 +108,147 @@ func (c *InMemoryStore) Delete(key string) error {
 
 // Increment (see CacheStore interface)
 func (c *InMemoryStore) Increment(key string, n uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	newValue, err := c.Cache.Increment(key, n)
 	if err == cache.ErrCacheMiss {
 		return 0, ErrCacheMiss
 	}
+	if err == nil {
+		c.bumpVersion(key)
+	}
 	return newValue, err
 }
 
 // Decrement (see CacheStore interface)
 func (c *InMemoryStore) Decrement(key string, n uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	newValue, err := c.Cache.Decrement(key, n)
 	if err == cache.ErrCacheMiss {
 		return 0, ErrCacheMiss
 	}
+	if err == nil {
+		c.bumpVersion(key)
+	}
 	return newValue, err
 }
 
 // Flush (see CacheStore interface)
 func (c *InMemoryStore) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.Cache.Flush()
+	c.expirations = make(map[string]time.Time)
+	c.versions = make(map[string]uint64)
+	return nil
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *InMemoryStore) TTL(key string) (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.Cache.Get(key); !found {
+		delete(c.expirations, key)
+		return 0, ErrCacheMiss
+	}
+	expiration, found := c.expirations[key]
+	if !found || expiration.IsZero() {
+		return FOREVER, nil
+	}
+	if ttl := expiration.Sub(time.Now()); ttl > 0 {
+		return ttl, nil
+	}
+	return 0, ErrCacheMiss
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *InMemoryStore) Touch(key string, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, found := c.Cache.Get(key)
+	if !found {
+		return ErrCacheMiss
+	}
+	c.Cache.Set(key, value, expires)
+	c.setExpiration(key, expires)
+	return nil
+}
+
+// setExpiration records when key expires, following the rules go-cache
+// applies to DEFAULT and FOREVER. It must be called with c.mu held.
+func (c *InMemoryStore) setExpiration(key string, expires time.Duration) {
+	if expires == DEFAULT {
+		expires = c.defaultExpiration
+	}
+	if expires > 0 {
+		c.expirations[key] = time.Now().Add(expires)
+	} else {
+		c.expirations[key] = time.Time{}
+	}
+
+	// go-cache drops expired items on its own, forget about them too
+	if now := time.Now(); now.Sub(c.pruned) > time.Minute {
+		for k, expiration := range c.expirations {
+			if !expiration.IsZero() && expiration.Before(now) {
+				delete(c.expirations, k)
+				delete(c.versions, k)
+			}
+		}
+		c.pruned = now
+	}
+}
+
+// bumpVersion gives key a new version. It must be called with c.mu held.
+func (c *InMemoryStore) bumpVersion(key string) uint64 {
+	c.version++
+	c.versions[key] = c.version
+	return c.version
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (c *InMemoryStore) GetWithVersion(key string, value interface{}) (Version, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val, found := c.Cache.Get(key)
+	if !found {
+		return Version{}, ErrCacheMiss
+	}
+	version, found := c.versions[key]
+	if !found {
+		// the item was written straight to the embedded go-cache
+		version = c.bumpVersion(key)
+	}
+	return Version{cas: version}, assign(val, value)
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (c *InMemoryStore) CompareAndSet(key string, value interface{}, version Version, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.Cache.Get(key); !found {
+		return ErrCacheMiss
+	}
+	if version.cas == 0 || c.versions[key] != version.cas {
+		return ErrCASConflict
+	}
+	c.Cache.Set(key, value, expires)
+	c.setExpiration(key, expires)
+	c.bumpVersion(key)
 	return nil
 }
+
+// GetMulti (see BatchCacheStore interface)
+func (c *InMemoryStore) GetMulti(values map[string]interface{}) error {
+	return getEach(c, values)
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *InMemoryStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	return setEach(c, values, expires)
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (c *InMemoryStore) DeleteMulti(keys ...string) error {
+	return deleteEach(c, keys)
+}
@@ -0,0 +1,197 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-contrib/cache/utils"
+)
+
+// inMemorySnapshotVersion is written in every snapshot, so that the format
+// can change without misreading older snapshots
+const inMemorySnapshotVersion = 1
+
+var errInMemoryClosed = errors.New("cache: snapshots already closed.")
+
+type inMemorySnapshot struct {
+	Version int
+	Items   []inMemorySnapshotItem
+}
+
+type inMemorySnapshotItem struct {
+	Key   string
+	Value interface{}
+	// Expiration is the zero time for items that never expire
+	Expiration time.Time
+}
+
+// inMemoryCacheItem mirrors the items of go-cache, to decode what its Save
+// writes
+type inMemoryCacheItem struct {
+	Object interface{}
+	// Expiration is nil for items that never expire
+	Expiration *time.Time
+}
+
+// SaveTo writes a snapshot of the items of the store to w, including those
+// written to the embedded Cache directly. The values are encoded with gob, so
+// their types must be registered with gob.Register, like
+// RegisterResponseCacheGob does for the cached pages, in the process loading
+// the snapshot.
+func (c *InMemoryStore) SaveTo(w io.Writer) error {
+	items, err := c.cacheItems()
+	if err != nil {
+		return err
+	}
+	snapshot := inMemorySnapshot{Version: inMemorySnapshotVersion}
+	now := time.Now()
+	for key, item := range items {
+		var expiration time.Time
+		if item.Expiration != nil {
+			if !item.Expiration.After(now) {
+				continue
+			}
+			expiration = *item.Expiration
+		}
+		snapshot.Items = append(snapshot.Items, inMemorySnapshotItem{key, item.Object, expiration})
+	}
+	b, err := utils.Serialize(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// cacheItems returns the items of the embedded Cache with their expiration,
+// which go-cache only gives out through Save. Save registers the types of
+// the values with gob, and doesn't lock the Cache itself.
+func (c *InMemoryStore) cacheItems() (items map[string]*inMemoryCacheItem, err error) {
+	var b bytes.Buffer
+	c.Cache.Lock()
+	err = c.Cache.Save(&b)
+	c.Cache.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("cache: can't encode the items with gob: %v", err)
+	}
+	if err := gob.NewDecoder(&b).Decode(&items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// LoadFrom adds the items of a snapshot written by SaveTo to the store, with
+// the expiration they had. Expired items, and items whose key is already in
+// the store, are skipped.
+func (c *InMemoryStore) LoadFrom(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var snapshot inMemorySnapshot
+	if err := utils.Deserialize(b, &snapshot); err != nil {
+		return err
+	}
+	if snapshot.Version != inMemorySnapshotVersion {
+		return fmt.Errorf("cache: unsupported snapshot version %d", snapshot.Version)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, item := range snapshot.Items {
+		expires := FOREVER
+		if !item.Expiration.IsZero() {
+			if expires = item.Expiration.Sub(time.Now()); expires <= 0 {
+				continue
+			}
+		}
+		if c.Cache.Add(item.Key, item.Value, expires) == nil {
+			c.setExpiration(item.Key, expires)
+			c.bumpVersion(item.Key)
+		}
+	}
+	return nil
+}
+
+// SaveToFile writes a snapshot of the store to the file at path. The snapshot
+// replaces the file atomically, so that a crash never leaves half of it.
+func (c *InMemoryStore) SaveToFile(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	err = c.SaveTo(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// LoadFromFile adds the items of the snapshot at path to the store
+func (c *InMemoryStore) LoadFromFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.LoadFrom(f)
+}
+
+// NewInMemoryStoreWithSnapshots returns an InMemoryStore loaded from the
+// snapshot at path, if there is one, and saving a new snapshot there every
+// interval. Call Close on shutdown to save the last snapshot.
+func NewInMemoryStoreWithSnapshots(defaultExpiration time.Duration, path string, interval time.Duration) (*InMemoryStore, error) {
+	c := NewInMemoryStore(defaultExpiration)
+	if err := c.LoadFromFile(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	c.snapshotPath = path
+	c.stopSnapshots = make(chan struct{})
+	c.snapshotsDone = make(chan struct{})
+	go func() {
+		defer close(c.snapshotsDone)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := c.SaveToFile(path); err != nil {
+					log.Println(err.Error())
+				}
+			case <-c.stopSnapshots:
+				return
+			}
+		}
+	}()
+	return c, nil
+}
+
+// Close stops the periodic snapshots of a store returned by
+// NewInMemoryStoreWithSnapshots and saves a last snapshot. It does nothing
+// for other stores.
+func (c *InMemoryStore) Close() error {
+	if c.stopSnapshots == nil {
+		return nil
+	}
+	err := errInMemoryClosed
+	c.closeSnapshots.Do(func() {
+		close(c.stopSnapshots)
+		<-c.snapshotsDone
+		err = c.SaveToFile(c.snapshotPath)
+	})
+	return err
+}
@@ -1,6 +1,8 @@
 package persistence
 
 import (
+	"bytes"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -10,26 +12,107 @@ var newInMemoryStore = func(_ *testing.T, defaultExpiration time.Duration) Cache
 }
 
 // Test typical cache interactions
-func TestInMemoryCache_TypicalGetSet(t *testing.T) {
-	typicalGetSet(t, newInMemoryStore)
-}
 
-func TestInMemoryCache_IncrDecr(t *testing.T) {
-	incrDecr(t, newInMemoryStore)
+type snapshotValue struct {
+	Name  string
+	Count int
 }
 
-func TestInMemoryCache_Expiration(t *testing.T) {
-	expiration(t, newInMemoryStore)
-}
+func TestInMemoryCache_SaveLoad(t *testing.T) {
+	cache := NewInMemoryStore(time.Hour)
+	cache.Set("string", "value", DEFAULT)
+	cache.Set("struct", snapshotValue{"name", 3}, FOREVER)
+	cache.Set("counter", 41, time.Minute)
+	cache.Set("expired", "value", time.Second)
+	time.Sleep(1100 * time.Millisecond)
+
+	var snapshot bytes.Buffer
+	if err := cache.SaveTo(&snapshot); err != nil {
+		t.Fatalf("Error saving the cache: %s", err)
+	}
+
+	restored := NewInMemoryStore(time.Hour)
+	restored.Set("string", "newer", DEFAULT)
+	if err := restored.LoadFrom(&snapshot); err != nil {
+		t.Fatalf("Error loading the cache: %s", err)
+	}
 
-func TestInMemoryCache_EmptyCache(t *testing.T) {
-	emptyCache(t, newInMemoryStore)
+	var s string
+	if err := restored.Get("string", &s); err != nil || s != "newer" {
+		t.Errorf("Expected the existing item to be kept, got %q, %v", s, err)
+	}
+	var v snapshotValue
+	if err := restored.Get("struct", &v); err != nil || v != (snapshotValue{"name", 3}) {
+		t.Errorf("Expected the struct to be restored, got %+v, %v", v, err)
+	}
+	if ttl, err := restored.TTL("struct"); err != nil || ttl != FOREVER {
+		t.Errorf("Expected the struct to never expire, got %s, %v", ttl, err)
+	}
+	if ttl, err := restored.TTL("counter"); err != nil || ttl > 59*time.Second || ttl < 50*time.Second {
+		t.Errorf("Expected the counter to keep its remaining TTL, got %s, %v", ttl, err)
+	}
+	if n, err := restored.Increment("counter", 1); err != nil || n != 42 {
+		t.Errorf("Expected the counter to be restored, got %d, %v", n, err)
+	}
+	if err := restored.Get("expired", &s); err != ErrCacheMiss {
+		t.Errorf("Expected the expired item to be skipped, got: %v", err)
+	}
 }
 
-func TestInMemoryCache_Replace(t *testing.T) {
-	testReplace(t, newInMemoryStore)
+func TestInMemoryCache_SaveDirectWrites(t *testing.T) {
+	cache := NewInMemoryStore(time.Hour)
+	// written to the embedded go-cache, bypassing the store
+	cache.Cache.Set("direct", "value", time.Minute)
+
+	var snapshot bytes.Buffer
+	if err := cache.SaveTo(&snapshot); err != nil {
+		t.Fatalf("Error saving the cache: %s", err)
+	}
+	restored := NewInMemoryStore(time.Hour)
+	if err := restored.LoadFrom(&snapshot); err != nil {
+		t.Fatalf("Error loading the cache: %s", err)
+	}
+	var s string
+	if err := restored.Get("direct", &s); err != nil || s != "value" {
+		t.Errorf("Expected the item to be restored, got %q, %v", s, err)
+	}
+	if ttl, err := restored.TTL("direct"); err != nil || ttl > time.Minute || ttl < 50*time.Second {
+		t.Errorf("Expected the item to keep its expiration, got %s, %v", ttl, err)
+	}
 }
 
-func TestInMemoryCache_Add(t *testing.T) {
-	testAdd(t, newInMemoryStore)
+func TestInMemoryCache_Snapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	cache, err := NewInMemoryStoreWithSnapshots(time.Hour, path, 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error creating the cache: %s", err)
+	}
+	cache.Set("periodic", "value", DEFAULT)
+	time.Sleep(300 * time.Millisecond)
+
+	// a crash doesn't lose the items saved by the last periodic snapshot
+	crashed := NewInMemoryStore(time.Hour)
+	var s string
+	if err := crashed.LoadFromFile(path); err != nil || crashed.Get("periodic", &s) != nil {
+		t.Errorf("Expected the periodic snapshot to hold the item, got: %v", err)
+	}
+
+	cache.Set("shutdown", "value", DEFAULT)
+	if err := cache.Close(); err != nil {
+		t.Fatalf("Error closing the cache: %s", err)
+	}
+	if err := cache.Close(); err != errInMemoryClosed {
+		t.Errorf("Expected a second Close to fail, got: %v", err)
+	}
+
+	restarted, err := NewInMemoryStoreWithSnapshots(time.Hour, path, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating the cache again: %s", err)
+	}
+	defer restarted.Close()
+	for _, key := range []string{"periodic", "shutdown"} {
+		if err := restarted.Get(key, &s); err != nil || s != "value" {
+			t.Errorf("Expected %s to survive the restart, got %q, %v", key, s, err)
+		}
+	}
 }
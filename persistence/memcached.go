@@ -59,6 +59,83 @@ func (c *MemcachedStore) Decrement(key string, delta uint64) (uint64, error) {
 	return newValue, convertMemcacheError(err)
 }
 
+// TTL (see TTLCacheStore interface)
+func (c *MemcachedStore) TTL(key string) (time.Duration, error) {
+	return 0, ErrNotSupport
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *MemcachedStore) Touch(key string, expires time.Duration) error {
+	return convertMemcacheError(c.Client.Touch(key, int32(c.expiration(expires)/time.Second)))
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (c *MemcachedStore) GetWithVersion(key string, value interface{}) (Version, error) {
+	item, err := c.Client.Get(key)
+	if err != nil {
+		return Version{}, convertMemcacheError(err)
+	}
+	// gomemcache keeps the cas id private to its items, so the version holds
+	// on to the item itself
+	return Version{token: item}, utils.Deserialize(item.Value, value)
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (c *MemcachedStore) CompareAndSet(key string, value interface{}, version Version, expires time.Duration) error {
+	read, ok := version.token.(*memcache.Item)
+	if !ok || read.Key != key {
+		return ErrCASConflict
+	}
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	item := *read
+	item.Value = b
+	item.Expiration = int32(c.expiration(expires) / time.Second)
+	err = c.Client.CompareAndSwap(&item)
+	if err == memcache.ErrNotStored {
+		return ErrCacheMiss
+	}
+	return convertMemcacheError(err)
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (c *MemcachedStore) GetMulti(values map[string]interface{}) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	items, err := c.Client.GetMulti(keys)
+	if err != nil {
+		return convertMemcacheError(err)
+	}
+
+	errs := MultiError{}
+	for key, value := range values {
+		item, found := items[key]
+		if !found {
+			errs[key] = ErrCacheMiss
+			continue
+		}
+		if err := utils.Deserialize(item.Value, value); err != nil {
+			errs[key] = err
+		}
+	}
+	return errs.errOrNil()
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *MemcachedStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	// the memcached text protocol has no multi-key storage command
+	return setEach(c, values, expires)
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (c *MemcachedStore) DeleteMulti(keys ...string) error {
+	return deleteEach(c, keys)
+}
+
 // Flush (see CacheStore interface)
 func (c *MemcachedStore) Flush() error {
 	return ErrNotSupport
@@ -67,13 +144,6 @@ func (c *MemcachedStore) Flush() error {
 func (c *MemcachedStore) invoke(storeFn func(*memcache.Client, *memcache.Item) error,
 	key string, value interface{}, expire time.Duration) error {
 
-	switch expire {
-	case DEFAULT:
-		expire = c.defaultExpiration
-	case FOREVER:
-		expire = time.Duration(0)
-	}
-
 	b, err := utils.Serialize(value)
 	if err != nil {
 		return err
@@ -81,10 +151,22 @@ func (c *MemcachedStore) invoke(storeFn func(*memcache.Client, *memcache.Item) e
 	return convertMemcacheError(storeFn(c.Client, &memcache.Item{
 		Key:        key,
 		Value:      b,
-		Expiration: int32(expire / time.Second),
+		Expiration: int32(c.expiration(expire) / time.Second),
 	}))
 }
 
+// expiration resolves DEFAULT and FOREVER, memcached uses 0 for items that
+// never expire
+func (c *MemcachedStore) expiration(expire time.Duration) time.Duration {
+	switch expire {
+	case DEFAULT:
+		expire = c.defaultExpiration
+	case FOREVER:
+		expire = time.Duration(0)
+	}
+	return expire
+}
+
 func convertMemcacheError(err error) error {
 	switch err {
 	case nil:
@@ -93,6 +175,8 @@ func convertMemcacheError(err error) error {
 		return ErrCacheMiss
 	case memcache.ErrNotStored:
 		return ErrNotStored
+	case memcache.ErrCASConflict:
+		return ErrCASConflict
 	}
 
 	return err
@@ -8,20 +8,40 @@ import (
 )
 
 // MemcachedBinaryStore represents the cache with memcached persistence using
-// the binary protocol
+// the binary protocol. The key hasher of a mc Client isn't safe for
+// concurrent use, so the store spreads its calls over a pool of clients, each
+// with its own hasher and used by one call at a time. The embedded Client
+// isn't part of the pool, and must not be used concurrently.
 type MemcachedBinaryStore struct {
 	*mc.Client
 	defaultExpiration time.Duration
+	clients           chan *mc.Client
 }
 
+// memcachedBinaryClients is the number of clients of a MemcachedBinaryStore,
+// which bounds its concurrent calls. Each client has its own connections.
+const memcachedBinaryClients = 8
+
 // NewMemcachedBinaryStore returns a MemcachedBinaryStore
 func NewMemcachedBinaryStore(hostList, username, password string, defaultExpiration time.Duration) *MemcachedBinaryStore {
-	return &MemcachedBinaryStore{mc.NewMC(hostList, username, password), defaultExpiration}
+	return NewMemcachedBinaryStoreWithConfig(hostList, username, password, defaultExpiration, mc.DefaultConfig())
 }
 
-// NewMemcachedBinaryStoreWithConfig returns a MemcachedBinaryStore using the provided configuration
+// NewMemcachedBinaryStoreWithConfig returns a MemcachedBinaryStore using the
+// provided configuration. The clients of the pool use copies of config with
+// a hasher of their own.
 func NewMemcachedBinaryStoreWithConfig(hostList, username, password string, defaultExpiration time.Duration, config *mc.Config) *MemcachedBinaryStore {
-	return &MemcachedBinaryStore{mc.NewMCwithConfig(hostList, username, password, config), defaultExpiration}
+	s := &MemcachedBinaryStore{
+		Client:            mc.NewMCwithConfig(hostList, username, password, config),
+		defaultExpiration: defaultExpiration,
+		clients:           make(chan *mc.Client, memcachedBinaryClients),
+	}
+	for i := 0; i < memcachedBinaryClients; i++ {
+		clientConfig := *config
+		clientConfig.Hasher = mc.NewModuloHasher()
+		s.clients <- mc.NewMCwithConfig(hostList, username, password, &clientConfig)
+	}
+	return s
 }
 
 // Set (see CacheStore interface)
@@ -31,7 +51,9 @@ func (s *MemcachedBinaryStore) Set(key string, value interface{}, expires time.D
 	if err != nil {
 		return err
 	}
-	_, err = s.Client.Set(key, string(b), 0, exp, 0)
+	client := s.client()
+	_, err = client.Set(key, string(b), 0, exp, 0)
+	s.release(client)
 	return convertMcError(err)
 }
 
@@ -42,7 +64,9 @@ func (s *MemcachedBinaryStore) Add(key string, value interface{}, expires time.D
 	if err != nil {
 		return err
 	}
-	_, err = s.Client.Add(key, string(b), 0, exp)
+	client := s.client()
+	_, err = client.Add(key, string(b), 0, exp)
+	s.release(client)
 	return convertMcError(err)
 }
 
@@ -53,13 +77,17 @@ func (s *MemcachedBinaryStore) Replace(key string, value interface{}, expires ti
 	if err != nil {
 		return err
 	}
-	_, err = s.Client.Replace(key, string(b), 0, exp, 0)
+	client := s.client()
+	_, err = client.Replace(key, string(b), 0, exp, 0)
+	s.release(client)
 	return convertMcError(err)
 }
 
 // Get (see CacheStore interface)
 func (s *MemcachedBinaryStore) Get(key string, value interface{}) error {
-	val, _, _, err := s.Client.Get(key)
+	client := s.client()
+	val, _, _, err := client.Get(key)
+	s.release(client)
 	if err != nil {
 		return convertMcError(err)
 	}
@@ -68,24 +96,88 @@ func (s *MemcachedBinaryStore) Get(key string, value interface{}) error {
 
 // Delete (see CacheStore interface)
 func (s *MemcachedBinaryStore) Delete(key string) error {
-	return convertMcError(s.Client.Del(key))
+	client := s.client()
+	err := client.Del(key)
+	s.release(client)
+	return convertMcError(err)
 }
 
 // Increment (see CacheStore interface)
 func (s *MemcachedBinaryStore) Increment(key string, delta uint64) (uint64, error) {
-	n, _, err := s.Client.Incr(key, delta, 0, 0xffffffff, 0)
+	client := s.client()
+	n, _, err := client.Incr(key, delta, 0, 0xffffffff, 0)
+	s.release(client)
 	return n, convertMcError(err)
 }
 
 // Decrement (see CacheStore interface)
 func (s *MemcachedBinaryStore) Decrement(key string, delta uint64) (uint64, error) {
-	n, _, err := s.Client.Decr(key, delta, 0, 0xffffffff, 0)
+	client := s.client()
+	n, _, err := client.Decr(key, delta, 0, 0xffffffff, 0)
+	s.release(client)
 	return n, convertMcError(err)
 }
 
+// TTL (see TTLCacheStore interface)
+func (s *MemcachedBinaryStore) TTL(key string) (time.Duration, error) {
+	return 0, ErrNotSupport
+}
+
+// Touch (see TTLCacheStore interface)
+func (s *MemcachedBinaryStore) Touch(key string, expires time.Duration) error {
+	client := s.client()
+	_, err := client.Touch(key, s.getExpiration(expires))
+	s.release(client)
+	return convertMcError(err)
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (s *MemcachedBinaryStore) GetWithVersion(key string, value interface{}) (Version, error) {
+	client := s.client()
+	val, _, cas, err := client.Get(key)
+	s.release(client)
+	if err != nil {
+		return Version{}, convertMcError(err)
+	}
+	return Version{cas: cas}, utils.Deserialize([]byte(val), value)
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (s *MemcachedBinaryStore) CompareAndSet(key string, value interface{}, version Version, expires time.Duration) error {
+	// a zero cas would make the set unconditional
+	if version.cas == 0 {
+		return ErrCASConflict
+	}
+	exp := s.getExpiration(expires)
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	client := s.client()
+	_, err = client.Set(key, string(b), 0, exp, version.cas)
+	s.release(client)
+	if err == mc.ErrKeyExists {
+		return ErrCASConflict
+	}
+	return convertMcError(err)
+}
+
 // Flush (see CacheStore interface)
 func (s *MemcachedBinaryStore) Flush() error {
-	return convertMcError(s.Client.Flush(0))
+	client := s.client()
+	err := client.Flush(0)
+	s.release(client)
+	return convertMcError(err)
+}
+
+// Quit closes the connections of the embedded Client and of the pool. The
+// store must not be used afterwards.
+func (s *MemcachedBinaryStore) Quit() {
+	s.Client.Quit()
+	for i := 0; i < memcachedBinaryClients; i++ {
+		client := s.client()
+		client.Quit()
+	}
 }
 
 // getExpiration converts a gin-contrib/cache expiration in the form of a
@@ -105,6 +197,16 @@ func (s *MemcachedBinaryStore) getExpiration(expires time.Duration) uint32 {
 	return exp
 }
 
+// client takes a client from the pool, waiting for one to be released
+func (s *MemcachedBinaryStore) client() *mc.Client {
+	return <-s.clients
+}
+
+// release gives a client taken with client back to the pool
+func (s *MemcachedBinaryStore) release(client *mc.Client) {
+	s.clients <- client
+}
+
 func convertMcError(err error) error {
 	switch err {
 	case nil:
@@ -7,77 +7,34 @@ import (
 	"github.com/memcachier/mc"
 )
 
-// These tests require memcached running on localhost:11211 (the default)
-const localhost = "localhost:11211"
-
 var newMcStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
-	mcStore := NewMemcachedBinaryStore(localhost, "", "", defaultExpiration)
-	err := mcStore.Flush()
-	if err == nil {
-		return mcStore
-	}
-	t.Errorf("Failed to connect to memcached on %s with %s", localhost, err)
-	t.FailNow()
-	panic("")
-}
-
-func TestMemcachedBinary_TypicalGetSet(t *testing.T) {
-	typicalGetSet(t, newMcStore)
-}
-
-func TestMemcachedBinary_IncrDecr(t *testing.T) {
-	incrDecr(t, newMcStore)
-}
-
-func TestMemcachedBinary_Expiration(t *testing.T) {
-	expiration(t, newMcStore)
-}
-
-func TestMemcachedBinary_EmptyCache(t *testing.T) {
-	emptyCache(t, newMcStore)
-}
-
-func TestMemcachedBinary_Replace(t *testing.T) {
-	testReplace(t, newMcStore)
-}
-
-func TestMemcachedBinary_Add(t *testing.T) {
-	testAdd(t, newMcStore)
+	server := newFakeMemcached(t)
+	t.Cleanup(server.Close)
+	return NewMemcachedBinaryStore(server.Addr(), "", "", defaultExpiration)
 }
 
 var newMcStoreWithConfig = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
+	server := newFakeMemcached(t)
+	t.Cleanup(server.Close)
 	config := mc.DefaultConfig()
 	config.PoolSize = 2
-	mcStore := NewMemcachedBinaryStoreWithConfig(localhost, "", "", defaultExpiration, config)
-	err := mcStore.Flush()
-	if err == nil {
-		return mcStore
-	}
-	t.Errorf("Failed to connect to memcached on %s with %s", localhost, err)
-	t.FailNow()
-	panic("")
-}
-
-func TestMemcachedBinaryWithConfig_TypicalGetSet(t *testing.T) {
-	typicalGetSet(t, newMcStoreWithConfig)
+	return NewMemcachedBinaryStoreWithConfig(server.Addr(), "", "", defaultExpiration, config)
 }
 
-func TestMemcachedBinaryWithConfig_IncrDecr(t *testing.T) {
-	incrDecr(t, newMcStoreWithConfig)
-}
-
-func TestMemcachedBinaryWithConfig_Expiration(t *testing.T) {
-	expiration(t, newMcStoreWithConfig)
-}
+func TestMemcachedBinaryCache_DroppedConnections(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	store := NewMemcachedBinaryStore(server.Addr(), "", "", time.Hour)
 
-func TestMemcachedBinaryWithConfig_EmptyCache(t *testing.T) {
-	emptyCache(t, newMcStoreWithConfig)
-}
-
-func TestMemcachedBinaryWithConfig_Replace(t *testing.T) {
-	testReplace(t, newMcStoreWithConfig)
-}
-
-func TestMemcachedBinaryWithConfig_Add(t *testing.T) {
-	testAdd(t, newMcStoreWithConfig)
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	// the client retries on a new connection. Dropping the connection while
+	// the client authenticates would make it panic, so only established
+	// connections are dropped.
+	server.DropConnections()
+	var value string
+	if err := store.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the value after a retry, got %q, %v", value, err)
+	}
 }
@@ -1,46 +1,31 @@
 package persistence
 
 import (
-	"net"
 	"testing"
 	"time"
 )
 
-// These tests require memcached running on localhost:11211 (the default)
-const testServer = "localhost:11211"
-
 var newMemcachedStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
-	c, err := net.Dial("tcp", testServer)
-	if err == nil {
-		c.Write([]byte("flush_all\r\n"))
-		c.Close()
-		return NewMemcachedStore([]string{testServer}, defaultExpiration)
-	}
-	t.Errorf("couldn't connect to memcached on %s", testServer)
-	t.FailNow()
-	panic("")
-}
-
-func TestMemcachedCache_TypicalGetSet(t *testing.T) {
-	typicalGetSet(t, newMemcachedStore)
-}
-
-func TestMemcachedCache_IncrDecr(t *testing.T) {
-	incrDecr(t, newMemcachedStore)
-}
-
-func TestMemcachedCache_Expiration(t *testing.T) {
-	expiration(t, newMemcachedStore)
-}
-
-func TestMemcachedCache_EmptyCache(t *testing.T) {
-	emptyCache(t, newMemcachedStore)
+	server := newFakeMemcached(t)
+	t.Cleanup(server.Close)
+	return NewMemcachedStore([]string{server.Addr()}, defaultExpiration)
 }
 
-func TestMemcachedCache_Replace(t *testing.T) {
-	testReplace(t, newMemcachedStore)
-}
+func TestMemcachedCache_DroppedConnections(t *testing.T) {
+	server := newFakeMemcached(t)
+	defer server.Close()
+	store := NewMemcachedStore([]string{server.Addr()}, time.Hour)
 
-func TestMemcachedCache_Add(t *testing.T) {
-	testAdd(t, newMemcachedStore)
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	server.DropNext(1)
+	var value string
+	if err := store.Get("key", &value); !isStoreFailure(err) {
+		t.Errorf("Expected a failure on a dropped connection, got: %v", err)
+	}
+	// the broken connection isn't reused
+	if err := store.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the value once reconnected, got %q, %v", value, err)
+	}
 }
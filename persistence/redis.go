@@ -1,6 +1,10 @@
 package persistence
 
 import (
+	"crypto/tls"
+	"hash/fnv"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cache/utils"
@@ -9,53 +13,150 @@ import (
 
 // RedisStore represents the cache with redis persistence
 type RedisStore struct {
-	pool              *redis.Pool
+	pool              redisPool
 	defaultExpiration time.Duration
 }
 
-// NewRedisCache returns a RedisStore
-// until redigo supports sharding/clustering, only one host will be in hostList
+// redisPool hands out the connections used by a RedisStore. It is satisfied by
+// *redis.Pool and by the cluster router.
+type redisPool interface {
+	Get() redis.Conn
+}
+
+// RedisOptions configures the connections opened by a RedisStore. The zero
+// value connects over plain TCP to database 0 without authentication.
+type RedisOptions struct {
+	// Network is "tcp" or "unix". When empty, addresses starting with a slash
+	// are unix socket paths and anything else is a TCP host:port.
+	Network string
+
+	// Username and Password authenticate the connection. Username requires a
+	// server with ACL support (redis 6 and later).
+	Username string
+	Password string
+
+	// Database is the index selected on every new connection
+	Database int
+
+	// TLSConfig enables TLS when it is not nil
+	TLSConfig *tls.Config
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxIdle defaults to 5 and IdleTimeout to 240 seconds. MaxActive and
+	// Wait behave as in redis.Pool.
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+	Wait        bool
+
+	// HealthCheckInterval is how long a connection can stay idle in the pool
+	// before it is checked again when borrowed. Zero checks every borrow.
+	HealthCheckInterval time.Duration
+}
+
+// NewRedisCache returns a RedisStore connected to a single redis server.
+// See NewRedisClusterCache and NewRedisSentinelCache for replicated setups.
 func NewRedisCache(host string, password string, defaultExpiration time.Duration) *RedisStore {
-	var pool = &redis.Pool{
-		MaxIdle:     5,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			// the redis protocol should probably be made sett-able
-			c, err := redis.Dial("tcp", host)
-			if err != nil {
-				return nil, err
-			}
-			if len(password) > 0 {
-				if _, err := c.Do("AUTH", password); err != nil {
-					c.Close()
-					return nil, err
-				}
-			} else {
-				// check with PING
-				if _, err := c.Do("PING"); err != nil {
-					c.Close()
-					return nil, err
-				}
-			}
-			return c, err
-		},
-		// custom connection test method
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			if _, err := c.Do("PING"); err != nil {
-				return err
-			}
-			return nil
-		},
-	}
+	return NewRedisCacheWithOptions(host, RedisOptions{Password: password}, defaultExpiration)
+}
+
+// NewRedisCacheWithOptions returns a RedisStore connected to the redis server
+// at address using the provided options
+func NewRedisCacheWithOptions(address string, options RedisOptions, defaultExpiration time.Duration) *RedisStore {
+	pool := options.newPool(func() (redis.Conn, error) {
+		return options.dial(address)
+	})
 	return &RedisStore{pool, defaultExpiration}
 }
 
 // NewRedisCacheWithPool returns a RedisStore using the provided pool
-// until redigo supports sharding/clustering, only one host will be in hostList
 func NewRedisCacheWithPool(pool *redis.Pool, defaultExpiration time.Duration) *RedisStore {
 	return &RedisStore{pool, defaultExpiration}
 }
 
+func (o RedisOptions) newPool(dial func() (redis.Conn, error)) *redis.Pool {
+	maxIdle := o.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = 5
+	}
+	idleTimeout := o.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 240 * time.Second
+	}
+	return &redis.Pool{
+		MaxIdle:     maxIdle,
+		MaxActive:   o.MaxActive,
+		IdleTimeout: idleTimeout,
+		Wait:        o.Wait,
+		Dial:        dial,
+		// custom connection test method
+		TestOnBorrow: o.testOnBorrow(func(c redis.Conn) error {
+			_, err := c.Do("PING")
+			return err
+		}),
+	}
+}
+
+// testOnBorrow runs check on connections that stayed idle longer than the
+// health check interval
+func (o RedisOptions) testOnBorrow(check func(c redis.Conn) error) func(c redis.Conn, t time.Time) error {
+	return func(c redis.Conn, t time.Time) error {
+		if time.Since(t) < o.HealthCheckInterval {
+			return nil
+		}
+		return check(c)
+	}
+}
+
+// dialNetwork opens a connection without authenticating it
+func (o RedisOptions) dialNetwork(address string) (redis.Conn, error) {
+	network := o.Network
+	if network == "" {
+		network = "tcp"
+		if strings.HasPrefix(address, "/") {
+			network = "unix"
+		}
+	}
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(o.DialTimeout),
+		redis.DialReadTimeout(o.ReadTimeout),
+		redis.DialWriteTimeout(o.WriteTimeout),
+	}
+	if o.TLSConfig != nil {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(o.TLSConfig))
+	}
+	return redis.Dial(network, address, options...)
+}
+
+func (o RedisOptions) dial(address string) (redis.Conn, error) {
+	c, err := o.dialNetwork(address)
+	if err != nil {
+		return nil, err
+	}
+	// redigo's DialPassword can't send a username, so authenticate here
+	if len(o.Password) > 0 {
+		args := []interface{}{o.Password}
+		if len(o.Username) > 0 {
+			args = []interface{}{o.Username, o.Password}
+		}
+		_, err = c.Do("AUTH", args...)
+	} else {
+		// check with PING
+		_, err = c.Do("PING")
+	}
+	if err == nil && o.Database != 0 {
+		_, err = c.Do("SELECT", o.Database)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
 // Set (see CacheStore interface)
 func (c *RedisStore) Set(key string, value interface{}, expires time.Duration) error {
 	conn := c.pool.Get()
@@ -67,26 +168,14 @@ func (c *RedisStore) Set(key string, value interface{}, expires time.Duration) e
 func (c *RedisStore) Add(key string, value interface{}, expires time.Duration) error {
 	conn := c.pool.Get()
 	defer conn.Close()
-	if exists(conn, key) {
-		return ErrNotStored
-	}
-	return c.invoke(conn.Do, key, value, expires)
+	return c.invoke(conn.Do, key, value, expires, "NX")
 }
 
 // Replace (see CacheStore interface)
 func (c *RedisStore) Replace(key string, value interface{}, expires time.Duration) error {
 	conn := c.pool.Get()
 	defer conn.Close()
-	if !exists(conn, key) {
-		return ErrNotStored
-	}
-	err := c.invoke(conn.Do, key, value, expires)
-	if value == nil {
-		return ErrNotStored
-	}
-
-	return err
-
+	return c.invoke(conn.Do, key, value, expires, "XX")
 }
 
 // Get (see CacheStore interface)
@@ -94,16 +183,45 @@ func (c *RedisStore) Get(key string, ptrValue interface{}) error {
 	conn := c.pool.Get()
 	defer conn.Close()
 	raw, err := conn.Do("GET", key)
+	if err != nil {
+		return err
+	}
 	if raw == nil {
 		return ErrCacheMiss
 	}
-	item, err := redis.Bytes(raw, err)
+	item, err := redis.Bytes(raw, nil)
 	if err != nil {
 		return err
 	}
 	return utils.Deserialize(item, ptrValue)
 }
 
+var (
+	// redisIncrScript increments an existing counter, as INCRBY alone would
+	// create missing keys
+	redisIncrScript = redis.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+return redis.call('INCRBY', KEYS[1], ARGV[1])
+`)
+
+	// redisDecrScript decrements an existing counter, flooring it at 0
+	redisDecrScript = redis.NewScript(1, `
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return false
+end
+if not tonumber(current) then
+	return redis.error_reply('ERR value is not an integer or out of range')
+end
+if tonumber(ARGV[1]) >= tonumber(current) then
+	return redis.call('DECRBY', KEYS[1], current)
+end
+return redis.call('DECRBY', KEYS[1], ARGV[1])
+`)
+)
+
 func exists(conn redis.Conn, key string) bool {
 	retval, _ := redis.Bool(conn.Do("EXISTS", key))
 	return retval
@@ -124,61 +242,227 @@ func (c *RedisStore) Delete(key string) error {
 func (c *RedisStore) Increment(key string, delta uint64) (uint64, error) {
 	conn := c.pool.Get()
 	defer conn.Close()
-	// Check for existance *before* increment as per the cache contract.
-	// redis will auto create the key, and we don't want that. Since we need to do increment
-	// ourselves instead of natively via INCRBY (redis doesn't support wrapping), we get the value
-	// and do the exists check this way to minimize calls to Redis
-	val, err := conn.Do("GET", key)
-	if val == nil {
+	// the delta is sent as a signed number, so that values wrap around like
+	// uint64 as long as they fit in redis' signed 64 bit integers
+	return counterReply(redisIncrScript.Do(conn, key, int64(delta)))
+}
+
+// Decrement (see CacheStore interface)
+func (c *RedisStore) Decrement(key string, delta uint64) (newValue uint64, err error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	// redis integers are signed, any larger delta floors the value at 0 anyway
+	if delta > math.MaxInt64 {
+		delta = math.MaxInt64
+	}
+	return counterReply(redisDecrScript.Do(conn, key, delta))
+}
+
+func counterReply(reply interface{}, err error) (uint64, error) {
+	if reply == nil && err == nil {
 		return 0, ErrCacheMiss
 	}
-	if err == nil {
-		currentVal, err := redis.Int64(val, nil)
-		if err != nil {
-			return 0, err
+	n, err := redis.Int64(reply, err)
+	return uint64(n), err
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *RedisStore) TTL(key string) (time.Duration, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	switch {
+	case err != nil:
+		return 0, err
+	case ttl == -2:
+		return 0, ErrCacheMiss
+	case ttl == -1:
+		return FOREVER, nil
+	}
+	return time.Duration(ttl) * time.Millisecond, nil
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *RedisStore) Touch(key string, expires time.Duration) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	if expires == DEFAULT {
+		expires = c.defaultExpiration
+	}
+
+	var found bool
+	var err error
+	if expires > 0 {
+		found, err = redis.Bool(conn.Do("PEXPIRE", key, int64(expires/time.Millisecond)))
+	} else {
+		// PERSIST also answers 0 for keys without expiration
+		if _, err = conn.Do("PERSIST", key); err == nil {
+			found = exists(conn, key)
+		}
+	}
+	if err == nil && !found {
+		return ErrCacheMiss
+	}
+	return err
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (c *RedisStore) GetWithVersion(key string, ptrValue interface{}) (Version, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	raw, err := conn.Do("GET", key)
+	if raw == nil && err == nil {
+		return Version{}, ErrCacheMiss
+	}
+	item, err := redis.Bytes(raw, err)
+	if err != nil {
+		return Version{}, err
+	}
+	return Version{cas: redisVersion(item)}, utils.Deserialize(item, ptrValue)
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (c *RedisStore) CompareAndSet(key string, value interface{}, version Version, expires time.Duration) error {
+	conn := c.pool.Get()
+	// closing the connection discards the transaction and unwatches the key
+	defer conn.Close()
+	if _, err := conn.Do("WATCH", key); err != nil {
+		return err
+	}
+	raw, err := conn.Do("GET", key)
+	if raw == nil && err == nil {
+		return ErrCacheMiss
+	}
+	item, err := redis.Bytes(raw, err)
+	if err != nil {
+		return err
+	}
+	if redisVersion(item) != version.cas {
+		return ErrCASConflict
+	}
+
+	if _, err := conn.Do("MULTI"); err != nil {
+		return err
+	}
+	if err := c.invoke(conn.Do, key, value, expires); err != nil {
+		return err
+	}
+	// EXEC answers nil when the watched key changed since the WATCH
+	reply, err := conn.Do("EXEC")
+	if err == nil && reply == nil {
+		return ErrCASConflict
+	}
+	return err
+}
+
+// redisVersion derives the version of an item from its content, as redis
+// keeps no version of its keys
+func redisVersion(item []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(item)
+	return h.Sum64()
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (c *RedisStore) GetMulti(values map[string]interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	keys := make([]interface{}, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	items, err := redis.Values(conn.Do("MGET", keys...))
+	if err != nil {
+		return err
+	}
+
+	errs := MultiError{}
+	for i, raw := range items {
+		key := keys[i].(string)
+		if raw == nil {
+			errs[key] = ErrCacheMiss
+			continue
+		}
+		item, err := redis.Bytes(raw, nil)
+		if err == nil {
+			err = utils.Deserialize(item, values[key])
 		}
-		sum := currentVal + int64(delta)
-		_, err = conn.Do("SET", key, sum)
 		if err != nil {
-			return 0, err
+			errs[key] = err
 		}
-		return uint64(sum), nil
+	}
+	return errs.errOrNil()
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *RedisStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	send := func(cmd string, args ...interface{}) (interface{}, error) {
+		return nil, conn.Send(cmd, args...)
 	}
 
-	return 0, err
+	errs := MultiError{}
+	sent := make([]string, 0, len(values))
+	for key, value := range values {
+		if err := c.invoke(send, key, value, expires); err != nil {
+			errs[key] = err
+			continue
+		}
+		sent = append(sent, key)
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for _, key := range sent {
+		if _, err := conn.Receive(); err != nil {
+			errs[key] = err
+		}
+	}
+	return errs.errOrNil()
 }
 
-// Decrement (see CacheStore interface)
-func (c *RedisStore) Decrement(key string, delta uint64) (newValue uint64, err error) {
+// DeleteMulti (see BatchCacheStore interface)
+func (c *RedisStore) DeleteMulti(keys ...string) error {
 	conn := c.pool.Get()
 	defer conn.Close()
-	// Check for existance *before* increment as per the cache contract.
-	// redis will auto create the key, and we don't want that, hence the exists call
-	if !exists(conn, key) {
-		return 0, ErrCacheMiss
+	for _, key := range keys {
+		if err := conn.Send("DEL", key); err != nil {
+			return err
+		}
 	}
-	// Decrement contract says you can only go to 0
-	// so we go fetch the value and if the delta is greater than the amount,
-	// 0 out the value
-	currentVal, err := redis.Int64(conn.Do("GET", key))
-	if err == nil && delta > uint64(currentVal) {
-		tempint, err := redis.Int64(conn.Do("DECRBY", key, currentVal))
-		return uint64(tempint), err
+	if err := conn.Flush(); err != nil {
+		return err
 	}
-	tempint, err := redis.Int64(conn.Do("DECRBY", key, delta))
-	return uint64(tempint), err
+
+	errs := MultiError{}
+	for _, key := range keys {
+		deleted, err := redis.Int(conn.Receive())
+		if err != nil {
+			errs[key] = err
+		} else if deleted == 0 {
+			errs[key] = ErrCacheMiss
+		}
+	}
+	return errs.errOrNil()
 }
 
-// Flush (see CacheStore interface)
+// Flush (see CacheStore interface). Only the database of the store is
+// flushed.
 func (c *RedisStore) Flush() error {
 	conn := c.pool.Get()
 	defer conn.Close()
-	_, err := conn.Do("FLUSHALL")
+	_, err := conn.Do("FLUSHDB")
 	return err
 }
 
+// invoke stores the value with a SET command, passing it the extra arguments
+// of condition (NX or XX). A condition that isn't met returns ErrNotStored.
 func (c *RedisStore) invoke(f func(string, ...interface{}) (interface{}, error),
-	key string, value interface{}, expires time.Duration) error {
+	key string, value interface{}, expires time.Duration, condition ...interface{}) error {
 
 	switch expires {
 	case DEFAULT:
@@ -192,12 +476,13 @@ func (c *RedisStore) invoke(f func(string, ...interface{}) (interface{}, error),
 		return err
 	}
 
+	args := []interface{}{key, b}
 	if expires > 0 {
-		_, err := f("SETEX", key, int32(expires/time.Second), b)
-		return err
+		args = append(args, "PX", int64(expires/time.Millisecond))
+	}
+	reply, err := f("SET", append(args, condition...)...)
+	if err == nil && reply == nil && len(condition) > 0 {
+		return ErrNotStored
 	}
-
-	_, err = f("SET", key, b)
 	return err
-
 }
@@ -0,0 +1,469 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	// redisClusterSlots is the number of hash slots of a Redis Cluster
+	redisClusterSlots = 16384
+	// maxRedisRedirects bounds the MOVED/ASK redirections followed by a command
+	maxRedisRedirects = 16
+)
+
+var errRedisTooManyRedirects = errors.New("cache: too many redis cluster redirections.")
+
+// NewRedisClusterCache returns a RedisStore backed by a Redis Cluster. The
+// hostList only needs to contain some of the nodes: the slot table is fetched
+// from them and commands are routed to the node serving the slot of their key,
+// following MOVED and ASK redirections.
+func NewRedisClusterCache(hostList []string, password string, defaultExpiration time.Duration) *RedisStore {
+	return NewRedisClusterCacheWithOptions(hostList, RedisOptions{Password: password}, defaultExpiration)
+}
+
+// NewRedisClusterCacheWithOptions returns a RedisStore backed by a Redis
+// Cluster, connecting to every node with the provided options. The Database
+// option must be 0 as a cluster only has one database.
+func NewRedisClusterCacheWithOptions(hostList []string, options RedisOptions, defaultExpiration time.Duration) *RedisStore {
+	return &RedisStore{newRedisCluster(hostList, options), defaultExpiration}
+}
+
+// redisCluster keeps a connection pool per cluster node and the table mapping
+// each hash slot to the node serving it.
+type redisCluster struct {
+	seeds   []string
+	options RedisOptions
+
+	mu    sync.RWMutex
+	slots []string
+	nodes map[string]*redis.Pool
+}
+
+func newRedisCluster(seeds []string, options RedisOptions) *redisCluster {
+	return &redisCluster{
+		seeds:   seeds,
+		options: options,
+		slots:   make([]string, redisClusterSlots),
+		nodes:   make(map[string]*redis.Pool),
+	}
+}
+
+// Get returns a connection routing each command to the right cluster node
+func (rc *redisCluster) Get() redis.Conn {
+	return &redisClusterConn{cluster: rc, conns: make(map[string]redis.Conn)}
+}
+
+func (rc *redisCluster) node(address string) *redis.Pool {
+	rc.mu.RLock()
+	pool, found := rc.nodes[address]
+	rc.mu.RUnlock()
+	if found {
+		return pool
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if pool, found = rc.nodes[address]; !found {
+		pool = rc.options.newPool(func() (redis.Conn, error) {
+			return rc.options.dial(address)
+		})
+		rc.nodes[address] = pool
+	}
+	return pool
+}
+
+// slotAddress returns the node serving slot, loading the slot table the first
+// time it is needed.
+func (rc *redisCluster) slotAddress(slot int) string {
+	rc.mu.RLock()
+	address := rc.slots[slot]
+	rc.mu.RUnlock()
+	if address != "" {
+		return address
+	}
+
+	if err := rc.refresh(); err == nil {
+		rc.mu.RLock()
+		address = rc.slots[slot]
+		rc.mu.RUnlock()
+	}
+	if address == "" && len(rc.seeds) > 0 {
+		// the node will redirect us if it doesn't serve the slot
+		address = rc.seeds[0]
+	}
+	return address
+}
+
+func (rc *redisCluster) setSlotAddress(slot int, address string) {
+	rc.mu.Lock()
+	rc.slots[slot] = address
+	rc.mu.Unlock()
+}
+
+// masters returns the address of every node serving at least one slot
+func (rc *redisCluster) masters() ([]string, error) {
+	if err := rc.refresh(); err != nil {
+		return nil, err
+	}
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	seen := make(map[string]bool)
+	var masters []string
+	for _, address := range rc.slots {
+		if address != "" && !seen[address] {
+			seen[address] = true
+			masters = append(masters, address)
+		}
+	}
+	return masters, nil
+}
+
+// refresh reloads the slot table with CLUSTER SLOTS from the first node that
+// answers, trying the seeds first, then the nodes of the current table.
+func (rc *redisCluster) refresh() error {
+	var err error
+	addresses := append([]string(nil), rc.seeds...)
+	seen := make(map[string]bool)
+	for _, address := range rc.seeds {
+		seen[address] = true
+	}
+	rc.mu.RLock()
+	for _, address := range rc.slots {
+		if address != "" && !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	rc.mu.RUnlock()
+	for _, address := range addresses {
+		var slots []string
+		if slots, err = rc.fetchSlots(address); err == nil {
+			rc.mu.Lock()
+			rc.slots = slots
+			rc.mu.Unlock()
+			return nil
+		}
+	}
+	if err == nil {
+		err = errors.New("cache: no redis cluster node to query.")
+	}
+	return err
+}
+
+func (rc *redisCluster) fetchSlots(address string) ([]string, error) {
+	conn := rc.node(address).Get()
+	defer conn.Close()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	slots := make([]string, redisClusterSlots)
+	for _, r := range ranges {
+		// each range is [start, end, [ip, port, ...], replicas...]
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, fmt.Errorf("cache: unexpected CLUSTER SLOTS reply: %v", r)
+		}
+		start, _ := redis.Int(fields[0], nil)
+		end, _ := redis.Int(fields[1], nil)
+		master, err := redis.Values(fields[2], nil)
+		if err != nil || len(master) < 2 || start < 0 || end >= redisClusterSlots {
+			return nil, fmt.Errorf("cache: unexpected CLUSTER SLOTS reply: %v", r)
+		}
+		ip, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		if ip == "" {
+			// an empty ip means the node we are talking to
+			ip = host
+		}
+		node := net.JoinHostPort(ip, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = node
+		}
+	}
+	return slots, nil
+}
+
+// redisClusterConn implements redis.Conn on top of a redisCluster. It keeps a
+// connection to every node it talked to until it is closed, so that WATCH,
+// MULTI and EXEC run on the same node connection.
+type redisClusterConn struct {
+	cluster *redisCluster
+	conns   map[string]redis.Conn
+	last    string
+	multi   bool
+	pending []redisCommand
+	replies []redisReply
+}
+
+type redisCommand struct {
+	name string
+	args []interface{}
+}
+
+type redisReply struct {
+	value interface{}
+	err   error
+}
+
+func (c *redisClusterConn) Close() error {
+	var err error
+	for _, conn := range c.conns {
+		if e := conn.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	c.conns = nil
+	return err
+}
+
+func (c *redisClusterConn) Err() error {
+	if c.conns == nil {
+		return errors.New("cache: redis cluster connection closed.")
+	}
+	return nil
+}
+
+// Send queues the command, which is executed on Flush or Receive
+func (c *redisClusterConn) Send(cmd string, args ...interface{}) error {
+	c.pending = append(c.pending, redisCommand{cmd, args})
+	return nil
+}
+
+func (c *redisClusterConn) Flush() error {
+	for _, command := range c.pending {
+		value, err := c.Do(command.name, command.args...)
+		c.replies = append(c.replies, redisReply{value, err})
+	}
+	c.pending = nil
+	return nil
+}
+
+func (c *redisClusterConn) Receive() (interface{}, error) {
+	if len(c.replies) == 0 {
+		c.Flush()
+	}
+	if len(c.replies) == 0 {
+		return nil, errors.New("cache: no pending redis reply.")
+	}
+	reply := c.replies[0]
+	c.replies = c.replies[1:]
+	return reply.value, reply.err
+}
+
+func (c *redisClusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	switch strings.ToUpper(cmd) {
+	case "":
+		return nil, c.Flush()
+	case "FLUSHALL", "FLUSHDB", "SCRIPT":
+		return c.broadcast(cmd, args...)
+	case "MGET":
+		return c.mget(args...)
+	}
+
+	switch strings.ToUpper(cmd) {
+	case "MULTI":
+		c.multi = true
+	case "EXEC", "DISCARD":
+		c.multi = false
+	}
+	key, ok := redisCommandKey(cmd, args)
+	if !ok {
+		// keyless commands, such as MULTI and EXEC, go to the last node used
+		address := c.last
+		if address == "" && len(c.cluster.seeds) > 0 {
+			address = c.cluster.seeds[0]
+		}
+		return c.conn(address).Do(cmd, args...)
+	}
+	return c.route(redisKeySlot(key), cmd, args...)
+}
+
+func (c *redisClusterConn) conn(address string) redis.Conn {
+	conn, found := c.conns[address]
+	if !found {
+		conn = c.cluster.node(address).Get()
+		c.conns[address] = conn
+	}
+	c.last = address
+	return conn
+}
+
+// drop closes the connection to address, which failed
+func (c *redisClusterConn) drop(address string) {
+	if conn, found := c.conns[address]; found {
+		conn.Close()
+		delete(c.conns, address)
+	}
+}
+
+// route runs the command on the node serving slot, following redirections.
+// A command is only retried when the node couldn't be dialed, as it was never
+// sent then, and not inside MULTI. Other connection errors are returned, and
+// reload the slot table for the next commands.
+func (c *redisClusterConn) route(slot int, cmd string, args ...interface{}) (interface{}, error) {
+	address := c.cluster.slotAddress(slot)
+	asking, retried := false, false
+	for i := 0; i < maxRedisRedirects; i++ {
+		conn := c.conn(address)
+		if err := conn.Err(); err != nil {
+			// the node may be gone, with a replica serving its slots in its
+			// place: no node would ever redirect us there
+			c.drop(address)
+			if retried || c.multi || c.cluster.refresh() != nil {
+				return nil, err
+			}
+			retried, asking = true, false
+			address = c.cluster.slotAddress(slot)
+			continue
+		}
+		if asking {
+			if _, err := conn.Do("ASKING"); err != nil {
+				return nil, err
+			}
+		}
+		reply, err := conn.Do(cmd, args...)
+		redirect, ok := err.(redis.Error)
+		if err != nil && !ok {
+			// the command may have run, it isn't retried
+			c.drop(address)
+			c.cluster.refresh()
+		}
+		if !ok {
+			return reply, err
+		}
+
+		// redirections look like "MOVED 3999 127.0.0.1:6381"
+		fields := strings.Fields(string(redirect))
+		if len(fields) != 3 {
+			return reply, err
+		}
+		switch fields[0] {
+		case "MOVED":
+			// the slot now lives on another node
+			c.cluster.setSlotAddress(slot, fields[2])
+			asking = false
+		case "ASK":
+			// the slot is being migrated, only this command goes to the new node
+			asking = true
+		default:
+			return reply, err
+		}
+		address = fields[2]
+	}
+	return nil, errRedisTooManyRedirects
+}
+
+// mget splits an MGET by slot, as a cluster refuses multi-key commands whose
+// keys hash to different slots.
+func (c *redisClusterConn) mget(keys ...interface{}) (interface{}, error) {
+	bySlot := make(map[int][]int)
+	for i, key := range keys {
+		slot := redisKeySlot(redisArgString(key))
+		bySlot[slot] = append(bySlot[slot], i)
+	}
+
+	values := make([]interface{}, len(keys))
+	for slot, indexes := range bySlot {
+		args := make([]interface{}, len(indexes))
+		for i, index := range indexes {
+			args[i] = keys[index]
+		}
+		reply, err := redis.Values(c.route(slot, "MGET", args...))
+		if err != nil {
+			return nil, err
+		}
+		if len(reply) != len(indexes) {
+			return nil, fmt.Errorf("cache: unexpected MGET reply length %d", len(reply))
+		}
+		for i, index := range indexes {
+			values[index] = reply[i]
+		}
+	}
+	return values, nil
+}
+
+// broadcast runs the command on every master, returning the last reply
+func (c *redisClusterConn) broadcast(cmd string, args ...interface{}) (interface{}, error) {
+	masters, err := c.cluster.masters()
+	if err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	for _, address := range masters {
+		if reply, err = c.conn(address).Do(cmd, args...); err != nil {
+			return nil, err
+		}
+	}
+	return reply, nil
+}
+
+// redisCommandKey returns the key used to route the command
+func redisCommandKey(cmd string, args []interface{}) (string, bool) {
+	switch strings.ToUpper(cmd) {
+	case "MULTI", "EXEC", "DISCARD", "UNWATCH", "PING", "ASKING":
+		return "", false
+	case "EVAL", "EVALSHA":
+		// EVAL script numkeys key [key ...] arg [arg ...]
+		if len(args) < 3 {
+			return "", false
+		}
+		if numKeys, err := strconv.Atoi(redisArgString(args[1])); err != nil || numKeys < 1 {
+			return "", false
+		}
+		return redisArgString(args[2]), true
+	}
+	if len(args) == 0 {
+		return "", false
+	}
+	return redisArgString(args[0]), true
+}
+
+func redisArgString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	}
+	return fmt.Sprint(arg)
+}
+
+// redisKeySlot returns the hash slot of key, honouring {hash tags}
+func redisKeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % redisClusterSlots
+}
+
+// crc16 implements the CRC16-CCITT (XMODEM) checksum used by Redis Cluster
+func crc16(key string) uint16 {
+	var crc uint16
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
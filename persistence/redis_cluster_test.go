@@ -0,0 +1,221 @@
+package persistence
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newFakeRedisCluster starts two fake nodes splitting the slots in half. The
+// first node reports that it serves every slot, so the client has to learn
+// the real layout from MOVED redirections.
+func newFakeRedisCluster(t *testing.T) (*fakeRedis, *fakeRedis) {
+	a, b := newFakeRedis(t), newFakeRedis(t)
+	owner := func(slot int) *fakeRedis {
+		if slot < redisClusterSlots/2 {
+			return a
+		}
+		return b
+	}
+	for _, node := range []*fakeRedis{a, b} {
+		node := node
+		node.Configure(func(s *fakeRedis) {
+			s.slots = []fakeRedisSlots{{0, redisClusterSlots - 1, a.Addr()}}
+			s.intercept = func(conn *fakeRedisConn, cmd string, args []string) interface{} {
+				slot, ok := fakeRedisSlot(cmd, args)
+				if !ok || owner(slot) == node {
+					return nil
+				}
+				return fakeRedisError(fmt.Sprintf("MOVED %d %s", slot, owner(slot).Addr()))
+			}
+		})
+	}
+	return a, b
+}
+
+func fakeRedisSlot(cmd string, args []string) (int, bool) {
+	if cmd == "CLUSTER" {
+		return 0, false
+	}
+	keyArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		keyArgs[i] = arg
+	}
+	key, ok := redisCommandKey(cmd, keyArgs)
+	return redisKeySlot(key), ok
+}
+
+// keyInSlots returns a key hashing to a slot accepted by inRange
+func keyInSlots(inRange func(slot int) bool) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if inRange(redisKeySlot(key)) {
+			return key
+		}
+	}
+}
+
+func countCommand(commands []string, name string) int {
+	count := 0
+	for _, command := range commands {
+		if command == name {
+			count++
+		}
+	}
+	return count
+}
+
+var newRedisClusterStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
+	a, b := newFakeRedisCluster(t)
+	// report the real layout, so that FLUSHDB reaches both nodes
+	for _, node := range []*fakeRedis{a, b} {
+		node.Configure(func(s *fakeRedis) {
+			s.slots = []fakeRedisSlots{
+				{0, redisClusterSlots/2 - 1, a.Addr()},
+				{redisClusterSlots / 2, redisClusterSlots - 1, b.Addr()},
+			}
+		})
+	}
+	return NewRedisClusterCache([]string{a.Addr()}, "", defaultExpiration)
+}
+
+func TestRedisCluster_Moved(t *testing.T) {
+	a, b := newFakeRedisCluster(t)
+	store := NewRedisClusterCache([]string{a.Addr()}, "", time.Hour)
+	key := keyInSlots(func(slot int) bool { return slot >= redisClusterSlots/2 })
+
+	if err := store.Set(key, "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if !b.Has(key) || a.Has(key) {
+		t.Errorf("Expected %s to be stored on the node serving its slot", key)
+	}
+
+	// the redirection updated the slot table, so the GET goes straight to b
+	var value string
+	if err := store.Get(key, &value); err != nil || value != "value" {
+		t.Errorf("Expected to get value back, got %q, %v", value, err)
+	}
+	if n := countCommand(a.Commands(), "GET"); n != 0 {
+		t.Errorf("Expected no GET on the old node, got %d", n)
+	}
+}
+
+func TestRedisCluster_Ask(t *testing.T) {
+	a, b := newFakeRedis(t), newFakeRedis(t)
+	key := keyInSlots(func(slot int) bool { return true })
+	migrating := redisKeySlot(key)
+
+	// a serves every slot but is migrating one of them to b: keys it no
+	// longer holds are answered with ASK, and b only accepts them after ASKING
+	a.Configure(func(s *fakeRedis) {
+		s.slots = []fakeRedisSlots{{0, redisClusterSlots - 1, a.Addr()}}
+		s.intercept = func(conn *fakeRedisConn, cmd string, args []string) interface{} {
+			if slot, ok := fakeRedisSlot(cmd, args); ok && slot == migrating && !a.Has(args[0]) {
+				return fakeRedisError(fmt.Sprintf("ASK %d %s", slot, b.Addr()))
+			}
+			return nil
+		}
+	})
+	b.Configure(func(s *fakeRedis) {
+		s.intercept = func(conn *fakeRedisConn, cmd string, args []string) interface{} {
+			if slot, ok := fakeRedisSlot(cmd, args); ok && slot == migrating && !conn.asking {
+				return fakeRedisError(fmt.Sprintf("MOVED %d %s", slot, a.Addr()))
+			}
+			return nil
+		}
+	})
+
+	store := NewRedisClusterCache([]string{a.Addr()}, "", time.Hour)
+	if err := store.Set(key, "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if !b.Has(key) {
+		t.Errorf("Expected %s to be stored on the importing node", key)
+	}
+
+	var value string
+	if err := store.Get(key, &value); err != nil || value != "value" {
+		t.Errorf("Expected to get value back, got %q, %v", value, err)
+	}
+	// an ASK redirection doesn't change the slot table
+	if n := countCommand(a.Commands(), "GET"); n != 1 {
+		t.Errorf("Expected the GET to be tried on the migrating node first, got %d", n)
+	}
+	if n := countCommand(b.Commands(), "ASKING"); n != 2 {
+		t.Errorf("Expected 2 ASKING on the importing node, got %d", n)
+	}
+}
+
+func TestRedisCluster_Failover(t *testing.T) {
+	a, b := newFakeRedisCluster(t)
+	for _, node := range []*fakeRedis{a, b} {
+		node.Configure(func(s *fakeRedis) {
+			s.slots = []fakeRedisSlots{
+				{0, redisClusterSlots/2 - 1, a.Addr()},
+				{redisClusterSlots / 2, redisClusterSlots - 1, b.Addr()},
+			}
+		})
+	}
+	store := NewRedisClusterCache([]string{a.Addr()}, "", time.Hour)
+	key := keyInSlots(func(slot int) bool { return slot < redisClusterSlots/2 })
+	// load the slot table
+	if err := store.Set(key, "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+
+	// a dies and b takes over its slots: nothing ever redirects to b
+	a.Close()
+	b.Configure(func(s *fakeRedis) {
+		s.slots = []fakeRedisSlots{{0, redisClusterSlots - 1, b.Addr()}}
+		s.intercept = nil
+	})
+	if err := store.Set(key, "other", DEFAULT); err != nil {
+		t.Fatalf("Expected the write to reach the promoted node, got %v", err)
+	}
+	if !b.Has(key) {
+		t.Errorf("Expected %s to be stored on the promoted node", key)
+	}
+	var value string
+	if err := store.Get(key, &value); err != nil || value != "other" {
+		t.Errorf("Expected to get other back, got %q, %v", value, err)
+	}
+}
+
+func TestRedisCluster_NoRetryAfterSend(t *testing.T) {
+	a, _ := newFakeRedisCluster(t)
+	// no health check, the pooled connection is used as is
+	store := NewRedisClusterCacheWithOptions([]string{a.Addr()}, RedisOptions{HealthCheckInterval: time.Hour}, time.Hour)
+	key := keyInSlots(func(slot int) bool { return slot < redisClusterSlots/2 })
+	if err := store.Set(key, "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+
+	// the connection drops once the SET is sent: it may have run, so it isn't
+	// sent again
+	a.DropNext(1)
+	sets := countCommand(a.Commands(), "SET")
+	if err := store.Set(key, "other", DEFAULT); err == nil {
+		t.Errorf("Expected the connection error to be returned")
+	}
+	if n := countCommand(a.Commands(), "SET"); n != sets {
+		t.Errorf("Expected the SET not to be retried, got %d more", n-sets)
+	}
+	var value string
+	if err := store.Get(key, &value); err != nil || value != "value" {
+		t.Errorf("Expected the next command to run, got %q, %v", value, err)
+	}
+}
+
+func TestRedisKeySlot(t *testing.T) {
+	// reference values from the Redis Cluster specification
+	if slot := redisKeySlot("123456789"); slot != 0x31C3%redisClusterSlots {
+		t.Errorf("Expected slot %d, got %d", 0x31C3%redisClusterSlots, slot)
+	}
+	if redisKeySlot("{user1000}.following") != redisKeySlot("{user1000}.followers") {
+		t.Errorf("Expected keys with the same hash tag to share a slot")
+	}
+	if redisKeySlot("foo{}{bar}") != int(crc16("foo{}{bar}"))%redisClusterSlots {
+		t.Errorf("Expected an empty hash tag to hash the whole key")
+	}
+}
@@ -0,0 +1,134 @@
+package persistence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// maxRedisResubscribeDelay bounds the wait between two attempts to subscribe
+// again to the invalidation channel
+const maxRedisResubscribeDelay = 5 * time.Second
+
+// RedisInvalidator is an Invalidator publishing the changed keys on a redis
+// pub/sub channel.
+type RedisInvalidator struct {
+	pool    *redis.Pool
+	dial    func() (redis.Conn, error)
+	channel string
+	// id tells the messages of this instance apart from the others
+	id string
+
+	mu     sync.Mutex
+	conn   redis.Conn
+	closed bool
+}
+
+// NewRedisInvalidator returns a RedisInvalidator using channel on the redis
+// server at address
+func NewRedisInvalidator(address string, options RedisOptions, channel string) *RedisInvalidator {
+	dial := func() (redis.Conn, error) {
+		return options.dial(address)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &RedisInvalidator{
+		pool:    options.newPool(dial),
+		dial:    dial,
+		channel: channel,
+		id:      hex.EncodeToString(id),
+	}
+}
+
+// Invalidate (see Invalidator interface)
+func (i *RedisInvalidator) Invalidate(key string) error {
+	conn := i.pool.Get()
+	defer conn.Close()
+	_, err := conn.Do("PUBLISH", i.channel, i.id+"\n"+key)
+	return err
+}
+
+// Listen (see Invalidator interface). When the subscription is lost, it is
+// opened again and invalidate is called with an empty key, as the messages
+// published meanwhile are lost.
+func (i *RedisInvalidator) Listen(invalidate func(key string)) {
+	go func() {
+		var delay time.Duration
+		for resubscribe := false; ; resubscribe = true {
+			start := time.Now()
+			i.subscribe(invalidate, resubscribe)
+			if i.isClosed() {
+				return
+			}
+
+			// back off while the server can't be reached
+			if time.Since(start) > maxRedisResubscribeDelay {
+				delay = 0
+			}
+			time.Sleep(delay)
+			if delay *= 2; delay == 0 {
+				delay = 100 * time.Millisecond
+			} else if delay > maxRedisResubscribeDelay {
+				delay = maxRedisResubscribeDelay
+			}
+		}
+	}()
+}
+
+// subscribe receives the messages of the channel until the connection fails
+func (i *RedisInvalidator) subscribe(invalidate func(key string), resubscribe bool) error {
+	conn, err := i.dial()
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	if i.closed {
+		i.mu.Unlock()
+		return conn.Close()
+	}
+	i.conn = conn
+	i.mu.Unlock()
+	defer conn.Close()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(i.channel); err != nil {
+		return err
+	}
+	for {
+		// the read timeout of the options doesn't apply to the subscription
+		switch v := psc.ReceiveWithTimeout(0).(type) {
+		case redis.Subscription:
+			if resubscribe {
+				invalidate("")
+			}
+		case redis.Message:
+			message := string(v.Data)
+			if sep := strings.IndexByte(message, '\n'); sep >= 0 && message[:sep] != i.id {
+				invalidate(message[sep+1:])
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+func (i *RedisInvalidator) isClosed() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.closed
+}
+
+// Close stops listening and releases the connections
+func (i *RedisInvalidator) Close() error {
+	i.mu.Lock()
+	i.closed = true
+	if i.conn != nil {
+		i.conn.Close()
+	}
+	i.mu.Unlock()
+	return i.pool.Close()
+}
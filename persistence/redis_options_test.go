@@ -0,0 +1,139 @@
+package persistence
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordCommands makes the fake record the arguments of the named commands
+func recordCommands(s *fakeRedis, names ...string) func() []string {
+	var mu sync.Mutex
+	var recorded []string
+	s.Configure(func(s *fakeRedis) {
+		s.intercept = func(conn *fakeRedisConn, cmd string, args []string) interface{} {
+			for _, name := range names {
+				if cmd == name {
+					mu.Lock()
+					recorded = append(recorded, strings.Join(append([]string{cmd}, args...), " "))
+					mu.Unlock()
+				}
+			}
+			return nil
+		}
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), recorded...)
+	}
+}
+
+// setGet checks that a value makes the round trip through store
+func setGet(t *testing.T, store CacheStore) {
+	if err := store.Set("value", "foo", DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	var value string
+	if err := store.Get("value", &value); err != nil || value != "foo" {
+		t.Errorf("Expected to get foo back, got %q, %v", value, err)
+	}
+}
+
+func TestRedisOptions_AuthAndDatabase(t *testing.T) {
+	server := newFakeRedis(t)
+	recorded := recordCommands(server, "AUTH", "SELECT")
+
+	store := NewRedisCacheWithOptions(server.Addr(), RedisOptions{
+		Username: "cache",
+		Password: "secret",
+		Database: 3,
+	}, time.Hour)
+	setGet(t, store)
+
+	commands := recorded()
+	if len(commands) != 2 || commands[0] != "AUTH cache secret" || commands[1] != "SELECT 3" {
+		t.Errorf("Expected AUTH with username then SELECT, got %q", commands)
+	}
+}
+
+func TestRedisOptions_FlushDatabase(t *testing.T) {
+	server := newFakeRedis(t)
+	recorded := recordCommands(server, "FLUSHALL", "FLUSHDB")
+
+	store := NewRedisCacheWithOptions(server.Addr(), RedisOptions{Database: 3}, time.Hour)
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	// the other databases of the server are left alone
+	if commands := recorded(); len(commands) != 1 || commands[0] != "FLUSHDB" {
+		t.Errorf("Expected FLUSHDB, got %q", commands)
+	}
+}
+
+func TestRedisOptions_HealthCheckInterval(t *testing.T) {
+	server := newFakeRedis(t)
+	store := NewRedisCacheWithOptions(server.Addr(), RedisOptions{
+		HealthCheckInterval: time.Minute,
+	}, time.Hour)
+	for i := 0; i < 3; i++ {
+		store.Set("int", i, DEFAULT)
+	}
+	// the only PING is the one checking the new connection
+	if n := countCommand(server.Commands(), "PING"); n != 1 {
+		t.Errorf("Expected 1 PING, got %d", n)
+	}
+}
+
+func TestRedisOptions_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "redis.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("unix sockets not available: %s", err)
+	}
+	server := newFakeRedisWithListener(listener)
+	defer server.Close()
+
+	setGet(t, NewRedisCacheWithOptions(path, RedisOptions{}, time.Hour))
+}
+
+func TestRedisOptions_TLS(t *testing.T) {
+	// borrow the self-signed certificate of httptest
+	https := httptest.NewTLSServer(nil)
+	defer https.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: https.TLS.Certificates,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeRedisWithListener(listener)
+	defer server.Close()
+
+	setGet(t, NewRedisCacheWithOptions(server.Addr(), RedisOptions{
+		TLSConfig:   &tls.Config{RootCAs: roots},
+		DialTimeout: time.Second,
+	}, time.Hour))
+
+	// a plain connection is refused by the TLS server
+	store := NewRedisCacheWithOptions(server.Addr(), RedisOptions{ReadTimeout: time.Second}, time.Hour)
+	if err := store.Set("int", 1, DEFAULT); err == nil {
+		t.Errorf("Expected an error connecting without TLS")
+	}
+}
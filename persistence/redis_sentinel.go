@@ -0,0 +1,81 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var errRedisNotMaster = errors.New("cache: redis server is not a master.")
+
+// NewRedisSentinelCache returns a RedisStore connected to the master that the
+// sentinels in sentinelList report for masterName. New connections ask the
+// sentinels again, and pooled connections to a demoted master are dropped, so
+// the store follows a failover.
+func NewRedisSentinelCache(sentinelList []string, masterName string, password string, defaultExpiration time.Duration) *RedisStore {
+	return NewRedisSentinelCacheWithOptions(sentinelList, masterName, RedisOptions{Password: password}, defaultExpiration)
+}
+
+// NewRedisSentinelCacheWithOptions returns a RedisStore following the master
+// named masterName, connecting to it with the provided options. The sentinels
+// are reached with the same network, TLS and timeout options, but without
+// authentication.
+func NewRedisSentinelCacheWithOptions(sentinelList []string, masterName string, options RedisOptions, defaultExpiration time.Duration) *RedisStore {
+	pool := options.newPool(func() (redis.Conn, error) {
+		address, err := redisSentinelMaster(sentinelList, masterName, options.dialNetwork)
+		if err != nil {
+			return nil, err
+		}
+		c, err := options.dial(address)
+		if err != nil {
+			return nil, err
+		}
+		// the sentinels may not have noticed a failover yet
+		if err := checkRedisMaster(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	})
+	pool.TestOnBorrow = options.testOnBorrow(checkRedisMaster)
+	return &RedisStore{pool, defaultExpiration}
+}
+
+// redisSentinelMaster asks each sentinel in turn for the address of the master
+// named masterName.
+func redisSentinelMaster(sentinels []string, masterName string, dial func(address string) (redis.Conn, error)) (string, error) {
+	err := errors.New("cache: no redis sentinel to query.")
+	for _, sentinel := range sentinels {
+		var c redis.Conn
+		if c, err = dial(sentinel); err != nil {
+			continue
+		}
+		var master []string
+		master, err = redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", masterName))
+		c.Close()
+		if err == nil && len(master) != 2 {
+			err = fmt.Errorf("cache: sentinel %s doesn't know master %s", sentinel, masterName)
+		}
+		if err == nil {
+			return net.JoinHostPort(master[0], master[1]), nil
+		}
+	}
+	return "", err
+}
+
+func checkRedisMaster(c redis.Conn) error {
+	role, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(role) == 0 {
+		return errRedisNotMaster
+	}
+	if name, _ := redis.String(role[0], nil); name != "master" {
+		return errRedisNotMaster
+	}
+	return nil
+}
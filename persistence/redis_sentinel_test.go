@@ -0,0 +1,52 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+var newRedisSentinelStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
+	master, sentinel := newFakeRedis(t), newFakeRedis(t)
+	sentinel.Configure(func(s *fakeRedis) {
+		s.masters["mymaster"] = master.Addr()
+	})
+	return NewRedisSentinelCache([]string{sentinel.Addr()}, "mymaster", "", defaultExpiration)
+}
+
+func TestRedisSentinel_Failover(t *testing.T) {
+	oldMaster, newMaster, sentinel := newFakeRedis(t), newFakeRedis(t), newFakeRedis(t)
+	sentinel.Configure(func(s *fakeRedis) {
+		s.masters["mymaster"] = oldMaster.Addr()
+	})
+	store := NewRedisSentinelCache([]string{"127.0.0.1:1", sentinel.Addr()}, "mymaster", "", time.Hour)
+
+	if err := store.Set("before", 1, DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if !oldMaster.Has("before") {
+		t.Errorf("Expected the value to be stored on the master")
+	}
+
+	// the old master is demoted and the sentinel points at the new one
+	oldMaster.Configure(func(s *fakeRedis) {
+		s.role = "slave"
+	})
+	sentinel.Configure(func(s *fakeRedis) {
+		s.masters["mymaster"] = newMaster.Addr()
+	})
+
+	if err := store.Set("after", 2, DEFAULT); err != nil {
+		t.Fatalf("Error setting a value after failover: %s", err)
+	}
+	if !newMaster.Has("after") || oldMaster.Has("after") {
+		t.Errorf("Expected the value to be stored on the new master")
+	}
+}
+
+func TestRedisSentinel_UnknownMaster(t *testing.T) {
+	sentinel := newFakeRedis(t)
+	store := NewRedisSentinelCache([]string{sentinel.Addr()}, "unknown", "", time.Hour)
+	if err := store.Set("int", 1, DEFAULT); err == nil {
+		t.Errorf("Expected an error without a master")
+	}
+}
@@ -1,48 +1,62 @@
 package persistence
 
 import (
-	"net"
 	"testing"
 	"time"
 )
 
-// These tests require redis server running on localhost:6379 (the default)
-const redisTestServer = "localhost:6379"
-
 var newRedisStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
-	c, err := net.Dial("tcp", redisTestServer)
-	if err == nil {
-		c.Write([]byte("flush_all\r\n"))
-		c.Close()
-		redisCache := NewRedisCache(redisTestServer, "", defaultExpiration)
-		redisCache.Flush()
-		return redisCache
-	}
-	t.Errorf("couldn't connect to redis on %s", redisTestServer)
-	t.FailNow()
-	panic("")
-}
-
-func TestRedisCache_TypicalGetSet(t *testing.T) {
-	typicalGetSet(t, newRedisStore)
+	server := newFakeRedis(t)
+	t.Cleanup(server.Close)
+	return NewRedisCache(server.Addr(), "", defaultExpiration)
 }
 
-func TestRedisCache_IncrDecr(t *testing.T) {
-	incrDecr(t, newRedisStore)
-}
+func TestRedisCache_ScriptCaching(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+	store := NewRedisCache(server.Addr(), "", time.Hour)
 
-func TestRedisCache_Expiration(t *testing.T) {
-	expiration(t, newRedisStore)
+	if _, err := store.Increment("missing", 1); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss incrementing a missing key, got: %v", err)
+	}
+	store.Set("int", 1, DEFAULT)
+	for i := 0; i < 3; i++ {
+		store.Increment("int", 1)
+	}
+	if server.Has("missing") {
+		t.Errorf("Expected the missing key not to be created")
+	}
+	// the script is sent once, later calls only send its hash
+	commands := server.Commands()
+	if n := countCommand(commands, "EVAL"); n != 1 {
+		t.Errorf("Expected 1 EVAL, got %d", n)
+	}
+	if n := countCommand(commands, "EVALSHA"); n != 4 {
+		t.Errorf("Expected 4 EVALSHA, got %d", n)
+	}
 }
 
-func TestRedisCache_EmptyCache(t *testing.T) {
-	emptyCache(t, newRedisStore)
-}
+func TestRedisCache_DroppedConnections(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+	store := NewRedisCache(server.Addr(), "", time.Hour)
 
-func TestRedisCache_Replace(t *testing.T) {
-	testReplace(t, newRedisStore)
-}
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	// the pooled connection is checked before being used again
+	server.DropConnections()
+	var value string
+	if err := store.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the value after a restart, got %q, %v", value, err)
+	}
 
-func TestRedisCache_Add(t *testing.T) {
-	testAdd(t, newRedisStore)
+	// both the health check and the command itself fail
+	server.DropNext(2)
+	if err := store.Get("key", &value); !isStoreFailure(err) {
+		t.Errorf("Expected a failure on a dropped connection, got: %v", err)
+	}
+	if err := store.Get("key", &value); err != nil {
+		t.Errorf("Expected the store to reconnect, got: %v", err)
+	}
 }
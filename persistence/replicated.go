@@ -0,0 +1,498 @@
+package persistence
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ReplicatedOptions configures a ReplicatedStore
+type ReplicatedOptions struct {
+	// WriteQuorum is the number of replicas a write must succeed on, 1 by
+	// default. Writes wait for the first WriteQuorum replicas, and the others
+	// are written asynchronously, except for deletes, which wait for every
+	// replica.
+	WriteQuorum int
+
+	// RetryInterval is how long a replica that failed is only read from when
+	// no other replica can answer, 10 seconds by default
+	RetryInterval time.Duration
+
+	// OnFailure is called with the index of the replica and the error when an
+	// operation on a replica fails, including the asynchronous writes and the
+	// writes dropped because the replica is too far behind. Misses and the
+	// other errors of the CacheStore contract aren't failures.
+	OnFailure func(replica int, key string, err error)
+}
+
+// ReplicatedStore writes every item to several stores, and reads it from the
+// first that has it, so that losing one of them doesn't empty the cache. An
+// item found after misses is copied to the replicas that missed it, like a
+// replica that restarted empty. Misses aren't looked for on the replicas that
+// failed recently, which may have missed deletes.
+type ReplicatedStore struct {
+	replicas      []CacheStore
+	quorum        int
+	retryInterval time.Duration
+	onFailure     func(replica int, key string, err error)
+
+	mu       sync.Mutex
+	failedAt []time.Time
+	closed   bool
+
+	// queues hold the asynchronous writes of each replica, which are applied
+	// in order
+	queues  []chan func()
+	pending sync.WaitGroup
+}
+
+// replicatedQueueSize bounds the writes waiting for a replica, beyond which
+// the writes are dropped
+const replicatedQueueSize = 1024
+
+var (
+	errReplicatedClosed = errors.New("cache: replicated store closed.")
+	errReplicaQueueFull = errors.New("cache: too many writes waiting for the replica.")
+)
+
+// NewReplicatedStore returns a ReplicatedStore over replicas, which must not
+// be empty. Reads try them in order.
+func NewReplicatedStore(replicas []CacheStore, options ReplicatedOptions) *ReplicatedStore {
+	if len(replicas) == 0 {
+		panic("cache: ReplicatedStore without replicas")
+	}
+	quorum := options.WriteQuorum
+	if quorum <= 0 {
+		quorum = 1
+	} else if quorum > len(replicas) {
+		quorum = len(replicas)
+	}
+	retryInterval := options.RetryInterval
+	if retryInterval <= 0 {
+		retryInterval = 10 * time.Second
+	}
+	c := &ReplicatedStore{
+		replicas:      replicas,
+		quorum:        quorum,
+		retryInterval: retryInterval,
+		onFailure:     options.OnFailure,
+		failedAt:      make([]time.Time, len(replicas)),
+		queues:        make([]chan func(), len(replicas)),
+	}
+	for i := range c.queues {
+		c.queues[i] = make(chan func(), replicatedQueueSize)
+		go func(queue chan func()) {
+			for write := range queue {
+				write()
+			}
+		}(c.queues[i])
+	}
+	return c
+}
+
+// Wait waits for the asynchronous writes to finish
+func (c *ReplicatedStore) Wait() {
+	c.pending.Wait()
+}
+
+// Close waits for the asynchronous writes to finish and stops the goroutines
+// writing to the replicas. It doesn't close the replicas. The writes fail
+// once the store is closed.
+func (c *ReplicatedStore) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	c.pending.Wait()
+	for _, queue := range c.queues {
+		close(queue)
+	}
+	return nil
+}
+
+// Get (see CacheStore interface)
+func (c *ReplicatedStore) Get(key string, value interface{}) error {
+	found, missed, err := c.read(key, func(store CacheStore) error {
+		return store.Get(key, value)
+	})
+	if err == nil {
+		c.backfill(key, found, missed, value)
+	}
+	return err
+}
+
+// Set (see CacheStore interface)
+func (c *ReplicatedStore) Set(key string, value interface{}, expires time.Duration) error {
+	return c.write(key, c.order(), c.quorum, c.quorum, func(store CacheStore) error {
+		return store.Set(key, value, expires)
+	})
+}
+
+// Add (see CacheStore interface). Whether the item is added is decided by the
+// first healthy replica, which the others then follow.
+func (c *ReplicatedStore) Add(key string, value interface{}, expires time.Duration) error {
+	return c.lead(key, func(store CacheStore) error {
+		return store.Add(key, value, expires)
+	}, func(store CacheStore) error {
+		return store.Set(key, value, expires)
+	})
+}
+
+// Replace (see CacheStore interface). Whether the item is replaced is decided
+// by the first healthy replica, which the others then follow.
+func (c *ReplicatedStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return c.lead(key, func(store CacheStore) error {
+		return store.Replace(key, value, expires)
+	}, func(store CacheStore) error {
+		return store.Set(key, value, expires)
+	})
+}
+
+// Delete (see CacheStore interface). It waits for every replica, so that the
+// item isn't read back from a replica that didn't delete it yet.
+func (c *ReplicatedStore) Delete(key string) error {
+	return c.write(key, c.order(), len(c.replicas), c.quorum, func(store CacheStore) error {
+		return store.Delete(key)
+	})
+}
+
+// Increment (see CacheStore interface). The counter is updated by the first
+// healthy replica, which the others then follow.
+func (c *ReplicatedStore) Increment(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(store CacheStore) (uint64, error) {
+		return store.Increment(key, delta)
+	})
+}
+
+// Decrement (see CacheStore interface)
+func (c *ReplicatedStore) Decrement(key string, delta uint64) (uint64, error) {
+	return c.count(key, func(store CacheStore) (uint64, error) {
+		return store.Decrement(key, delta)
+	})
+}
+
+// Flush (see CacheStore interface). It waits for every replica, like Delete.
+func (c *ReplicatedStore) Flush() error {
+	return c.write("", c.order(), len(c.replicas), c.quorum, func(store CacheStore) error {
+		return store.Flush()
+	})
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *ReplicatedStore) TTL(key string) (ttl time.Duration, err error) {
+	_, _, err = c.read(key, func(store CacheStore) (err error) {
+		ttl, err = TTL(store, key)
+		return err
+	})
+	return ttl, err
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *ReplicatedStore) Touch(key string, expires time.Duration) error {
+	return c.write(key, c.order(), c.quorum, c.quorum, func(store CacheStore) error {
+		return Touch(store, key, expires)
+	})
+}
+
+// GetMulti (see BatchCacheStore interface). The keys a replica misses or
+// fails to get are looked for in the next ones, like with Get.
+func (c *ReplicatedStore) GetMulti(values map[string]interface{}) error {
+	result := MultiError{}
+	missed := make(map[string][]int)
+	batch := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		batch[key] = value
+	}
+	for _, i := range c.order() {
+		if c.failedRecently(i) {
+			for key := range batch {
+				if len(missed[key]) > 0 {
+					delete(batch, key)
+				}
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		errs := MultiError{}
+		errs.merge(c.report(i, "", GetMulti(c.replicas[i], batch)), batch)
+		next := make(map[string]interface{})
+		for key, value := range batch {
+			switch err := errs[key]; {
+			case err == nil:
+				delete(result, key)
+				c.backfill(key, i, missed[key], value)
+			case err == ErrCacheMiss:
+				result[key] = err
+				missed[key] = append(missed[key], i)
+				next[key] = value
+			case isStoreFailure(err):
+				if len(missed[key]) == 0 {
+					result[key] = err
+				}
+				next[key] = value
+			default:
+				result[key] = err
+			}
+		}
+		batch = next
+	}
+	return result.errOrNil()
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *ReplicatedStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	return c.write("", c.order(), c.quorum, c.quorum, func(store CacheStore) error {
+		return SetMulti(store, values, expires)
+	})
+}
+
+// DeleteMulti (see BatchCacheStore interface). A key is missing only if it
+// is missing from every replica. It waits for every replica, like Delete.
+func (c *ReplicatedStore) DeleteMulti(keys ...string) error {
+	var mu sync.Mutex
+	deleted := make(map[string]bool)
+	err := c.write("", c.order(), len(c.replicas), c.quorum, func(store CacheStore) error {
+		err := DeleteMulti(store, keys...)
+		errs, _ := err.(MultiError)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, key := range keys {
+			if err == nil || errs != nil && errs[key] == nil {
+				deleted[key] = true
+			}
+		}
+		if isStoreFailure(err) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	errs := MultiError{}
+	for _, key := range keys {
+		if !deleted[key] {
+			errs[key] = ErrCacheMiss
+		}
+	}
+	return errs.errOrNil()
+}
+
+// read calls op on the replicas in order until one has the item, moving on
+// after failures and misses. A miss isn't looked for on the replicas that
+// failed recently, as they may have missed the delete. read returns the
+// replica that answered, and those that missed the item before it.
+func (c *ReplicatedStore) read(key string, op func(store CacheStore) error) (int, []int, error) {
+	var missed []int
+	var err error
+	for _, i := range c.order() {
+		if len(missed) > 0 && c.failedRecently(i) {
+			break
+		}
+		switch err = c.report(i, key, op(c.replicas[i])); {
+		case err == nil:
+			return i, missed, nil
+		case err == ErrCacheMiss:
+			missed = append(missed, i)
+		case !isStoreFailure(err):
+			return i, missed, err
+		}
+	}
+	if len(missed) > 0 {
+		err = ErrCacheMiss
+	}
+	return -1, missed, err
+}
+
+// backfill copies the item value found on a replica to the replicas that
+// missed it, in the background. The item keeps its expiration, and isn't
+// copied over an item written meanwhile.
+func (c *ReplicatedStore) backfill(key string, found int, missed []int, value interface{}) {
+	v := reflect.ValueOf(value)
+	if len(missed) == 0 || v.Kind() != reflect.Ptr || v.IsNil() {
+		return
+	}
+	expires, err := TTL(c.replicas[found], key)
+	switch {
+	case err == ErrNotSupport:
+		expires = DEFAULT
+	case err != nil || expires == DEFAULT:
+		// the item is gone, or about to expire
+		return
+	}
+	item := v.Elem().Interface()
+	for _, i := range missed {
+		i := i
+		c.enqueue(i, key, func() {
+			c.report(i, key, c.replicas[i].Add(key, item, expires))
+		})
+	}
+}
+
+// write calls op on the replicas concurrently, and returns once the first
+// sync of them are done and quorum of them succeeded, or when they can't
+// anymore. The writes go through the queues of the replicas, so that each
+// replica applies them in order, but only the first sync are waited for.
+func (c *ReplicatedStore) write(key string, replicas []int, sync, quorum int, op func(store CacheStore) error) error {
+	if c.isClosed() {
+		return errReplicatedClosed
+	}
+	sync = min(sync, len(replicas))
+	results := make(chan replicaResult, len(replicas))
+	for n, i := range replicas {
+		i, sync := i, n < sync
+		err := c.enqueue(i, key, func() {
+			results <- replicaResult{sync, c.report(i, key, op(c.replicas[i]))}
+		})
+		if err != nil {
+			results <- replicaResult{sync, err}
+		}
+	}
+	if sync <= 0 || quorum <= 0 {
+		return nil
+	}
+
+	var first error
+	waiting, succeeded := sync, 0
+	for n := 1; n <= len(replicas); n++ {
+		result := <-results
+		if result.sync {
+			waiting--
+		}
+		if result.err == nil {
+			succeeded++
+		} else if first == nil || isStoreFailure(first) && !isStoreFailure(result.err) {
+			// the errors of the contract tell more than failures
+			first = result.err
+		}
+		if waiting <= 0 && succeeded >= quorum {
+			return nil
+		}
+		if waiting <= 0 && succeeded+len(replicas)-n < quorum {
+			break
+		}
+	}
+	return first
+}
+
+type replicaResult struct {
+	sync bool
+	err  error
+}
+
+// lead calls op on the first replica that doesn't fail, then follow on the
+// other replicas
+func (c *ReplicatedStore) lead(key string, op, follow func(store CacheStore) error) error {
+	if c.isClosed() {
+		return errReplicatedClosed
+	}
+	var err error
+	order := c.order()
+	for n, i := range order {
+		if err = c.report(i, key, op(c.replicas[i])); isStoreFailure(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return c.write(key, order[n+1:], c.quorum-1, c.quorum-1, follow)
+	}
+	return err
+}
+
+// count updates a counter on the first replica that doesn't fail, then copies
+// its value to the other replicas
+func (c *ReplicatedStore) count(key string, op func(store CacheStore) (uint64, error)) (uint64, error) {
+	var value uint64
+	var leader CacheStore
+	err := c.lead(key, func(store CacheStore) (err error) {
+		value, err = op(store)
+		leader = store
+		return err
+	}, func(store CacheStore) error {
+		expires, err := TTL(leader, key)
+		if err == ErrNotSupport {
+			expires = DEFAULT
+		} else if err != nil {
+			return err
+		}
+		return store.Set(key, value, expires)
+	})
+	return value, err
+}
+
+// enqueue adds write to the queue of the replica. A write that doesn't fit in
+// the queue, as the replica is too slow, is dropped and reported as a failure
+// of the replica rather than holding up the other replicas.
+func (c *ReplicatedStore) enqueue(replica int, key string, write func()) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return errReplicatedClosed
+	}
+	c.pending.Add(1)
+	select {
+	case c.queues[replica] <- func() {
+		defer c.pending.Done()
+		write()
+	}:
+		c.mu.Unlock()
+		return nil
+	default:
+	}
+	c.mu.Unlock()
+	c.pending.Done()
+	return c.report(replica, key, errReplicaQueueFull)
+}
+
+// order returns the indexes of the replicas to read from: the healthy ones
+// first, then those that failed recently
+func (c *ReplicatedStore) order() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	healthy := make([]int, 0, len(c.replicas))
+	var failed []int
+	for i, failedAt := range c.failedAt {
+		if now.Sub(failedAt) < c.retryInterval {
+			failed = append(failed, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+func (c *ReplicatedStore) failedRecently(replica int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.failedAt[replica]) < c.retryInterval
+}
+
+func (c *ReplicatedStore) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// report remembers when a replica fails and tells OnFailure, and returns err
+func (c *ReplicatedStore) report(replica int, key string, err error) error {
+	if !isStoreFailure(err) {
+		return err
+	}
+	c.mu.Lock()
+	c.failedAt[replica] = time.Now()
+	c.mu.Unlock()
+	if c.onFailure != nil {
+		c.onFailure(replica, key, err)
+	}
+	return err
+}
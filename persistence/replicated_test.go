@@ -0,0 +1,190 @@
+package persistence
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+var newReplicatedStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
+	store := NewReplicatedStore([]CacheStore{
+		NewInMemoryStore(defaultExpiration),
+		NewInMemoryStore(defaultExpiration),
+		NewInMemoryStore(defaultExpiration),
+	}, ReplicatedOptions{})
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestReplicatedCache_Failover(t *testing.T) {
+	primary := &downStore{CacheStore: NewInMemoryStore(time.Hour)}
+	secondary := NewInMemoryStore(time.Hour)
+	var mu sync.Mutex
+	var failures []int
+	cache := NewReplicatedStore([]CacheStore{primary, secondary}, ReplicatedOptions{
+		OnFailure: func(replica int, key string, err error) {
+			mu.Lock()
+			failures = append(failures, replica)
+			mu.Unlock()
+		},
+	})
+
+	if err := cache.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	cache.Wait()
+	var value string
+	if err := secondary.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the secondary replica to be written, got %q, %v", value, err)
+	}
+
+	primary.down = true
+	value = ""
+	if err := cache.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the secondary replica to answer, got %q, %v", value, err)
+	}
+	// the failed replica is written again, but read last
+	if err := cache.Set("other", "value", DEFAULT); err != nil {
+		t.Errorf("Expected a write to the secondary replica, got %v", err)
+	}
+	cache.Wait()
+	if err := cache.Get("other", &value); err != nil || value != "value" {
+		t.Errorf("Expected the secondary replica to answer, got %q, %v", value, err)
+	}
+	mu.Lock()
+	if len(failures) != 2 || failures[0] != 0 || failures[1] != 0 {
+		t.Errorf("Expected the failures of the primary replica to be reported, got %v", failures)
+	}
+	mu.Unlock()
+}
+
+func TestReplicatedCache_ReadFallbackOnMiss(t *testing.T) {
+	primary, secondary := NewInMemoryStore(time.Hour), NewInMemoryStore(time.Hour)
+	cache := NewReplicatedStore([]CacheStore{primary, secondary}, ReplicatedOptions{})
+	defer cache.Close()
+	// an item the primary replica lost, like after a restart
+	secondary.Set("key", "value", time.Minute)
+	secondary.Set("other", "value", DEFAULT)
+
+	var value string
+	if err := cache.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the secondary replica to answer, got %q, %v", value, err)
+	}
+	var other string
+	values := map[string]interface{}{"other": &other}
+	if err := cache.GetMulti(values); err != nil || other != "value" {
+		t.Errorf("Expected the secondary replica to answer, got %q, %v", other, err)
+	}
+
+	// the primary replica was filled back with the items it missed
+	cache.Wait()
+	for _, key := range []string{"key", "other"} {
+		value = ""
+		if err := primary.Get(key, &value); err != nil || value != "value" {
+			t.Errorf("Expected the primary replica to be filled back, got %q, %v", value, err)
+		}
+	}
+	if ttl, err := primary.TTL("key"); err != nil || ttl <= 0 || ttl > time.Minute {
+		t.Errorf("Expected the filled back item to keep its expiration, got %v, %v", ttl, err)
+	}
+}
+
+// gatedStore holds Set and Delete until its gate is closed
+type gatedStore struct {
+	CacheStore
+	gate chan struct{}
+}
+
+func (s *gatedStore) Set(key string, value interface{}, expires time.Duration) error {
+	<-s.gate
+	return s.CacheStore.Set(key, value, expires)
+}
+
+func (s *gatedStore) Delete(key string) error {
+	<-s.gate
+	return s.CacheStore.Delete(key)
+}
+
+func TestReplicatedCache_DeleteWaitsForReplicas(t *testing.T) {
+	primary, secondary := NewInMemoryStore(time.Hour), NewInMemoryStore(time.Hour)
+	gated := &gatedStore{secondary, make(chan struct{})}
+	cache := NewReplicatedStore([]CacheStore{primary, gated}, ReplicatedOptions{})
+	defer cache.Close()
+	primary.Set("key", "value", DEFAULT)
+	secondary.Set("key", "value", DEFAULT)
+
+	deleted := make(chan error)
+	go func() { deleted <- cache.Delete("key") }()
+	select {
+	case err := <-deleted:
+		t.Fatalf("Expected the delete to wait for the secondary replica, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(gated.gate)
+	if err := <-deleted; err != nil {
+		t.Fatalf("Error deleting a value: %s", err)
+	}
+	var value string
+	if err := secondary.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected the secondary replica to be deleted from, got %q, %v", value, err)
+	}
+	if err := cache.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected a miss, got %q, %v", value, err)
+	}
+}
+
+func TestReplicatedCache_QueueFull(t *testing.T) {
+	gated := &gatedStore{NewInMemoryStore(time.Hour), make(chan struct{})}
+	var mu sync.Mutex
+	var failures []error
+	cache := NewReplicatedStore([]CacheStore{NewInMemoryStore(time.Hour), gated}, ReplicatedOptions{
+		OnFailure: func(replica int, key string, err error) {
+			mu.Lock()
+			failures = append(failures, err)
+			mu.Unlock()
+		},
+	})
+	defer cache.Close()
+
+	// the secondary replica holds one write, and queues replicatedQueueSize
+	// of them
+	for i := 0; i < replicatedQueueSize+10; i++ {
+		if err := cache.Set("key", i, DEFAULT); err != nil {
+			t.Fatalf("Error setting a value: %s", err)
+		}
+	}
+	close(gated.gate)
+	cache.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(failures) < 9 || failures[0] != errReplicaQueueFull {
+		t.Errorf("Expected the dropped writes to be reported, got %d failures", len(failures))
+	}
+}
+
+func TestReplicatedCache_Closed(t *testing.T) {
+	cache := NewReplicatedStore([]CacheStore{NewInMemoryStore(time.Hour), NewInMemoryStore(time.Hour)}, ReplicatedOptions{})
+	cache.Close()
+	if err := cache.Set("key", "value", DEFAULT); err != errReplicatedClosed {
+		t.Errorf("Expected writes to fail once closed, got %v", err)
+	}
+	if _, err := cache.Increment("key", 1); err != errReplicatedClosed {
+		t.Errorf("Expected writes to fail once closed, got %v", err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Errorf("Expected closing twice to be a no-op, got %v", err)
+	}
+}
+
+func TestReplicatedCache_WriteQuorum(t *testing.T) {
+	down := &downStore{CacheStore: NewInMemoryStore(time.Hour), down: true}
+	cache := NewReplicatedStore([]CacheStore{NewInMemoryStore(time.Hour), down}, ReplicatedOptions{WriteQuorum: 2})
+	if err := cache.Set("key", "value", DEFAULT); err != errShardDown {
+		t.Errorf("Expected the write to miss its quorum, got %v", err)
+	}
+
+	cache = NewReplicatedStore([]CacheStore{NewInMemoryStore(time.Hour), down, NewInMemoryStore(time.Hour)}, ReplicatedOptions{WriteQuorum: 2})
+	if err := cache.Set("key", "value", DEFAULT); err != nil {
+		t.Errorf("Expected the third replica to make the quorum, got %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package persistence
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"time"
+)
+
+// Operation names an operation of the stores, for the policies of a
+// RetryStore
+type Operation string
+
+// The operations of the stores
+const (
+	OpGet            Operation = "Get"
+	OpSet            Operation = "Set"
+	OpAdd            Operation = "Add"
+	OpReplace        Operation = "Replace"
+	OpDelete         Operation = "Delete"
+	OpIncrement      Operation = "Increment"
+	OpDecrement      Operation = "Decrement"
+	OpFlush          Operation = "Flush"
+	OpTTL            Operation = "TTL"
+	OpTouch          Operation = "Touch"
+	OpGetWithVersion Operation = "GetWithVersion"
+	OpCompareAndSet  Operation = "CompareAndSet"
+	OpGetMulti       Operation = "GetMulti"
+	OpSetMulti       Operation = "SetMulti"
+	OpDeleteMulti    Operation = "DeleteMulti"
+)
+
+var operations = []Operation{
+	OpGet, OpSet, OpAdd, OpReplace, OpDelete, OpIncrement, OpDecrement, OpFlush,
+	OpTTL, OpTouch, OpGetWithVersion, OpCompareAndSet, OpGetMulti, OpSetMulti, OpDeleteMulti,
+}
+
+// RetryPolicy configures how a RetryStore calls one operation
+type RetryPolicy struct {
+	// Timeout bounds each attempt. An attempt timing out fails with
+	// ErrTimeout but isn't canceled: the store may still complete it, so a
+	// Set or Delete that timed out may be applied later, after the writes
+	// that followed it. Zero means no timeout.
+	Timeout time.Duration
+
+	// MaxRetries is the number of attempts after the first one failed. Only
+	// the idempotent operations are retried.
+	MaxRetries int
+
+	// Backoff is the wait before the first retry, 10 milliseconds by default.
+	// It doubles with every retry, up to MaxBackoff, and is jittered by up to
+	// half of it.
+	Backoff time.Duration
+
+	// MaxBackoff bounds the wait between two retries, 1 second by default
+	MaxBackoff time.Duration
+}
+
+// RetryOptions configures a RetryStore
+type RetryOptions struct {
+	// Default is the policy of the operations missing from Operations
+	Default RetryPolicy
+
+	// Operations holds the policies of single operations, such as OpGet or
+	// OpSetMulti
+	Operations map[Operation]RetryPolicy
+
+	// MaxPending bounds the attempts with a timeout running at once,
+	// including those that timed out and didn't complete yet, 1024 by
+	// default. Attempts beyond it fail right away with ErrTimeout, rather
+	// than piling up on a store that hangs.
+	MaxPending int
+}
+
+// RetryStore bounds the time taken by the operations of a store, and retries
+// those that fail with errors other than the errors of the CacheStore
+// contract, such as network errors. Add, Increment, Decrement and
+// CompareAndSet are never retried, as an attempt that failed on the way back
+// may have been applied already.
+type RetryStore struct {
+	store   CacheStore
+	options RetryOptions
+	pending chan struct{}
+}
+
+// NewRetryStore returns a RetryStore in front of store. It panics if
+// Operations holds an unknown operation.
+func NewRetryStore(store CacheStore, options RetryOptions) *RetryStore {
+	for op := range options.Operations {
+		if !isOperation(op) {
+			panic(fmt.Sprintf("cache: unknown operation %q in RetryOptions", op))
+		}
+	}
+	maxPending := options.MaxPending
+	if maxPending <= 0 {
+		maxPending = 1024
+	}
+	return &RetryStore{store, options, make(chan struct{}, maxPending)}
+}
+
+func isOperation(op Operation) bool {
+	for _, known := range operations {
+		if op == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Get (see CacheStore interface)
+func (c *RetryStore) Get(key string, value interface{}) error {
+	// an attempt timing out goes on in the background, so each attempt
+	// decodes into its own copy of value
+	result, err := c.do(OpGet, true, func() (interface{}, error) {
+		v := newLike(value)
+		return v, c.store.Get(key, v)
+	})
+	if err == nil {
+		copyInto(value, result)
+	}
+	return err
+}
+
+// Set (see CacheStore interface)
+func (c *RetryStore) Set(key string, value interface{}, expires time.Duration) error {
+	_, err := c.do(OpSet, true, func() (interface{}, error) {
+		return nil, c.store.Set(key, value, expires)
+	})
+	return err
+}
+
+// Add (see CacheStore interface)
+func (c *RetryStore) Add(key string, value interface{}, expires time.Duration) error {
+	_, err := c.do(OpAdd, false, func() (interface{}, error) {
+		return nil, c.store.Add(key, value, expires)
+	})
+	return err
+}
+
+// Replace (see CacheStore interface)
+func (c *RetryStore) Replace(key string, value interface{}, expires time.Duration) error {
+	_, err := c.do(OpReplace, true, func() (interface{}, error) {
+		return nil, c.store.Replace(key, value, expires)
+	})
+	return err
+}
+
+// Delete (see CacheStore interface)
+func (c *RetryStore) Delete(key string) error {
+	_, err := c.do(OpDelete, true, func() (interface{}, error) {
+		return nil, c.store.Delete(key)
+	})
+	return err
+}
+
+// Increment (see CacheStore interface)
+func (c *RetryStore) Increment(key string, delta uint64) (uint64, error) {
+	result, err := c.do(OpIncrement, false, func() (interface{}, error) {
+		return c.store.Increment(key, delta)
+	})
+	value, _ := result.(uint64)
+	return value, err
+}
+
+// Decrement (see CacheStore interface)
+func (c *RetryStore) Decrement(key string, delta uint64) (uint64, error) {
+	result, err := c.do(OpDecrement, false, func() (interface{}, error) {
+		return c.store.Decrement(key, delta)
+	})
+	value, _ := result.(uint64)
+	return value, err
+}
+
+// Flush (see CacheStore interface)
+func (c *RetryStore) Flush() error {
+	_, err := c.do(OpFlush, true, func() (interface{}, error) {
+		return nil, c.store.Flush()
+	})
+	return err
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *RetryStore) TTL(key string) (time.Duration, error) {
+	result, err := c.do(OpTTL, true, func() (interface{}, error) {
+		return TTL(c.store, key)
+	})
+	ttl, _ := result.(time.Duration)
+	return ttl, err
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *RetryStore) Touch(key string, expires time.Duration) error {
+	_, err := c.do(OpTouch, true, func() (interface{}, error) {
+		return nil, Touch(c.store, key, expires)
+	})
+	return err
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (c *RetryStore) GetWithVersion(key string, value interface{}) (Version, error) {
+	type versioned struct {
+		value   interface{}
+		version Version
+	}
+	result, err := c.do(OpGetWithVersion, true, func() (interface{}, error) {
+		v := newLike(value)
+		version, err := GetWithVersion(c.store, key, v)
+		return versioned{v, version}, err
+	})
+	if err != nil {
+		return Version{}, err
+	}
+	copyInto(value, result.(versioned).value)
+	return result.(versioned).version, nil
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (c *RetryStore) CompareAndSet(key string, value interface{}, version Version, expires time.Duration) error {
+	_, err := c.do(OpCompareAndSet, false, func() (interface{}, error) {
+		return nil, CompareAndSet(c.store, key, value, version, expires)
+	})
+	return err
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (c *RetryStore) GetMulti(values map[string]interface{}) error {
+	result, err := c.do(OpGetMulti, true, func() (interface{}, error) {
+		copies := make(map[string]interface{}, len(values))
+		for key, value := range values {
+			copies[key] = newLike(value)
+		}
+		return copies, GetMulti(c.store, copies)
+	})
+	if copies, ok := result.(map[string]interface{}); ok {
+		errs, _ := err.(MultiError)
+		for key, value := range copies {
+			if err == nil || errs != nil && errs[key] == nil {
+				copyInto(values[key], value)
+			}
+		}
+	}
+	return err
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *RetryStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	_, err := c.do(OpSetMulti, true, func() (interface{}, error) {
+		return nil, SetMulti(c.store, values, expires)
+	})
+	return err
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (c *RetryStore) DeleteMulti(keys ...string) error {
+	_, err := c.do(OpDeleteMulti, true, func() (interface{}, error) {
+		return nil, DeleteMulti(c.store, keys...)
+	})
+	return err
+}
+
+// do runs op with the policy of operation, retrying it if it is idempotent
+func (c *RetryStore) do(operation Operation, idempotent bool, op func() (interface{}, error)) (interface{}, error) {
+	policy, found := c.options.Operations[operation]
+	if !found {
+		policy = c.options.Default
+	}
+	backoff, maxBackoff := policy.Backoff, policy.MaxBackoff
+	if backoff <= 0 {
+		backoff = 10 * time.Millisecond
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = time.Second
+	}
+
+	for retries := 0; ; retries++ {
+		result, err := c.withTimeout(policy.Timeout, op)
+		if !idempotent || retries >= policy.MaxRetries || !isStoreFailure(err) || err == ErrCircuitOpen {
+			return result, err
+		}
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1)))
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// withTimeout runs op, giving up after timeout if it is positive. op then
+// runs in the background, as one of the pending attempts.
+func (c *RetryStore) withTimeout(timeout time.Duration, op func() (interface{}, error)) (interface{}, error) {
+	if timeout <= 0 {
+		return op()
+	}
+	select {
+	case c.pending <- struct{}{}:
+	default:
+		return nil, ErrTimeout
+	}
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		defer func() { <-c.pending }()
+		result, err := op()
+		done <- outcome{result, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-timer.C:
+		return nil, ErrTimeout
+	}
+}
+
+// newLike returns a pointer to a new value of the type value points to, or
+// value itself if it isn't a pointer
+func newLike(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return value
+	}
+	return reflect.New(v.Elem().Type()).Interface()
+}
+
+// copyInto copies what the pointer from newLike points to into value
+func copyInto(value, from interface{}) {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Ptr || v.IsNil() || value == from {
+		return
+	}
+	v.Elem().Set(reflect.ValueOf(from).Elem())
+}
@@ -0,0 +1,139 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+var newRetryStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+	return NewRetryStore(NewInMemoryStore(defaultExpiration), RetryOptions{
+		Default: RetryPolicy{Timeout: time.Second, MaxRetries: 2},
+	})
+}
+
+// flakyStore fails the first calls of Get, Set and Increment
+type flakyStore struct {
+	CacheStore
+	failures int
+	calls    int
+}
+
+func (s *flakyStore) fail() bool {
+	s.calls++
+	return s.calls <= s.failures
+}
+
+func (s *flakyStore) Get(key string, value interface{}) error {
+	if s.fail() {
+		return errShardDown
+	}
+	return s.CacheStore.Get(key, value)
+}
+
+func (s *flakyStore) Set(key string, value interface{}, expires time.Duration) error {
+	if s.fail() {
+		return errShardDown
+	}
+	return s.CacheStore.Set(key, value, expires)
+}
+
+func (s *flakyStore) Increment(key string, delta uint64) (uint64, error) {
+	if s.fail() {
+		return 0, errShardDown
+	}
+	return s.CacheStore.Increment(key, delta)
+}
+
+func TestRetryCache_Retries(t *testing.T) {
+	store := &flakyStore{CacheStore: NewInMemoryStore(time.Hour), failures: 2}
+	cache := NewRetryStore(store, RetryOptions{
+		Default:    RetryPolicy{MaxRetries: 2, Backoff: time.Millisecond},
+		Operations: map[Operation]RetryPolicy{OpGet: {MaxRetries: 1, Backoff: time.Millisecond}},
+	})
+
+	if err := cache.Set("key", 1, DEFAULT); err != nil || store.calls != 3 {
+		t.Errorf("Expected the set to succeed on the third attempt, got %v after %d", err, store.calls)
+	}
+
+	store.calls = 0
+	var value int
+	if err := cache.Get("key", &value); err != errShardDown || store.calls != 2 {
+		t.Errorf("Expected the get to fail after one retry, got %v after %d", err, store.calls)
+	}
+
+	// misses aren't retried
+	store.calls, store.failures = 0, 0
+	if err := cache.Get("missing", &value); err != ErrCacheMiss || store.calls != 1 {
+		t.Errorf("Expected a miss after one attempt, got %v after %d", err, store.calls)
+	}
+
+	// neither are the operations that aren't idempotent
+	store.calls, store.failures = 0, 1
+	if _, err := cache.Increment("key", 1); err != errShardDown || store.calls != 1 {
+		t.Errorf("Expected the increment to fail without retries, got %v after %d", err, store.calls)
+	}
+}
+
+func TestRetryCache_Timeout(t *testing.T) {
+	store := &slowStore{NewInMemoryStore(time.Hour), 100 * time.Millisecond}
+	store.Set("key", "value", DEFAULT)
+	cache := NewRetryStore(store, RetryOptions{
+		Operations: map[Operation]RetryPolicy{OpGet: {Timeout: 20 * time.Millisecond, MaxRetries: 1}},
+	})
+
+	start := time.Now()
+	value := "unchanged"
+	if err := cache.Get("key", &value); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 80*time.Millisecond {
+		t.Errorf("Expected the get to give up after two attempts, took %s", elapsed)
+	}
+	// the attempts finishing late don't write into value
+	time.Sleep(150 * time.Millisecond)
+	if value != "unchanged" {
+		t.Errorf("Expected value to be left alone, got %q", value)
+	}
+}
+
+func TestRetryCache_MaxPending(t *testing.T) {
+	store := &slowStore{NewInMemoryStore(time.Hour), 100 * time.Millisecond}
+	cache := NewRetryStore(store, RetryOptions{
+		Default:    RetryPolicy{Timeout: 10 * time.Millisecond},
+		MaxPending: 1,
+	})
+	var value string
+	if err := cache.Get("key", &value); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+
+	// the first attempt still runs, the next one fails without waiting
+	start := time.Now()
+	if err := cache.Get("key", &value); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= 10*time.Millisecond {
+		t.Errorf("Expected the attempt to fail right away, took %s", elapsed)
+	}
+
+	// until the first attempt completes
+	time.Sleep(100 * time.Millisecond)
+	start = time.Now()
+	if err := cache.Get("key", &value); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 10*time.Millisecond {
+		t.Errorf("Expected the attempt to run, took %s", elapsed)
+	}
+}
+
+func TestRetryCache_UnknownOperation(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a misspelled operation to panic")
+		}
+	}()
+	NewRetryStore(NewInMemoryStore(time.Hour), RetryOptions{
+		Operations: map[Operation]RetryPolicy{"Gett": {MaxRetries: 1}},
+	})
+}
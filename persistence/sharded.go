@@ -0,0 +1,380 @@
+package persistence
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/utils"
+)
+
+// ShardNode is one of the stores of a ShardedStore
+type ShardNode struct {
+	// Name places the node on the ring. It must not change when the nodes are
+	// added or removed, so that the other nodes keep their keys.
+	Name  string
+	Store CacheStore
+	// Weight is the share of the keys of the node relative to the others, 1 by
+	// default
+	Weight int
+}
+
+// ShardedOptions configures a ShardedStore
+type ShardedOptions struct {
+	// VirtualNodes is the number of points on the ring per unit of weight, 160
+	// by default. More points spread the keys more evenly.
+	VirtualNodes int
+
+	// MaxFailures is the number of consecutive failures after which a node is
+	// ejected from the ring, its keys going to the next nodes. Zero disables
+	// the ejection. Misses and the other errors of the CacheStore contract
+	// aren't failures.
+	MaxFailures int
+
+	// EjectionTime is how long an ejected node is left out before it is tried
+	// again, 30 seconds by default. The node is flushed before it gets its
+	// keys back, as they may have changed on the other nodes meanwhile. The
+	// copies left on the other nodes aren't deleted: they may be served again
+	// if the node is ejected again before they expire.
+	EjectionTime time.Duration
+}
+
+// ShardedStore spreads the keys over several stores of any kind with
+// consistent hashing: adding or removing one of N nodes only moves about 1/N
+// of the keys.
+type ShardedStore struct {
+	nodes        []*shardNode
+	ring         []shardPoint
+	maxFailures  int
+	ejectionTime time.Duration
+}
+
+type shardNode struct {
+	ShardNode
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+	// stale is set while a node that was ejected hasn't been flushed yet,
+	// flushing while it is being flushed
+	stale    bool
+	flushing bool
+}
+
+// shardPoint is a virtual node, owning the keys hashed up to its hash
+type shardPoint struct {
+	hash uint32
+	node *shardNode
+}
+
+// NewShardedStore returns a ShardedStore over nodes, which must not be empty
+func NewShardedStore(nodes []ShardNode, options ShardedOptions) *ShardedStore {
+	if len(nodes) == 0 {
+		panic("cache: ShardedStore without nodes")
+	}
+	virtualNodes := options.VirtualNodes
+	if virtualNodes <= 0 {
+		virtualNodes = 160
+	}
+	ejectionTime := options.EjectionTime
+	if ejectionTime <= 0 {
+		ejectionTime = 30 * time.Second
+	}
+	c := &ShardedStore{maxFailures: options.MaxFailures, ejectionTime: ejectionTime}
+	for _, node := range nodes {
+		n := &shardNode{ShardNode: node}
+		weight := node.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		for i := 0; i < weight*virtualNodes; i++ {
+			c.ring = append(c.ring, shardPoint{ringHash(node.Name + "#" + strconv.Itoa(i)), n})
+		}
+		c.nodes = append(c.nodes, n)
+	}
+	sort.Slice(c.ring, func(i, j int) bool {
+		return c.ring[i].hash < c.ring[j].hash
+	})
+	return c
+}
+
+// Node returns the name of the node holding key
+func (c *ShardedStore) Node(key string) string {
+	return c.node(key).Name
+}
+
+// Ejected returns the names of the nodes currently ejected from the ring
+func (c *ShardedStore) Ejected() []string {
+	var names []string
+	now := time.Now()
+	for _, n := range c.nodes {
+		if n.ejected(now) {
+			names = append(names, n.Name)
+		}
+	}
+	return names
+}
+
+// Get (see CacheStore interface)
+func (c *ShardedStore) Get(key string, value interface{}) error {
+	n := c.node(key)
+	return n.report(c, n.Store.Get(key, value))
+}
+
+// Set (see CacheStore interface)
+func (c *ShardedStore) Set(key string, value interface{}, expires time.Duration) error {
+	n := c.node(key)
+	return n.report(c, n.Store.Set(key, value, expires))
+}
+
+// Add (see CacheStore interface)
+func (c *ShardedStore) Add(key string, value interface{}, expires time.Duration) error {
+	n := c.node(key)
+	return n.report(c, n.Store.Add(key, value, expires))
+}
+
+// Replace (see CacheStore interface)
+func (c *ShardedStore) Replace(key string, value interface{}, expires time.Duration) error {
+	n := c.node(key)
+	return n.report(c, n.Store.Replace(key, value, expires))
+}
+
+// Delete (see CacheStore interface)
+func (c *ShardedStore) Delete(key string) error {
+	n := c.node(key)
+	return n.report(c, n.Store.Delete(key))
+}
+
+// Increment (see CacheStore interface)
+func (c *ShardedStore) Increment(key string, delta uint64) (uint64, error) {
+	n := c.node(key)
+	value, err := n.Store.Increment(key, delta)
+	return value, n.report(c, err)
+}
+
+// Decrement (see CacheStore interface)
+func (c *ShardedStore) Decrement(key string, delta uint64) (uint64, error) {
+	n := c.node(key)
+	value, err := n.Store.Decrement(key, delta)
+	return value, n.report(c, err)
+}
+
+// Flush (see CacheStore interface). It flushes every node, even the ejected
+// ones, and returns the first error.
+func (c *ShardedStore) Flush() error {
+	var first error
+	for _, n := range c.nodes {
+		if err := n.report(c, n.Store.Flush()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *ShardedStore) TTL(key string) (time.Duration, error) {
+	n := c.node(key)
+	ttl, err := TTL(n.Store, key)
+	return ttl, n.report(c, err)
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *ShardedStore) Touch(key string, expires time.Duration) error {
+	n := c.node(key)
+	return n.report(c, Touch(n.Store, key, expires))
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (c *ShardedStore) GetWithVersion(key string, value interface{}) (Version, error) {
+	n := c.node(key)
+	version, err := GetWithVersion(n.Store, key, value)
+	return version, n.report(c, err)
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (c *ShardedStore) CompareAndSet(key string, value interface{}, version Version, expires time.Duration) error {
+	n := c.node(key)
+	return n.report(c, CompareAndSet(n.Store, key, value, version, expires))
+}
+
+// GetMulti (see BatchCacheStore interface). The keys are sent to their nodes
+// with one call per node.
+func (c *ShardedStore) GetMulti(values map[string]interface{}) error {
+	batches := make(map[*shardNode]map[string]interface{})
+	for key, value := range values {
+		n := c.node(key)
+		if batches[n] == nil {
+			batches[n] = make(map[string]interface{})
+		}
+		batches[n][key] = value
+	}
+	errs := MultiError{}
+	for n, batch := range batches {
+		errs.merge(n.report(c, GetMulti(n.Store, batch)), batch)
+	}
+	return errs.errOrNil()
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *ShardedStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	batches := make(map[*shardNode]map[string]interface{})
+	for key, value := range values {
+		n := c.node(key)
+		if batches[n] == nil {
+			batches[n] = make(map[string]interface{})
+		}
+		batches[n][key] = value
+	}
+	errs := MultiError{}
+	for n, batch := range batches {
+		errs.merge(n.report(c, SetMulti(n.Store, batch, expires)), batch)
+	}
+	return errs.errOrNil()
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (c *ShardedStore) DeleteMulti(keys ...string) error {
+	batches := make(map[*shardNode]map[string]interface{})
+	for _, key := range keys {
+		n := c.node(key)
+		if batches[n] == nil {
+			batches[n] = make(map[string]interface{})
+		}
+		batches[n][key] = nil
+	}
+	errs := MultiError{}
+	for n, batch := range batches {
+		keys := make([]string, 0, len(batch))
+		for key := range batch {
+			keys = append(keys, key)
+		}
+		errs.merge(n.report(c, DeleteMulti(n.Store, keys...)), batch)
+	}
+	return errs.errOrNil()
+}
+
+// node returns the node owning key: the first node after the hash of key on
+// the ring that isn't ejected
+func (c *ShardedStore) node(key string) *shardNode {
+	hash := ringHash(key)
+	i := sort.Search(len(c.ring), func(i int) bool {
+		return c.ring[i].hash >= hash
+	})
+	now := time.Now()
+	for j := 0; j < len(c.ring); j++ {
+		n := c.ring[(i+j)%len(c.ring)].node
+		if n.available(c, now) {
+			return n
+		}
+	}
+	// with every node ejected, the keys go to their usual node
+	return c.ring[i%len(c.ring)].node
+}
+
+// report counts the consecutive failures of the node, ejecting it after too
+// many, and returns err
+func (n *shardNode) report(c *ShardedStore, err error) error {
+	if c.maxFailures <= 0 {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !isStoreFailure(err) {
+		n.failures = 0
+		return err
+	}
+	if n.failures++; n.failures >= c.maxFailures {
+		n.failures = 0
+		n.ejectedUntil = time.Now().Add(c.ejectionTime)
+		n.stale = true
+	}
+	return err
+}
+
+// available tells whether the node may serve its keys. A node coming back
+// from an ejection is flushed first, and ejected again if that fails.
+func (n *shardNode) available(c *ShardedStore, now time.Time) bool {
+	n.mu.Lock()
+	if now.Before(n.ejectedUntil) || n.flushing {
+		n.mu.Unlock()
+		return false
+	}
+	if !n.stale {
+		n.mu.Unlock()
+		return true
+	}
+	n.flushing = true
+	n.mu.Unlock()
+
+	err := n.Store.Flush()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.flushing = false
+	if err != nil {
+		n.ejectedUntil = time.Now().Add(c.ejectionTime)
+		return false
+	}
+	n.stale = false
+	return true
+}
+
+func (n *shardNode) ejected(now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return now.Before(n.ejectedUntil)
+}
+
+// merge adds the errors of a batch operation on keys to m. Errors other than
+// a MultiError apply to all the keys.
+func (m MultiError) merge(err error, keys map[string]interface{}) {
+	if err == nil {
+		return
+	}
+	if errs, ok := err.(MultiError); ok {
+		for key, err := range errs {
+			m[key] = err
+		}
+		return
+	}
+	for key := range keys {
+		m[key] = err
+	}
+}
+
+// isStoreFailure tells whether err means the store failed, rather than being
+// one of the answers of the CacheStore contract. Values that can't be encoded
+// or decoded, like counters that aren't numbers, are the caller's doing.
+func isStoreFailure(err error) bool {
+	switch err {
+	case nil, ErrCacheMiss, ErrNotStored, ErrNotSupport, ErrCASConflict:
+		return false
+	}
+	if errs, ok := err.(MultiError); ok {
+		for _, err := range errs {
+			if isStoreFailure(err) {
+				return true
+			}
+		}
+		return false
+	}
+	var serializationErr *utils.SerializationError
+	var numErr *strconv.NumError
+	return !errors.As(err, &serializationErr) && !errors.As(err, &numErr)
+}
+
+// ringHash places s on the ring. FNV-1a is mixed with the finalizer of
+// MurmurHash3, as it spreads similar strings poorly on its own.
+func ringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
@@ -0,0 +1,178 @@
+package persistence
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var newShardedStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+	return NewShardedStore([]ShardNode{
+		{Name: "a", Store: NewInMemoryStore(defaultExpiration)},
+		{Name: "b", Store: NewInMemoryStore(defaultExpiration)},
+		{Name: "c", Store: NewInMemoryStore(defaultExpiration)},
+	}, ShardedOptions{})
+}
+
+func shardNodes(names ...string) []ShardNode {
+	nodes := make([]ShardNode, len(names))
+	for i, name := range names {
+		nodes[i] = ShardNode{Name: name, Store: NewInMemoryStore(time.Hour)}
+	}
+	return nodes
+}
+
+func TestShardedCache_Distribution(t *testing.T) {
+	nodes := shardNodes("a", "b", "c", "d")
+	nodes[3].Weight = 2
+	cache := NewShardedStore(nodes, ShardedOptions{})
+
+	counts := make(map[string]int)
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		counts[cache.Node("key"+strconv.Itoa(i))]++
+	}
+	// a fifth of the keys for the first nodes, two for the heavier one
+	for name, expected := range map[string]int{"a": keys / 5, "b": keys / 5, "c": keys / 5, "d": 2 * keys / 5} {
+		if n := counts[name]; n < expected*3/4 || n > expected*5/4 {
+			t.Errorf("Expected about %d keys on %s, got %d", expected, name, n)
+		}
+	}
+}
+
+func TestShardedCache_AddNode(t *testing.T) {
+	before := NewShardedStore(shardNodes("a", "b", "c"), ShardedOptions{})
+	after := NewShardedStore(shardNodes("a", "b", "c", "d"), ShardedOptions{})
+
+	moved := 0
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		key := "key" + strconv.Itoa(i)
+		if node := after.Node(key); node != before.Node(key) {
+			if node != "d" {
+				t.Fatalf("Expected %s to move to the new node, it moved to %s", key, node)
+			}
+			moved++
+		}
+	}
+	if moved < keys/4*3/4 || moved > keys/4*5/4 {
+		t.Errorf("Expected about a quarter of the keys to move, %d did", moved)
+	}
+}
+
+var errShardDown = errors.New("node down")
+
+// downStore fails every operation while down is set
+type downStore struct {
+	CacheStore
+	down bool
+}
+
+func (s *downStore) Get(key string, value interface{}) error {
+	if s.down {
+		return errShardDown
+	}
+	return s.CacheStore.Get(key, value)
+}
+
+func (s *downStore) Set(key string, value interface{}, expires time.Duration) error {
+	if s.down {
+		return errShardDown
+	}
+	return s.CacheStore.Set(key, value, expires)
+}
+
+func TestShardedCache_Ejection(t *testing.T) {
+	nodes := shardNodes("a", "b")
+	failing := &downStore{CacheStore: nodes[0].Store}
+	nodes[0].Store = failing
+	cache := NewShardedStore(nodes, ShardedOptions{MaxFailures: 3, EjectionTime: 500 * time.Millisecond})
+
+	var key string
+	for i := 0; cache.Node(key) != "a"; i++ {
+		key = "key" + strconv.Itoa(i)
+	}
+	var value string
+	if err := cache.Get(key, &value); err != ErrCacheMiss {
+		t.Errorf("Expected a miss, got %v", err)
+	}
+	if ejected := cache.Ejected(); len(ejected) != 0 {
+		t.Errorf("Expected misses not to eject nodes, got %v", ejected)
+	}
+
+	failing.down = true
+	for i := 0; i < 3; i++ {
+		if err := cache.Set(key, "value", DEFAULT); err != errShardDown {
+			t.Errorf("Expected the error of the node, got %v", err)
+		}
+	}
+	if ejected := cache.Ejected(); len(ejected) != 1 || ejected[0] != "a" {
+		t.Fatalf("Expected a to be ejected, got %v", ejected)
+	}
+	if node := cache.Node(key); node != "b" {
+		t.Errorf("Expected the key to move to b, got %s", node)
+	}
+	if err := cache.Set(key, "value", DEFAULT); err != nil {
+		t.Errorf("Expected the key to be stored on b, got %v", err)
+	}
+
+	failing.down = false
+	time.Sleep(600 * time.Millisecond)
+	if node := cache.Node(key); node != "a" {
+		t.Errorf("Expected the key to come back to a, got %s", node)
+	}
+}
+
+func TestShardedCache_FlushOnRejoin(t *testing.T) {
+	nodes := shardNodes("a", "b")
+	failing := &downStore{CacheStore: nodes[0].Store}
+	nodes[0].Store = failing
+	cache := NewShardedStore(nodes, ShardedOptions{MaxFailures: 1, EjectionTime: 100 * time.Millisecond})
+
+	var key string
+	for i := 0; cache.Node(key) != "a"; i++ {
+		key = "key" + strconv.Itoa(i)
+	}
+	cache.Set(key, "old", DEFAULT)
+
+	// a is ejected while the key changes on b
+	failing.down = true
+	var value string
+	cache.Get(key, &value)
+	failing.down = false
+	if err := cache.Set(key, "new", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if err := cache.Get(key, &value); err != ErrCacheMiss {
+		t.Errorf("Expected a to come back empty, got %q, %v", value, err)
+	}
+	if node := cache.Node(key); node != "a" {
+		t.Errorf("Expected the key to come back to a, got %s", node)
+	}
+}
+
+func TestShardedCache_DecodeErrorsDontEject(t *testing.T) {
+	nodes := shardNodes("a", "b")
+	nodes[0].Store = NewBoundedStore(BoundedOptions{}, time.Hour)
+	cache := NewShardedStore(nodes, ShardedOptions{MaxFailures: 1})
+
+	var key string
+	for i := 0; cache.Node(key) != "a"; i++ {
+		key = "key" + strconv.Itoa(i)
+	}
+	cache.Set(key, "value", DEFAULT)
+	// the caller asks for the wrong type, or increments a string
+	var value int
+	if err := cache.Get(key, &value); err == nil {
+		t.Errorf("Expected decoding a string into an int to fail")
+	}
+	if _, err := cache.Increment(key, 1); err == nil {
+		t.Errorf("Expected incrementing a string to fail")
+	}
+	if ejected := cache.Ejected(); len(ejected) != 0 {
+		t.Errorf("Expected the errors of the caller not to eject nodes, got %v", ejected)
+	}
+}
@@ -0,0 +1,454 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/utils"
+)
+
+// SQLDialect adapts the queries of a SQLStore to a database. Only SQLite is
+// tested against a database, Postgres and MySQL are experimental.
+type SQLDialect int
+
+const (
+	// Postgres is the dialect of PostgreSQL 9.5 and later. Experimental.
+	Postgres SQLDialect = iota
+	// MySQL is the dialect of MySQL 5.7 and MariaDB 10.2 and later.
+	// Experimental.
+	MySQL
+	// SQLite is the dialect of SQLite 3.35 and later
+	SQLite
+)
+
+var sqlTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+// SQLOptions configures a SQLStore
+type SQLOptions struct {
+	// Table holds the items, "cache" by default. It is created if it doesn't
+	// exist.
+	Table string
+
+	// SweepInterval is how often the expired rows are deleted, a minute by
+	// default. A negative interval disables the sweeper.
+	SweepInterval time.Duration
+}
+
+// SQLStore represents the cache with database/sql persistence. Items are rows
+// of a table with a key, a serialized value and the time they expire at, in
+// milliseconds since the epoch or 0 for items that never expire. Keys are
+// bytes rather than text on PostgreSQL, as the keys of long URLs aren't valid
+// UTF-8.
+type SQLStore struct {
+	db                *sql.DB
+	dialect           SQLDialect
+	table             string
+	defaultExpiration time.Duration
+
+	stopSweeper chan struct{}
+	closeOnce   sync.Once
+}
+
+// NewSQLStore returns a SQLStore keeping its items in db, which uses dialect
+func NewSQLStore(db *sql.DB, dialect SQLDialect, options SQLOptions, defaultExpiration time.Duration) (*SQLStore, error) {
+	table := options.Table
+	if table == "" {
+		table = "cache"
+	}
+	if !sqlTableName.MatchString(table) {
+		return nil, fmt.Errorf("cache: invalid table name %q", table)
+	}
+	c := &SQLStore{
+		db:                db,
+		dialect:           dialect,
+		table:             table,
+		defaultExpiration: defaultExpiration,
+		stopSweeper:       make(chan struct{}),
+	}
+	if _, err := db.Exec(c.query(c.dialect.createTable())); err != nil {
+		return nil, err
+	}
+
+	interval := options.SweepInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	if interval > 0 {
+		go c.sweep(interval)
+	}
+	return c, nil
+}
+
+// Close stops the sweeper. It doesn't close the database.
+func (c *SQLStore) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.stopSweeper)
+	})
+	return nil
+}
+
+func (c *SQLStore) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.DeleteExpired(); err != nil {
+				log.Println(err.Error())
+			}
+		case <-c.stopSweeper:
+			return
+		}
+	}
+}
+
+// DeleteExpired deletes the rows of the expired items, and returns how many
+// there were
+func (c *SQLStore) DeleteExpired() (int64, error) {
+	result, err := c.db.Exec(c.query("DELETE FROM {table} WHERE expires_at <> 0 AND expires_at <= ?"), sqlNow())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Get (see CacheStore interface)
+func (c *SQLStore) Get(key string, value interface{}) error {
+	var item []byte
+	err := c.db.QueryRow(c.query("SELECT value FROM {table} WHERE cache_key = ? AND {live}"), c.key(key), sqlNow()).Scan(&item)
+	if err == sql.ErrNoRows {
+		return ErrCacheMiss
+	}
+	if err != nil {
+		return err
+	}
+	return utils.Deserialize(item, value)
+}
+
+// Set (see CacheStore interface)
+func (c *SQLStore) Set(key string, value interface{}, expires time.Duration) error {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(c.query(c.dialect.upsert()), c.key(key), b, c.expiration(expires))
+	return err
+}
+
+// Add (see CacheStore interface)
+func (c *SQLStore) Add(key string, value interface{}, expires time.Duration) error {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	// an expired row would make the insert fail
+	_, err = c.db.Exec(c.query("DELETE FROM {table} WHERE cache_key = ? AND expires_at <> 0 AND expires_at <= ?"), c.key(key), sqlNow())
+	if err != nil {
+		return err
+	}
+	result, err := c.db.Exec(c.query(c.dialect.insertIfAbsent()), c.key(key), b, c.expiration(expires))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return orError(err, ErrNotStored)
+	}
+	return nil
+}
+
+// Replace (see CacheStore interface)
+func (c *SQLStore) Replace(key string, value interface{}, expires time.Duration) error {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	result, err := c.db.Exec(c.query("UPDATE {table} SET value = ?, expires_at = ? WHERE cache_key = ? AND {live}"),
+		b, c.expiration(expires), c.key(key), sqlNow())
+	return c.updated(result, err, key, ErrNotStored)
+}
+
+// Delete (see CacheStore interface)
+func (c *SQLStore) Delete(key string) error {
+	result, err := c.db.Exec(c.query("DELETE FROM {table} WHERE cache_key = ? AND {live}"), c.key(key), sqlNow())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return orError(err, ErrCacheMiss)
+	}
+	return nil
+}
+
+// Increment (see CacheStore interface)
+func (c *SQLStore) Increment(key string, delta uint64) (uint64, error) {
+	// the delta is sent as a signed number, so that values wrap around like
+	// uint64 as long as they fit in the signed 64 bit integers of SQL
+	return c.count(key, c.dialect.counter("{integer} + ?"), int64(delta))
+}
+
+// Decrement (see CacheStore interface)
+func (c *SQLStore) Decrement(key string, delta uint64) (uint64, error) {
+	if delta > math.MaxInt64 {
+		delta = math.MaxInt64
+	}
+	return c.count(key, c.dialect.counter("CASE WHEN {integer} <= ? THEN 0 ELSE {integer} - ? END"), delta, delta)
+}
+
+// Flush (see CacheStore interface)
+func (c *SQLStore) Flush() error {
+	_, err := c.db.Exec(c.query("DELETE FROM {table}"))
+	return err
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *SQLStore) TTL(key string) (time.Duration, error) {
+	var expiresAt int64
+	err := c.db.QueryRow(c.query("SELECT expires_at FROM {table} WHERE cache_key = ? AND {live}"), c.key(key), sqlNow()).Scan(&expiresAt)
+	switch {
+	case err == sql.ErrNoRows:
+		return 0, ErrCacheMiss
+	case err != nil:
+		return 0, err
+	case expiresAt == 0:
+		return FOREVER, nil
+	}
+	return time.Duration(expiresAt-sqlNow()) * time.Millisecond, nil
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *SQLStore) Touch(key string, expires time.Duration) error {
+	result, err := c.db.Exec(c.query("UPDATE {table} SET expires_at = ? WHERE cache_key = ? AND {live}"),
+		c.expiration(expires), c.key(key), sqlNow())
+	return c.updated(result, err, key, ErrCacheMiss)
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (c *SQLStore) GetMulti(values map[string]interface{}) error {
+	if len(values) == 0 {
+		return nil
+	}
+	args := make([]interface{}, 0, len(values)+1)
+	for key := range values {
+		args = append(args, c.key(key))
+	}
+	placeholders := strings.Repeat(", ?", len(values))[2:]
+	rows, err := c.db.Query(c.query("SELECT cache_key, value FROM {table} WHERE cache_key IN ("+placeholders+") AND {live}"),
+		append(args, sqlNow())...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	errs := MultiError{}
+	for key := range values {
+		errs[key] = ErrCacheMiss
+	}
+	for rows.Next() {
+		var key string
+		var item []byte
+		if err := rows.Scan(&key, &item); err != nil {
+			return err
+		}
+		if value, found := values[key]; found {
+			delete(errs, key)
+			if err := utils.Deserialize(item, value); err != nil {
+				errs[key] = err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return errs.errOrNil()
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (c *SQLStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	return setEach(c, values, expires)
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (c *SQLStore) DeleteMulti(keys ...string) error {
+	return deleteEach(c, keys)
+}
+
+// count updates a counter with the SET expression update, whose placeholders
+// take args, and returns the new value. Only the values that are counters
+// are updated, so that the others aren't read as 0.
+func (c *SQLStore) count(key string, update string, args ...interface{}) (uint64, error) {
+	args = append(args, c.key(key), sqlNow())
+	query := c.query("UPDATE {table} SET value = " + update + " WHERE cache_key = ? AND {live} AND " + c.dialect.isCounter())
+
+	var item []byte
+	var err error
+	if c.dialect == MySQL {
+		// MySQL has no RETURNING, read the value before the row is unlocked
+		err = c.transaction(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(query, args...); err != nil {
+				return err
+			}
+			return tx.QueryRow(c.query("SELECT value FROM {table} WHERE cache_key = ? AND {live}"), c.key(key), sqlNow()).Scan(&item)
+		})
+	} else {
+		err = c.db.QueryRow(query+" RETURNING value", args...).Scan(&item)
+		if err == sql.ErrNoRows {
+			// the item is missing, or isn't a counter
+			err = c.db.QueryRow(c.query("SELECT value FROM {table} WHERE cache_key = ? AND {live}"), c.key(key), sqlNow()).Scan(&item)
+		}
+	}
+	if err == sql.ErrNoRows {
+		return 0, ErrCacheMiss
+	}
+	if err != nil {
+		return 0, err
+	}
+	// a value that isn't a counter was left alone, and fails to parse
+	n, err := strconv.ParseInt(string(item), 10, 64)
+	return uint64(n), err
+}
+
+func (c *SQLStore) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// updated checks the result of an UPDATE of key, returning miss if the item
+// wasn't found. MySQL doesn't count the rows left unchanged, so they are
+// looked for again.
+func (c *SQLStore) updated(result sql.Result, err error, key string, miss error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+	var found int
+	err = c.db.QueryRow(c.query("SELECT 1 FROM {table} WHERE cache_key = ? AND {live}"), c.key(key), sqlNow()).Scan(&found)
+	if err == sql.ErrNoRows {
+		return miss
+	}
+	return err
+}
+
+// query expands the {table} and {live} macros of q, and adapts its
+// placeholders to the dialect. {live} takes the current time as argument.
+func (c *SQLStore) query(q string) string {
+	q = strings.Replace(q, "{table}", c.table, -1)
+	q = strings.Replace(q, "{live}", "(expires_at = 0 OR expires_at > ?)", -1)
+	if c.dialect != Postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// key returns the argument of a query for key. PostgreSQL would reject the
+// keys that aren't valid UTF-8 as text.
+func (c *SQLStore) key(key string) interface{} {
+	if c.dialect == Postgres {
+		return []byte(key)
+	}
+	return key
+}
+
+// expiration resolves DEFAULT and FOREVER to the expires_at of an item
+func (c *SQLStore) expiration(expires time.Duration) int64 {
+	if expires == DEFAULT {
+		expires = c.defaultExpiration
+	}
+	if expires > 0 {
+		return sqlNow() + int64(expires/time.Millisecond)
+	}
+	return 0
+}
+
+// sqlNow returns the current time as an expires_at
+func sqlNow() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func orError(err error, otherwise error) error {
+	if err != nil {
+		return err
+	}
+	return otherwise
+}
+
+func (d SQLDialect) createTable() string {
+	switch d {
+	case MySQL:
+		return "CREATE TABLE IF NOT EXISTS {table} (cache_key VARBINARY(255) PRIMARY KEY, value LONGBLOB NOT NULL, expires_at BIGINT NOT NULL)"
+	case SQLite:
+		return "CREATE TABLE IF NOT EXISTS {table} (cache_key TEXT PRIMARY KEY, value BLOB NOT NULL, expires_at INTEGER NOT NULL)"
+	}
+	return "CREATE TABLE IF NOT EXISTS {table} (cache_key BYTEA PRIMARY KEY, value BYTEA NOT NULL, expires_at BIGINT NOT NULL)"
+}
+
+func (d SQLDialect) upsert() string {
+	if d == MySQL {
+		return "INSERT INTO {table} (cache_key, value, expires_at) VALUES (?, ?, ?) " +
+			"ON DUPLICATE KEY UPDATE value = VALUES(value), expires_at = VALUES(expires_at)"
+	}
+	return "INSERT INTO {table} (cache_key, value, expires_at) VALUES (?, ?, ?) " +
+		"ON CONFLICT (cache_key) DO UPDATE SET value = excluded.value, expires_at = excluded.expires_at"
+}
+
+func (d SQLDialect) insertIfAbsent() string {
+	if d == MySQL {
+		return "INSERT IGNORE INTO {table} (cache_key, value, expires_at) VALUES (?, ?, ?)"
+	}
+	return "INSERT INTO {table} (cache_key, value, expires_at) VALUES (?, ?, ?) ON CONFLICT (cache_key) DO NOTHING"
+}
+
+// counter returns the SQL expression storing the result of expression, where
+// {integer} is the current value of the counter
+func (d SQLDialect) counter(expression string) string {
+	// counters are stored as decimal text, like utils.Serialize does
+	integer, store := "convert_from(value, 'UTF8')::bigint", "convert_to((%s)::text, 'UTF8')"
+	switch d {
+	case MySQL:
+		integer, store = "CAST(CAST(value AS CHAR) AS SIGNED)", "CAST(%s AS CHAR)"
+	case SQLite:
+		integer, store = "CAST(CAST(value AS TEXT) AS INTEGER)", "CAST(CAST(%s AS TEXT) AS BLOB)"
+	}
+	return fmt.Sprintf(store, strings.Replace(expression, "{integer}", integer, -1))
+}
+
+// isCounter returns the SQL condition of the values that are counters: up to
+// 19 digits, not beyond the largest signed 64 bit integer, which the casts of
+// counter would otherwise turn into 0 or saturate
+func (d SQLDialect) isCounter() string {
+	text, digits := "encode(value, 'escape')", "{text} ~ '^[0-9]{1,19}$'"
+	switch d {
+	case MySQL:
+		text, digits = "CAST(value AS CHAR)", "{text} REGEXP '^[0-9]{1,19}$'"
+	case SQLite:
+		text, digits = "CAST(value AS TEXT)", "{text} GLOB '[0-9]*' AND NOT {text} GLOB '*[^0-9]*' AND length({text}) <= 19"
+	}
+	condition := "(" + digits + " AND (length({text}) < 19 OR {text} <= '9223372036854775807'))"
+	return strings.Replace(condition, "{text}", text, -1)
+}
@@ -0,0 +1,119 @@
+package persistence
+
+import (
+	"database/sql"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func openSQLite(t *testing.T) *sql.DB {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		t.Fatalf("Error opening the database: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+var newSQLStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
+	store, err := NewSQLStore(openSQLite(t), SQLite, SQLOptions{}, defaultExpiration)
+	if err != nil {
+		t.Fatalf("Error creating the SQL store: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestSQLCache_DeleteExpired(t *testing.T) {
+	db := openSQLite(t)
+	cache, err := NewSQLStore(db, SQLite, SQLOptions{Table: "pages", SweepInterval: -1}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating the SQL store: %s", err)
+	}
+	cache.Set("kept", "value", DEFAULT)
+	cache.Set("expired", "value", time.Second)
+	time.Sleep(1100 * time.Millisecond)
+
+	if n, err := cache.DeleteExpired(); err != nil || n != 1 {
+		t.Errorf("Expected to delete 1 expired row, got %d, %v", n, err)
+	}
+	var rows int
+	if err := db.QueryRow("SELECT COUNT(*) FROM pages").Scan(&rows); err != nil || rows != 1 {
+		t.Errorf("Expected 1 row left, got %d, %v", rows, err)
+	}
+}
+
+func TestSQLCache_AddOverExpiredRow(t *testing.T) {
+	cache, err := NewSQLStore(openSQLite(t), SQLite, SQLOptions{SweepInterval: -1}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating the SQL store: %s", err)
+	}
+	cache.Set("key", "old", time.Second)
+	time.Sleep(1100 * time.Millisecond)
+	if err := cache.Add("key", "new", DEFAULT); err != nil {
+		t.Errorf("Expected Add to replace the expired row, got %v", err)
+	}
+	var value string
+	if err := cache.Get("key", &value); err != nil || value != "new" {
+		t.Errorf("Expected %q, got %q, %v", "new", value, err)
+	}
+}
+
+func TestSQLCache_Queries(t *testing.T) {
+	cache := &SQLStore{dialect: Postgres, table: "cache"}
+	query := cache.query("UPDATE {table} SET value = ? WHERE cache_key = ? AND {live}")
+	expected := "UPDATE cache SET value = $1 WHERE cache_key = $2 AND (expires_at = 0 OR expires_at > $3)"
+	if query != expected {
+		t.Errorf("Expected %q, got %q", expected, query)
+	}
+	// the keys of long URLs are sha1 sums, which aren't valid UTF-8
+	key := "prefix:\xd4\x1d\x8c\xd9\x8f"
+	if arg, ok := cache.key(key).([]byte); !ok || string(arg) != key {
+		t.Errorf("Expected the key to be passed as bytes, got %#v", cache.key(key))
+	}
+
+	if _, err := NewSQLStore(nil, SQLite, SQLOptions{Table: "cache; DROP TABLE users"}, time.Hour); err == nil {
+		t.Error("Expected an invalid table name to be rejected")
+	}
+}
+
+func TestSQLCache_IncrementNotCounter(t *testing.T) {
+	cache, err := NewSQLStore(openSQLite(t), SQLite, SQLOptions{SweepInterval: -1}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating the SQL store: %s", err)
+	}
+	for key, value := range map[string]interface{}{
+		"string":   "value",
+		"digits":   "12ab",
+		"overflow": uint64(math.MaxInt64) + 1,
+	} {
+		cache.Set(key, value, DEFAULT)
+		if _, err := cache.Increment(key, 1); err == nil {
+			t.Errorf("Expected an error incrementing %s", key)
+		}
+		if _, err := cache.Decrement(key, 1); err == nil {
+			t.Errorf("Expected an error decrementing %s", key)
+		}
+	}
+	var value string
+	if err := cache.Get("string", &value); err != nil || value != "value" {
+		t.Errorf("Expected the value to be left alone, got %q, %v", value, err)
+	}
+	var overflow uint64
+	if err := cache.Get("overflow", &overflow); err != nil || overflow != math.MaxInt64+1 {
+		t.Errorf("Expected the value to be left alone, got %d, %v", overflow, err)
+	}
+
+	cache.Set("counter", uint64(math.MaxInt64)-1, DEFAULT)
+	if n, err := cache.Increment("counter", 1); err != nil || n != math.MaxInt64 {
+		t.Errorf("Expected %d, got %d, %v", uint64(math.MaxInt64), n, err)
+	}
+	if _, err := cache.Increment("missing", 1); err != ErrCacheMiss {
+		t.Errorf("Expected a miss, got %v", err)
+	}
+}
@@ -0,0 +1,607 @@
+// Package storetest provides a conformance test suite for the
+// implementations of persistence.CacheStore, so that stores written outside
+// of this package can check they behave like the built-in ones.
+package storetest
+
+import (
+	"bytes"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+)
+
+// Factory returns an empty store with defaultExpiration. It can call t.Skip
+// when the store can't be tested, such as when its server is unreachable.
+type Factory func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore
+
+// RunConformance checks that the stores returned by newStore honour the
+// contract of persistence.CacheStore, running each check in a subtest with a
+// new store. The optional TTLCacheStore, BatchCacheStore and CASCacheStore
+// methods are checked through the package helpers, and the checks of Touch,
+// compare-and-swap and Flush are skipped for the stores that don't support
+// them. The suite takes a few seconds, as it waits for items to expire.
+func RunConformance(t *testing.T, newStore Factory) {
+	t.Run("Expiry", func(t *testing.T) {
+		runExpiry(t, newStore)
+	})
+	for _, test := range []struct {
+		name string
+		run  func(*testing.T, Factory)
+	}{
+		{"TypicalGetSet", typicalGetSet},
+		{"ValueTypes", valueTypes},
+		{"LargeValue", largeValue},
+		{"IncrDecr", incrDecr},
+		{"EmptyCache", emptyCache},
+		{"Flush", flush},
+		{"Batch", batchGetSetDelete},
+		{"Concurrency", concurrentIncrDecrAdd},
+		{"CompareAndSet", compareAndSet},
+		{"ConcurrentCompareAndSet", concurrentCompareAndSet},
+	} {
+		run := test.run
+		t.Run(test.name, func(t *testing.T) {
+			run(t, newStore)
+		})
+	}
+}
+
+// Test typical cache interactions
+func typicalGetSet(t *testing.T, newCache Factory) {
+	var err error
+	cache := newCache(t, time.Hour)
+
+	value := "foo"
+	if err = cache.Set("value", value, persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+
+	value = ""
+	err = cache.Get("value", &value)
+	if err != nil {
+		t.Errorf("Error getting a value: %s", err)
+	}
+	if value != "foo" {
+		t.Errorf("Expected to get foo back, got %s", value)
+	}
+}
+
+// Test the increment-decrement cases
+func incrDecr(t *testing.T, newCache Factory) {
+	var err error
+	cache := newCache(t, time.Hour)
+
+	// Normal increment / decrement operation.
+	if err = cache.Set("int", 10, persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting int: %s", err)
+	}
+	newValue, err := cache.Increment("int", 50)
+	if err != nil {
+		t.Errorf("Error incrementing int: %s", err)
+	}
+	if newValue != 60 {
+		t.Errorf("Expected 60, was %d", newValue)
+	}
+
+	if newValue, err = cache.Decrement("int", 50); err != nil {
+		t.Errorf("Error decrementing: %s", err)
+	}
+	if newValue != 10 {
+		t.Errorf("Expected 10, was %d", newValue)
+	}
+
+	// Increment wraparound
+	newValue, err = cache.Increment("int", math.MaxUint64-5)
+	if err != nil {
+		t.Errorf("Error wrapping around: %s", err)
+	}
+	if newValue != 4 {
+		t.Errorf("Expected wraparound 4, got %d", newValue)
+	}
+
+	// Decrement capped at 0
+	newValue, err = cache.Decrement("int", 25)
+	if err != nil {
+		t.Errorf("Error decrementing below 0: %s", err)
+	}
+	if newValue != 0 {
+		t.Errorf("Expected capped at 0, got %d", newValue)
+	}
+}
+
+// expiryCase stores items that expire, running the checks that don't wait,
+// and returns the checks to run once they expired, or nil
+type expiryCase func(t *testing.T, cache persistence.CacheStore) func(t *testing.T)
+
+// expiryWait is the wait for the items stored with an expiration of up to 2
+// seconds to expire. memcached rounds expirations down to the second.
+const expiryWait = 3 * time.Second
+
+// runExpiry runs the expiry cases side by side on stores of their own, so
+// that they share a single wait for their items to expire
+func runExpiry(t *testing.T, newCache Factory) {
+	cases := []struct {
+		name              string
+		defaultExpiration time.Duration
+		run               expiryCase
+	}{
+		{"Expiration", time.Second, expiration},
+		{"IncrDecrKeepsTTL", time.Hour, incrDecrKeepsTTL},
+		{"TTLTouch", time.Hour, ttlTouch},
+		{"Replace", time.Hour, testReplace},
+		{"Add", time.Hour, testAdd},
+	}
+	expired := make([]func(t *testing.T), len(cases))
+	for i, c := range cases {
+		// the stores outlive the subtests, until the checks below
+		cache := newCache(t, c.defaultExpiration)
+		t.Run(c.name, func(t *testing.T) {
+			expired[i] = c.run(t, cache)
+		})
+	}
+	time.Sleep(expiryWait)
+	for i, c := range cases {
+		if expired[i] != nil {
+			t.Run(c.name+"Expired", expired[i])
+		}
+	}
+}
+
+func expiration(t *testing.T, cache persistence.CacheStore) func(t *testing.T) {
+	// memcached does not support expiration times less than 1 second.
+	cache.Set("default", 10, persistence.DEFAULT)
+	cache.Set("short", 10, time.Second)
+	cache.Set("long", 10, time.Hour)
+	cache.Set("forever", 10, persistence.FOREVER)
+	return func(t *testing.T) {
+		var value int
+		for _, key := range []string{"default", "short"} {
+			if err := cache.Get(key, &value); err != persistence.ErrCacheMiss {
+				t.Errorf("Expected CacheMiss for %s, but got: %v", key, err)
+			}
+		}
+		for _, key := range []string{"long", "forever"} {
+			if err := cache.Get(key, &value); err != nil {
+				t.Errorf("Expected to get %s, but got: %s", key, err)
+			}
+		}
+	}
+}
+
+// Test that counter updates keep the expiration of the key
+func incrDecrKeepsTTL(t *testing.T, cache persistence.CacheStore) func(t *testing.T) {
+	var err error
+	if err = cache.Set("int", 10, 2*time.Second); err != nil {
+		t.Errorf("Error setting int: %s", err)
+	}
+	if _, err = cache.Increment("int", 5); err != nil {
+		t.Errorf("Error incrementing int: %s", err)
+	}
+	if _, err = cache.Decrement("int", 20); err != nil {
+		t.Errorf("Error decrementing int: %s", err)
+	}
+	var value int
+	if err = cache.Get("int", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+
+	return func(t *testing.T) {
+		if err := cache.Get("int", &value); err != persistence.ErrCacheMiss {
+			t.Errorf("Expected the counter to expire, but got: %v", err)
+		}
+		if _, err := cache.Increment("int", 1); err != persistence.ErrCacheMiss {
+			t.Errorf("Expected cache miss incrementing an expired counter, got: %v", err)
+		}
+	}
+}
+
+// Test reading and changing expirations without rewriting the items
+func ttlTouch(t *testing.T, cache persistence.CacheStore) func(t *testing.T) {
+	var err error
+	if err = persistence.Touch(cache, "notexist", time.Minute); err == persistence.ErrNotSupport {
+		t.Skip("touching isn't supported")
+	} else if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss touching non-existent key: %v", err)
+	}
+	if _, err = persistence.TTL(cache, "notexist"); err != persistence.ErrCacheMiss && err != persistence.ErrNotSupport {
+		t.Errorf("Expected ErrCacheMiss for non-existent key: %v", err)
+	}
+
+	if err = cache.Set("int", 1, time.Minute); err != nil {
+		t.Errorf("Error setting int: %s", err)
+	}
+	ttl, err := persistence.TTL(cache, "int")
+	supported := err != persistence.ErrNotSupport
+	if supported && (err != nil || ttl <= 0 || ttl > time.Minute) {
+		t.Errorf("Expected a TTL of at most a minute, got %s, %v", ttl, err)
+	}
+
+	if err = persistence.Touch(cache, "int", persistence.FOREVER); err != nil {
+		t.Errorf("Error touching int: %s", err)
+	}
+	if ttl, err = persistence.TTL(cache, "int"); supported && (err != nil || ttl != persistence.FOREVER) {
+		t.Errorf("Expected the item to never expire, got %s, %v", ttl, err)
+	}
+
+	// a short expiration is honoured without rewriting the value
+	if err = persistence.Touch(cache, "int", time.Second); err != nil {
+		t.Errorf("Error touching int: %s", err)
+	}
+	var i int
+	if err = cache.Get("int", &i); err != nil || i != 1 {
+		t.Errorf("Expected to get 1 back, got %d, %v", i, err)
+	}
+	return func(t *testing.T) {
+		if err := cache.Get("int", &i); err != persistence.ErrCacheMiss {
+			t.Errorf("Expected the touched item to expire, got: %v", err)
+		}
+	}
+}
+
+func emptyCache(t *testing.T, newCache Factory) {
+	var err error
+	cache := newCache(t, time.Hour)
+
+	err = cache.Get("notexist", 0)
+	if err == nil {
+		t.Errorf("Error expected for non-existent key")
+	}
+	if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
+	}
+
+	err = cache.Delete("notexist")
+	if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
+	}
+
+	_, err = cache.Increment("notexist", 1)
+	if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected cache miss incrementing non-existent key: %s", err)
+	}
+
+	_, err = cache.Decrement("notexist", 1)
+	if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected cache miss decrementing non-existent key: %s", err)
+	}
+}
+
+func testReplace(t *testing.T, cache persistence.CacheStore) func(t *testing.T) {
+	var err error
+	// Replace in an empty cache.
+	if err = cache.Replace("notexist", 1, persistence.FOREVER); err != persistence.ErrNotStored && err != persistence.ErrCacheMiss {
+		t.Errorf("Replace in empty cache: expected ErrNotStored or ErrCacheMiss, got: %s", err)
+	}
+
+	// Set a value of 1, and replace it with 2
+	if err = cache.Set("int", 1, time.Second); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	if err = cache.Replace("int", 2, time.Second); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	var i int
+	if err = cache.Get("int", &i); err != nil {
+		t.Errorf("Unexpected error getting a replaced item: %s", err)
+	}
+	if i != 2 {
+		t.Errorf("Expected 2, got %d", i)
+	}
+
+	// Once it expired, replace with 3 (unsuccessfully).
+	return func(t *testing.T) {
+		if err := cache.Replace("int", 3, time.Second); err != persistence.ErrNotStored && err != persistence.ErrCacheMiss {
+			t.Errorf("Expected ErrNotStored or ErrCacheMiss, got: %s", err)
+		}
+		if err := cache.Get("int", &i); err != persistence.ErrCacheMiss {
+			t.Errorf("Expected cache miss, got: %s", err)
+		}
+	}
+}
+
+func testAdd(t *testing.T, cache persistence.CacheStore) func(t *testing.T) {
+	var err error
+	// Add to an empty cache.
+	if err = cache.Add("int", 1, time.Second); err != nil {
+		t.Errorf("Unexpected error adding to empty cache: %s", err)
+	}
+
+	// Try to add again. (fail)
+	if err = cache.Add("int", 2, time.Second); err != persistence.ErrNotStored {
+		t.Errorf("Expected ErrNotStored adding dupe to cache: %s", err)
+	}
+
+	// Once it expired, add again.
+	return func(t *testing.T) {
+		if err := cache.Add("int", 3, time.Second); err != nil {
+			t.Errorf("Unexpected error adding to cache: %s", err)
+		}
+
+		// Get and verify the value.
+		var i int
+		if err := cache.Get("int", &i); err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+		if i != 3 {
+			t.Errorf("Expected 3, got: %d", i)
+		}
+	}
+}
+
+func batchGetSetDelete(t *testing.T, newCache Factory) {
+	var err error
+	cache := newCache(t, time.Hour)
+
+	if err = persistence.SetMulti(cache, map[string]interface{}{"a": 1, "b": "two"}, persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting multiple values: %s", err)
+	}
+
+	var a int
+	var b, c string
+	err = persistence.GetMulti(cache, map[string]interface{}{"a": &a, "b": &b, "c": &c})
+	errs, ok := err.(persistence.MultiError)
+	if !ok {
+		t.Fatalf("Expected a MultiError for the missing key, got: %v", err)
+	}
+	if len(errs) != 1 || errs["c"] != persistence.ErrCacheMiss {
+		t.Errorf("Expected only c to be reported as a cache miss, got: %s", errs)
+	}
+	if a != 1 || b != "two" {
+		t.Errorf("Expected 1 and two, got %d and %s", a, b)
+	}
+
+	err = persistence.DeleteMulti(cache, "a", "c")
+	errs, ok = err.(persistence.MultiError)
+	if !ok {
+		t.Fatalf("Expected a MultiError for the missing key, got: %v", err)
+	}
+	if len(errs) != 1 || errs["c"] != persistence.ErrCacheMiss {
+		t.Errorf("Expected only c to be reported as a cache miss, got: %s", errs)
+	}
+	if err = cache.Get("a", &a); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected a to be deleted, got: %v", err)
+	}
+	if err = persistence.GetMulti(cache, map[string]interface{}{"b": &b}); err != nil {
+		t.Errorf("Expected no error getting b, got: %s", err)
+	}
+}
+
+// Test that counters and conditional writes hold up under concurrent use
+func concurrentIncrDecrAdd(t *testing.T, newCache Factory) {
+	const workers, iterations = 20, 50
+	cache := newCache(t, time.Hour)
+
+	if err := cache.Set("counter", 0, persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting counter: %s", err)
+	}
+	var wg sync.WaitGroup
+	added := make(chan bool, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				if _, err := cache.Increment("counter", 2); err != nil {
+					t.Errorf("Error incrementing: %s", err)
+				}
+				if _, err := cache.Decrement("counter", 1); err != nil {
+					t.Errorf("Error decrementing: %s", err)
+				}
+			}
+			added <- cache.Add("once", w, persistence.DEFAULT) == nil
+		}(w)
+	}
+	wg.Wait()
+	close(added)
+
+	var counter int
+	if err := cache.Get("counter", &counter); err != nil {
+		t.Errorf("Error getting counter: %s", err)
+	}
+	if counter != workers*iterations {
+		t.Errorf("Expected %d, got %d", workers*iterations, counter)
+	}
+	successes := 0
+	for ok := range added {
+		if ok {
+			successes++
+		}
+	}
+	if successes != 1 {
+		t.Errorf("Expected exactly one Add to succeed, got %d", successes)
+	}
+}
+
+func compareAndSet(t *testing.T, newCache Factory) {
+	var err error
+	cache := newCache(t, time.Hour)
+
+	var value string
+	if _, err = persistence.GetWithVersion(cache, "cas", &value); err == persistence.ErrNotSupport {
+		t.Skip("compare-and-swap isn't supported")
+	} else if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected a cache miss, got: %v", err)
+	}
+	if err = cache.Set("cas", "v1", persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	version, err := persistence.GetWithVersion(cache, "cas", &value)
+	if err != nil || value != "v1" {
+		t.Fatalf("Expected v1, got %q, %v", value, err)
+	}
+	if err = persistence.CompareAndSet(cache, "cas", "v2", version, persistence.DEFAULT); err != nil {
+		t.Errorf("Error swapping an unchanged value: %s", err)
+	}
+	if err = persistence.CompareAndSet(cache, "cas", "v3", version, persistence.DEFAULT); err != persistence.ErrCASConflict {
+		t.Errorf("Expected a conflict swapping with a stale version, got: %v", err)
+	}
+	if err = cache.Get("cas", &value); err != nil || value != "v2" {
+		t.Errorf("Expected v2, got %q, %v", value, err)
+	}
+
+	// any write, not only persistence.CompareAndSet, makes older versions stale
+	if version, err = persistence.GetWithVersion(cache, "cas", &value); err != nil {
+		t.Fatalf("Error getting the version: %s", err)
+	}
+	if err = cache.Set("cas", "v4", persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err = persistence.CompareAndSet(cache, "cas", "v5", version, persistence.DEFAULT); err != persistence.ErrCASConflict {
+		t.Errorf("Expected a conflict after a Set, got: %v", err)
+	}
+
+	if version, err = persistence.GetWithVersion(cache, "cas", &value); err != nil {
+		t.Fatalf("Error getting the version: %s", err)
+	}
+	if err = cache.Delete("cas"); err != nil {
+		t.Fatalf("Error deleting the value: %s", err)
+	}
+	if err = persistence.CompareAndSet(cache, "cas", "v6", version, persistence.DEFAULT); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected a cache miss swapping a deleted value, got: %v", err)
+	}
+}
+
+// Test that read-modify-write cycles don't lose updates under concurrent use
+func concurrentCompareAndSet(t *testing.T, newCache Factory) {
+	const workers, iterations = 10, 20
+	cache := newCache(t, time.Hour)
+
+	if err := cache.Set("counter", 0, persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting counter: %s", err)
+	}
+	var initial int
+	if _, err := persistence.GetWithVersion(cache, "counter", &initial); err == persistence.ErrNotSupport {
+		t.Skip("compare-and-swap isn't supported")
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				for {
+					var counter int
+					version, err := persistence.GetWithVersion(cache, "counter", &counter)
+					if err != nil {
+						t.Errorf("Error getting counter: %s", err)
+						return
+					}
+					err = persistence.CompareAndSet(cache, "counter", counter+1, version, persistence.DEFAULT)
+					if err == nil {
+						break
+					}
+					if err != persistence.ErrCASConflict {
+						t.Errorf("Error swapping counter: %s", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var counter int
+	if err := cache.Get("counter", &counter); err != nil {
+		t.Errorf("Error getting counter: %s", err)
+	}
+	if counter != workers*iterations {
+		t.Errorf("Expected %d, got %d", workers*iterations, counter)
+	}
+}
+
+type valueTypesStruct struct {
+	Name  string
+	Tags  []string
+	Count int
+}
+
+// Test that the values come back with their type, whatever the encoding
+func valueTypes(t *testing.T, newCache Factory) {
+	cache := newCache(t, time.Hour)
+
+	values := map[string]struct{ set, get interface{} }{
+		"int":    {-42, new(int)},
+		"uint64": {uint64(math.MaxUint64), new(uint64)},
+		"string": {"foo", new(string)},
+		"bytes":  {[]byte{0, 1, 2, 255}, new([]byte)},
+		"struct": {valueTypesStruct{"foo", []string{"a", "b"}, 3}, new(valueTypesStruct)},
+		"map":    {map[string]int{"a": 1}, new(map[string]int)},
+	}
+	for key, value := range values {
+		if err := cache.Set(key, value.set, persistence.DEFAULT); err != nil {
+			t.Errorf("Error setting %s: %s", key, err)
+		}
+	}
+	for key, value := range values {
+		if err := cache.Get(key, value.get); err != nil {
+			t.Errorf("Error getting %s: %s", key, err)
+		}
+	}
+	if v := *values["int"].get.(*int); v != -42 {
+		t.Errorf("Expected -42, got %d", v)
+	}
+	if v := *values["uint64"].get.(*uint64); v != math.MaxUint64 {
+		t.Errorf("Expected %d, got %d", uint64(math.MaxUint64), v)
+	}
+	if v := *values["string"].get.(*string); v != "foo" {
+		t.Errorf("Expected foo, got %s", v)
+	}
+	if v := *values["bytes"].get.(*[]byte); !bytes.Equal(v, []byte{0, 1, 2, 255}) {
+		t.Errorf("Expected the bytes back, got %v", v)
+	}
+	if v := *values["struct"].get.(*valueTypesStruct); v.Name != "foo" || len(v.Tags) != 2 || v.Count != 3 {
+		t.Errorf("Expected the struct back, got %+v", v)
+	}
+	if v := *values["map"].get.(*map[string]int); v["a"] != 1 {
+		t.Errorf("Expected the map back, got %v", v)
+	}
+}
+
+// Test values as large as memcached accepts by default
+func largeValue(t *testing.T, newCache Factory) {
+	cache := newCache(t, time.Hour)
+
+	value := make([]byte, 512*1024)
+	for i := range value {
+		value[i] = byte(i * 7)
+	}
+	if err := cache.Set("large", value, persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting a large value: %s", err)
+	}
+	var got []byte
+	if err := cache.Get("large", &got); err != nil {
+		t.Fatalf("Error getting a large value: %s", err)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("Expected the large value back, got %d different bytes", len(got))
+	}
+}
+
+// Test that flushing removes every item
+func flush(t *testing.T, newCache Factory) {
+	cache := newCache(t, time.Hour)
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cache.Set(key, key, persistence.FOREVER); err != nil {
+			t.Errorf("Error setting %s: %s", key, err)
+		}
+	}
+	if err := cache.Flush(); err == persistence.ErrNotSupport {
+		t.Skip("flushing isn't supported")
+	} else if err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	var value string
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cache.Get(key, &value); err != persistence.ErrCacheMiss {
+			t.Errorf("Expected %s to be flushed, got: %v", key, err)
+		}
+	}
+	if err := cache.Add("a", "again", persistence.DEFAULT); err != nil {
+		t.Errorf("Expected to add a flushed key, got: %v", err)
+	}
+}
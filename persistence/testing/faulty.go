@@ -0,0 +1,305 @@
+// Package testing provides stores to test how the code using a cache copes
+// with a store misbehaving.
+package testing
+
+import (
+	"errors"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-contrib/cache/utils"
+)
+
+// corrupted is what a corrupted item holds
+var corrupted = []byte{0xde, 0xad, 0xbe, 0xef}
+
+// Fault describes how a FaultyStore misbehaves
+type Fault struct {
+	// Operations are the names of the methods affected, such as "Get" or
+	// "SetMulti". Empty means all of them.
+	Operations []string
+
+	// Keys is a pattern, in the syntax of path.Match, matching the keys
+	// affected. Empty means all of them. The batch operations apply the fault
+	// to each key, so that some keys fail and others don't.
+	Keys string
+
+	// Probability is the chance that the fault applies to a call, always if
+	// zero
+	Probability float64
+
+	// Latency is added to the calls
+	Latency time.Duration
+
+	// Err is returned instead of calling the store
+	Err error
+
+	// Miss makes the reads miss: Get, GetWithVersion, GetMulti and TTL return
+	// persistence.ErrCacheMiss
+	Miss bool
+
+	// Corrupt makes the reads decode a corrupted item: Get, GetWithVersion and
+	// GetMulti return the error of the decoding, or garbage into []byte values
+	Corrupt bool
+}
+
+// FaultyStore wraps a store, injecting the faults it is given. It is safe for
+// concurrent use.
+type FaultyStore struct {
+	store persistence.CacheStore
+
+	mu     sync.Mutex
+	faults []Fault
+	rand   *rand.Rand
+}
+
+// NewFaultyStore returns a FaultyStore in front of store, without faults
+func NewFaultyStore(store persistence.CacheStore) *FaultyStore {
+	return &FaultyStore{store: store, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Inject adds fault to the store
+func (s *FaultyStore) Inject(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault)
+}
+
+// Reset removes the faults
+func (s *FaultyStore) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Seed makes the probabilities of the faults reproducible
+func (s *FaultyStore) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rand = rand.New(rand.NewSource(seed))
+}
+
+// Get (see CacheStore interface)
+func (s *FaultyStore) Get(key string, value interface{}) error {
+	if err := s.read("Get", key, value); err != errPass {
+		return err
+	}
+	return s.store.Get(key, value)
+}
+
+// Set (see CacheStore interface)
+func (s *FaultyStore) Set(key string, value interface{}, expires time.Duration) error {
+	if err := s.write("Set", key); err != nil {
+		return err
+	}
+	return s.store.Set(key, value, expires)
+}
+
+// Add (see CacheStore interface)
+func (s *FaultyStore) Add(key string, value interface{}, expires time.Duration) error {
+	if err := s.write("Add", key); err != nil {
+		return err
+	}
+	return s.store.Add(key, value, expires)
+}
+
+// Replace (see CacheStore interface)
+func (s *FaultyStore) Replace(key string, value interface{}, expires time.Duration) error {
+	if err := s.write("Replace", key); err != nil {
+		return err
+	}
+	return s.store.Replace(key, value, expires)
+}
+
+// Delete (see CacheStore interface)
+func (s *FaultyStore) Delete(key string) error {
+	if err := s.write("Delete", key); err != nil {
+		return err
+	}
+	return s.store.Delete(key)
+}
+
+// Increment (see CacheStore interface)
+func (s *FaultyStore) Increment(key string, delta uint64) (uint64, error) {
+	if err := s.write("Increment", key); err != nil {
+		return 0, err
+	}
+	return s.store.Increment(key, delta)
+}
+
+// Decrement (see CacheStore interface)
+func (s *FaultyStore) Decrement(key string, delta uint64) (uint64, error) {
+	if err := s.write("Decrement", key); err != nil {
+		return 0, err
+	}
+	return s.store.Decrement(key, delta)
+}
+
+// Flush (see CacheStore interface)
+func (s *FaultyStore) Flush() error {
+	if err := s.write("Flush", ""); err != nil {
+		return err
+	}
+	return s.store.Flush()
+}
+
+// TTL (see TTLCacheStore interface)
+func (s *FaultyStore) TTL(key string) (time.Duration, error) {
+	fault := s.fault("TTL", key)
+	if fault.Err != nil {
+		return 0, fault.Err
+	}
+	if fault.Miss {
+		return 0, persistence.ErrCacheMiss
+	}
+	return persistence.TTL(s.store, key)
+}
+
+// Touch (see TTLCacheStore interface)
+func (s *FaultyStore) Touch(key string, expires time.Duration) error {
+	if err := s.write("Touch", key); err != nil {
+		return err
+	}
+	return persistence.Touch(s.store, key, expires)
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (s *FaultyStore) GetWithVersion(key string, value interface{}) (persistence.Version, error) {
+	if err := s.read("GetWithVersion", key, value); err != errPass {
+		return persistence.Version{}, err
+	}
+	return persistence.GetWithVersion(s.store, key, value)
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (s *FaultyStore) CompareAndSet(key string, value interface{}, version persistence.Version, expires time.Duration) error {
+	if err := s.write("CompareAndSet", key); err != nil {
+		return err
+	}
+	return persistence.CompareAndSet(s.store, key, value, version, expires)
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (s *FaultyStore) GetMulti(values map[string]interface{}) error {
+	errs := persistence.MultiError{}
+	pass := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if err := s.read("GetMulti", key, value); err == errPass {
+			pass[key] = value
+		} else if err != nil {
+			errs[key] = err
+		}
+	}
+	return s.merge(errs, persistence.GetMulti(s.store, pass), pass)
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (s *FaultyStore) SetMulti(values map[string]interface{}, expires time.Duration) error {
+	errs := persistence.MultiError{}
+	pass := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if err := s.write("SetMulti", key); err != nil {
+			errs[key] = err
+		} else {
+			pass[key] = value
+		}
+	}
+	return s.merge(errs, persistence.SetMulti(s.store, pass, expires), pass)
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (s *FaultyStore) DeleteMulti(keys ...string) error {
+	errs := persistence.MultiError{}
+	pass := make(map[string]interface{}, len(keys))
+	var passKeys []string
+	for _, key := range keys {
+		if err := s.write("DeleteMulti", key); err != nil {
+			errs[key] = err
+		} else {
+			pass[key] = nil
+			passKeys = append(passKeys, key)
+		}
+	}
+	return s.merge(errs, persistence.DeleteMulti(s.store, passKeys...), pass)
+}
+
+// errPass tells that a read goes to the store
+var errPass = errors.New("cache: pass to the store.")
+
+// read applies the faults of a read of key into value. It returns errPass
+// when the store must be called.
+func (s *FaultyStore) read(operation string, key string, value interface{}) error {
+	fault := s.fault(operation, key)
+	switch {
+	case fault.Err != nil:
+		return fault.Err
+	case fault.Miss:
+		return persistence.ErrCacheMiss
+	case fault.Corrupt:
+		return utils.Deserialize(append([]byte(nil), corrupted...), value)
+	}
+	return errPass
+}
+
+// write applies the faults of a write of key, returning their error
+func (s *FaultyStore) write(operation string, key string) error {
+	return s.fault(operation, key).Err
+}
+
+// fault sleeps the latency of the faults applying to the operation on key,
+// and returns them combined
+func (s *FaultyStore) fault(operation string, key string) Fault {
+	var combined Fault
+	s.mu.Lock()
+	for _, fault := range s.faults {
+		if !fault.matches(operation, key) || fault.Probability > 0 && s.rand.Float64() >= fault.Probability {
+			continue
+		}
+		combined.Latency += fault.Latency
+		if combined.Err == nil {
+			combined.Err = fault.Err
+		}
+		combined.Miss = combined.Miss || fault.Miss
+		combined.Corrupt = combined.Corrupt || fault.Corrupt
+	}
+	s.mu.Unlock()
+	time.Sleep(combined.Latency)
+	return combined
+}
+
+// merge adds the errors of a batch operation on keys to errs
+func (s *FaultyStore) merge(errs persistence.MultiError, err error, keys map[string]interface{}) error {
+	if multi, ok := err.(persistence.MultiError); ok {
+		for key, err := range multi {
+			errs[key] = err
+		}
+	} else if err != nil {
+		for key := range keys {
+			errs[key] = err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (f *Fault) matches(operation string, key string) bool {
+	if f.Keys != "" {
+		if matched, _ := path.Match(f.Keys, key); !matched {
+			return false
+		}
+	}
+	if len(f.Operations) == 0 {
+		return true
+	}
+	for _, o := range f.Operations {
+		if o == operation {
+			return true
+		}
+	}
+	return false
+}
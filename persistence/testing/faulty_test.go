@@ -0,0 +1,122 @@
+package testing
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+)
+
+var errInjected = errors.New("injected")
+
+func TestFaultyStore_Faults(t *testing.T) {
+	store := NewFaultyStore(persistence.NewInMemoryStore(time.Hour))
+	store.Set("page:1", "one", persistence.DEFAULT)
+	store.Set("user:1", "alice", persistence.DEFAULT)
+
+	store.Inject(Fault{Operations: []string{"Get"}, Keys: "page:*", Err: errInjected})
+	var value string
+	if err := store.Get("page:1", &value); err != errInjected {
+		t.Errorf("Expected the injected error, got %v", err)
+	}
+	if err := store.Get("user:1", &value); err != nil || value != "alice" {
+		t.Errorf("Expected the other keys to be left alone, got %q, %v", value, err)
+	}
+	if err := store.Set("page:1", "two", persistence.DEFAULT); err != nil {
+		t.Errorf("Expected the other operations to be left alone, got %v", err)
+	}
+
+	store.Reset()
+	store.Inject(Fault{Keys: "user:*", Miss: true})
+	if err := store.Get("user:1", &value); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected a miss, got %v", err)
+	}
+
+	store.Reset()
+	store.Inject(Fault{Corrupt: true})
+	if err := store.Get("user:1", &value); err == nil {
+		t.Error("Expected an error decoding a corrupted item")
+	}
+
+	store.Reset()
+	store.Inject(Fault{Latency: 50 * time.Millisecond})
+	start := time.Now()
+	store.Get("user:1", &value)
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the latency to be added, took %s", elapsed)
+	}
+}
+
+func TestFaultyStore_PartialFailures(t *testing.T) {
+	store := NewFaultyStore(persistence.NewInMemoryStore(time.Hour))
+	store.Inject(Fault{Operations: []string{"SetMulti"}, Keys: "b", Err: errInjected})
+
+	err := persistence.SetMulti(store, map[string]interface{}{"a": 1, "b": 2}, persistence.DEFAULT)
+	errs, ok := err.(persistence.MultiError)
+	if !ok || len(errs) != 1 || errs["b"] != errInjected {
+		t.Fatalf("Expected b to fail, got %v", err)
+	}
+	var a int
+	if err := store.Get("a", &a); err != nil || a != 1 {
+		t.Errorf("Expected a to be set, got %d, %v", a, err)
+	}
+}
+
+func TestFaultyStore_Probability(t *testing.T) {
+	store := NewFaultyStore(persistence.NewInMemoryStore(time.Hour))
+	store.Seed(1)
+	store.Inject(Fault{Probability: 0.25, Err: errInjected})
+
+	failures := 0
+	for i := 0; i < 1000; i++ {
+		if store.Set("key", i, persistence.DEFAULT) != nil {
+			failures++
+		}
+	}
+	if failures < 200 || failures > 300 {
+		t.Errorf("Expected about 250 failures, got %d", failures)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	faulty := NewFaultyStore(persistence.NewInMemoryStore(time.Hour))
+	faulty.Inject(Fault{Operations: []string{"Delete"}, Err: errInjected})
+	recorder := NewRecorder(faulty)
+
+	recorder.Set("a", 1, persistence.DEFAULT)
+	recorder.Get("b", new(int))
+	recorder.Delete("a")
+	persistence.GetMulti(recorder, map[string]interface{}{"b": new(int), "a": new(int)})
+
+	calls := recorder.Calls()
+	expected := []struct {
+		operation string
+		keys      []string
+		err       error
+	}{
+		{"Set", []string{"a"}, nil},
+		{"Get", []string{"b"}, persistence.ErrCacheMiss},
+		{"Delete", []string{"a"}, errInjected},
+		{"GetMulti", []string{"a", "b"}, persistence.MultiError{"b": persistence.ErrCacheMiss}},
+	}
+	if len(calls) != len(expected) {
+		t.Fatalf("Expected %d calls, got %+v", len(expected), calls)
+	}
+	for i, e := range expected {
+		call := calls[i]
+		if call.Operation != e.operation || len(call.Keys) != len(e.keys) || call.Keys[0] != e.keys[0] {
+			t.Errorf("Expected a call to %s %v, got %+v", e.operation, e.keys, call)
+		}
+		if (call.Err == nil) != (e.err == nil) || call.Err != nil && call.Err.Error() != e.err.Error() {
+			t.Errorf("Expected %s to return %v, got %v", e.operation, e.err, call.Err)
+		}
+	}
+	if n := recorder.Count("Get"); n != 1 {
+		t.Errorf("Expected 1 call to Get, got %d", n)
+	}
+	recorder.Reset()
+	if calls := recorder.Calls(); len(calls) != 0 {
+		t.Errorf("Expected no calls after a reset, got %+v", calls)
+	}
+}
@@ -0,0 +1,176 @@
+package testing
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+)
+
+// Call is an operation recorded by a Recorder
+type Call struct {
+	// Operation is the name of the method called, such as "Get"
+	Operation string
+	// Keys holds the key of the operation, the keys of a batch operation in
+	// order, or nothing for Flush
+	Keys []string
+	// Err is the error returned
+	Err error
+	// Start is when the call started, and Duration how long it took
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Recorder wraps a store, recording every call made to it. It is safe for
+// concurrent use.
+type Recorder struct {
+	store persistence.CacheStore
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+// NewRecorder returns a Recorder in front of store
+func NewRecorder(store persistence.CacheStore) *Recorder {
+	return &Recorder{store: store}
+}
+
+// Calls returns the calls recorded, in the order they completed
+func (r *Recorder) Calls() []Call {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Call(nil), r.calls...)
+}
+
+// Count returns the number of calls to operation
+func (r *Recorder) Count(operation string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, call := range r.calls {
+		if call.Operation == operation {
+			n++
+		}
+	}
+	return n
+}
+
+// Reset forgets the calls recorded
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = nil
+}
+
+// Get (see CacheStore interface)
+func (r *Recorder) Get(key string, value interface{}) (err error) {
+	defer r.done("Get", time.Now(), &err, key)
+	return r.store.Get(key, value)
+}
+
+// Set (see CacheStore interface)
+func (r *Recorder) Set(key string, value interface{}, expires time.Duration) (err error) {
+	defer r.done("Set", time.Now(), &err, key)
+	return r.store.Set(key, value, expires)
+}
+
+// Add (see CacheStore interface)
+func (r *Recorder) Add(key string, value interface{}, expires time.Duration) (err error) {
+	defer r.done("Add", time.Now(), &err, key)
+	return r.store.Add(key, value, expires)
+}
+
+// Replace (see CacheStore interface)
+func (r *Recorder) Replace(key string, value interface{}, expires time.Duration) (err error) {
+	defer r.done("Replace", time.Now(), &err, key)
+	return r.store.Replace(key, value, expires)
+}
+
+// Delete (see CacheStore interface)
+func (r *Recorder) Delete(key string) (err error) {
+	defer r.done("Delete", time.Now(), &err, key)
+	return r.store.Delete(key)
+}
+
+// Increment (see CacheStore interface)
+func (r *Recorder) Increment(key string, delta uint64) (_ uint64, err error) {
+	defer r.done("Increment", time.Now(), &err, key)
+	return r.store.Increment(key, delta)
+}
+
+// Decrement (see CacheStore interface)
+func (r *Recorder) Decrement(key string, delta uint64) (_ uint64, err error) {
+	defer r.done("Decrement", time.Now(), &err, key)
+	return r.store.Decrement(key, delta)
+}
+
+// Flush (see CacheStore interface)
+func (r *Recorder) Flush() (err error) {
+	defer r.done("Flush", time.Now(), &err)
+	return r.store.Flush()
+}
+
+// TTL (see TTLCacheStore interface)
+func (r *Recorder) TTL(key string) (_ time.Duration, err error) {
+	defer r.done("TTL", time.Now(), &err, key)
+	return persistence.TTL(r.store, key)
+}
+
+// Touch (see TTLCacheStore interface)
+func (r *Recorder) Touch(key string, expires time.Duration) (err error) {
+	defer r.done("Touch", time.Now(), &err, key)
+	return persistence.Touch(r.store, key, expires)
+}
+
+// GetWithVersion (see CASCacheStore interface)
+func (r *Recorder) GetWithVersion(key string, value interface{}) (_ persistence.Version, err error) {
+	defer r.done("GetWithVersion", time.Now(), &err, key)
+	return persistence.GetWithVersion(r.store, key, value)
+}
+
+// CompareAndSet (see CASCacheStore interface)
+func (r *Recorder) CompareAndSet(key string, value interface{}, version persistence.Version, expires time.Duration) (err error) {
+	defer r.done("CompareAndSet", time.Now(), &err, key)
+	return persistence.CompareAndSet(r.store, key, value, version, expires)
+}
+
+// GetMulti (see BatchCacheStore interface)
+func (r *Recorder) GetMulti(values map[string]interface{}) (err error) {
+	defer r.done("GetMulti", time.Now(), &err, sortedKeys(values)...)
+	return persistence.GetMulti(r.store, values)
+}
+
+// SetMulti (see BatchCacheStore interface)
+func (r *Recorder) SetMulti(values map[string]interface{}, expires time.Duration) (err error) {
+	defer r.done("SetMulti", time.Now(), &err, sortedKeys(values)...)
+	return persistence.SetMulti(r.store, values, expires)
+}
+
+// DeleteMulti (see BatchCacheStore interface)
+func (r *Recorder) DeleteMulti(keys ...string) (err error) {
+	defer r.done("DeleteMulti", time.Now(), &err, keys...)
+	return persistence.DeleteMulti(r.store, keys...)
+}
+
+// done records a call that returned *err
+func (r *Recorder) done(operation string, start time.Time, err *error, keys ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, Call{
+		Operation: operation,
+		Keys:      append([]string(nil), keys...),
+		Err:       *err,
+		Start:     start,
+		Duration:  time.Since(start),
+	})
+}
+
+func sortedKeys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
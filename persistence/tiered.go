@@ -0,0 +1,164 @@
+package persistence
+
+import (
+	"reflect"
+	"time"
+)
+
+// TieredStore represents the cache with two tiers: a small local store, such
+// as a BoundedStore, in front of a remote store shared by all the instances.
+// Reads try the local tier first, and copy remote hits to it for a shorter
+// time. Writes and deletes go to both tiers.
+type TieredStore struct {
+	local           CacheStore
+	remote          CacheStore
+	localExpiration time.Duration
+	invalidator     Invalidator
+}
+
+// Invalidator tells the other instances sharing the remote tier of a
+// TieredStore which keys changed, so that they drop them from their local tier.
+type Invalidator interface {
+	// Invalidate announces that key changed. An empty key announces that the
+	// whole cache was flushed.
+	Invalidate(key string) error
+
+	// Listen calls invalidate with the keys announced by the other instances.
+	// It is called once, by NewTieredStoreWithInvalidator.
+	Listen(invalidate func(key string))
+}
+
+// NewTieredStore returns a TieredStore. Items stay in the local tier for at
+// most localExpiration, which bounds how stale they can get when another
+// instance changes them.
+func NewTieredStore(local, remote CacheStore, localExpiration time.Duration) *TieredStore {
+	return &TieredStore{local: local, remote: remote, localExpiration: localExpiration}
+}
+
+// NewTieredStoreWithInvalidator returns a TieredStore announcing its writes
+// through invalidator, and dropping the keys the other instances announce
+// from its local tier.
+func NewTieredStoreWithInvalidator(local, remote CacheStore, localExpiration time.Duration, invalidator Invalidator) *TieredStore {
+	c := &TieredStore{local, remote, localExpiration, invalidator}
+	invalidator.Listen(func(key string) {
+		if key == "" {
+			local.Flush()
+		} else {
+			local.Delete(key)
+		}
+	})
+	return c
+}
+
+// Get (see CacheStore interface)
+func (c *TieredStore) Get(key string, value interface{}) error {
+	if err := c.local.Get(key, value); err == nil {
+		return nil
+	}
+	if err := c.remote.Get(key, value); err != nil {
+		return err
+	}
+	if v := reflect.ValueOf(value); v.Kind() == reflect.Ptr && !v.IsNil() {
+		c.local.Set(key, v.Elem().Interface(), c.localTTL(DEFAULT))
+	}
+	return nil
+}
+
+// Set (see CacheStore interface)
+func (c *TieredStore) Set(key string, value interface{}, expires time.Duration) error {
+	if err := c.remote.Set(key, value, expires); err != nil {
+		c.invalidate(key)
+		return err
+	}
+	c.local.Set(key, value, c.localTTL(expires))
+	c.announce(key)
+	return nil
+}
+
+// Add (see CacheStore interface)
+func (c *TieredStore) Add(key string, value interface{}, expires time.Duration) error {
+	if err := c.remote.Add(key, value, expires); err != nil {
+		return err
+	}
+	c.local.Set(key, value, c.localTTL(expires))
+	c.announce(key)
+	return nil
+}
+
+// Replace (see CacheStore interface)
+func (c *TieredStore) Replace(key string, value interface{}, expires time.Duration) error {
+	if err := c.remote.Replace(key, value, expires); err != nil {
+		c.invalidate(key)
+		return err
+	}
+	c.local.Set(key, value, c.localTTL(expires))
+	c.announce(key)
+	return nil
+}
+
+// Delete (see CacheStore interface)
+func (c *TieredStore) Delete(key string) error {
+	// the remote tier goes first, so that a Get in between doesn't copy the
+	// item back to a local tier
+	err := c.remote.Delete(key)
+	c.invalidate(key)
+	return err
+}
+
+// Increment (see CacheStore interface)
+func (c *TieredStore) Increment(key string, delta uint64) (uint64, error) {
+	// counters change too often to be worth a local copy
+	defer c.invalidate(key)
+	return c.remote.Increment(key, delta)
+}
+
+// Decrement (see CacheStore interface)
+func (c *TieredStore) Decrement(key string, delta uint64) (uint64, error) {
+	defer c.invalidate(key)
+	return c.remote.Decrement(key, delta)
+}
+
+// TTL (see TTLCacheStore interface)
+func (c *TieredStore) TTL(key string) (time.Duration, error) {
+	return TTL(c.remote, key)
+}
+
+// Touch (see TTLCacheStore interface)
+func (c *TieredStore) Touch(key string, expires time.Duration) error {
+	if err := Touch(c.remote, key, expires); err != nil {
+		return err
+	}
+	if Touch(c.local, key, c.localTTL(expires)) != nil {
+		c.local.Delete(key)
+	}
+	return nil
+}
+
+// Flush (see CacheStore interface)
+func (c *TieredStore) Flush() error {
+	err := c.remote.Flush()
+	c.local.Flush()
+	c.announce("")
+	return err
+}
+
+// invalidate drops key from the local tier of every instance
+func (c *TieredStore) invalidate(key string) {
+	c.local.Delete(key)
+	c.announce(key)
+}
+
+func (c *TieredStore) announce(key string) {
+	if c.invalidator != nil {
+		c.invalidator.Invalidate(key)
+	}
+}
+
+// localTTL returns the expiration of the local copy of an item stored with
+// expires, which is never longer than localExpiration
+func (c *TieredStore) localTTL(expires time.Duration) time.Duration {
+	if expires > 0 && expires < c.localExpiration {
+		return expires
+	}
+	return c.localExpiration
+}
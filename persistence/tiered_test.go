@@ -0,0 +1,119 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+var newTieredStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
+	// keep the local copies shorter than the expirations of the tests
+	return NewTieredStore(NewInMemoryStore(time.Hour), NewBoundedStore(BoundedOptions{}, defaultExpiration), 500*time.Millisecond)
+}
+
+func TestTieredCache_LocalTier(t *testing.T) {
+	remote := NewInMemoryStore(time.Hour)
+	cache := NewTieredStore(NewInMemoryStore(time.Hour), remote, time.Second)
+
+	// remote hits are copied to the local tier...
+	remote.Set("key", "value", DEFAULT)
+	var value string
+	if err := cache.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected to get value from the remote tier, got %q, %v", value, err)
+	}
+	remote.Delete("key")
+	if err := cache.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected to get value from the local tier, got %q, %v", value, err)
+	}
+
+	// ...for at most the local expiration
+	time.Sleep(1100 * time.Millisecond)
+	if err := cache.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected the local copy to expire, got: %v", err)
+	}
+
+	// writes go to both tiers
+	if err := cache.Set("key", "other", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := remote.Get("key", &value); err != nil || value != "other" {
+		t.Errorf("Expected the remote tier to be written, got %q, %v", value, err)
+	}
+	remote.Delete("key")
+	if err := cache.Get("key", &value); err != nil || value != "other" {
+		t.Errorf("Expected the local tier to be written, got %q, %v", value, err)
+	}
+}
+
+// hookedStore calls before ahead of every Delete
+type hookedStore struct {
+	CacheStore
+	before func()
+}
+
+func (s *hookedStore) Delete(key string) error {
+	s.before()
+	return s.CacheStore.Delete(key)
+}
+
+func TestTieredCache_DeleteRace(t *testing.T) {
+	local := NewInMemoryStore(time.Hour)
+	remote := &hookedStore{CacheStore: NewInMemoryStore(time.Hour)}
+	cache := NewTieredStore(local, remote, time.Minute)
+	cache.Set("key", "value", DEFAULT)
+
+	// a Get running while the remote tier deletes the item
+	var value string
+	remote.before = func() { cache.Get("key", &value) }
+	if err := cache.Delete("key"); err != nil {
+		t.Fatalf("Error deleting a value: %s", err)
+	}
+	if err := cache.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected the deleted item to stay deleted, got %q, %v", value, err)
+	}
+}
+
+func TestTieredCache_RedisInvalidation(t *testing.T) {
+	server := newFakeRedis(t)
+	defer server.Close()
+	remote := NewInMemoryStore(time.Hour)
+	newInstance := func() *TieredStore {
+		invalidator := NewRedisInvalidator(server.Addr(), RedisOptions{}, "invalidations")
+		t.Cleanup(func() { invalidator.Close() })
+		return NewTieredStoreWithInvalidator(NewInMemoryStore(time.Hour), remote, time.Hour, invalidator)
+	}
+	a, b := newInstance(), newInstance()
+	waitForSubscribers(t, server, "invalidations", 2)
+
+	var value string
+	a.Set("key", "v1", DEFAULT)
+	b.Get("key", &value)
+
+	a.Set("key", "v2", DEFAULT)
+	eventually(t, func() bool {
+		return b.Get("key", &value) == nil && value == "v2"
+	}, "Expected the local copy of b to be invalidated by a Set")
+
+	a.Delete("key")
+	eventually(t, func() bool {
+		return b.Get("key", &value) == ErrCacheMiss
+	}, "Expected the local copy of b to be invalidated by a Delete")
+}
+
+func waitForSubscribers(t *testing.T, server *fakeRedis, channel string, n int) {
+	eventually(t, func() bool {
+		server.mu.Lock()
+		defer server.mu.Unlock()
+		return len(server.subscribers[channel]) == n
+	}, "Expected %d subscribers", n)
+}
+
+// eventually polls condition for a second, reporting failure with format and
+// args if it never holds
+func eventually(t *testing.T, condition func() bool, format string, args ...interface{}) {
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Errorf(format, args...)
+			return
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShouldCacheRequest tells whether the response to a request may be served
+// from the cache and cached. Requests it turns down go straight to the
+// handler, with the X-Cache-Status header set to BYPASS.
+type ShouldCacheRequest func(c *gin.Context) bool
+
+// ShouldCacheResponse tells whether a response may be cached, from its status
+// code, its headers and its body. The body is nil for the responses larger
+// than the chunk size, which are never held in full: use WithMaxBodySize to
+// limit the size of the cached responses.
+type ShouldCacheResponse func(status int, header http.Header, body []byte) bool
+
+// WithShouldCacheRequest adds predicates that every request must satisfy to be
+// served from the cache, like NoAuthorization
+func WithShouldCacheRequest(predicates ...ShouldCacheRequest) Option {
+	return func(cfg *pageConfig) {
+		cfg.requestPredicates = append(cfg.requestPredicates, predicates...)
+	}
+}
+
+// WithShouldCacheResponse adds predicates that every response must satisfy to
+// be cached, like NoSetCookie
+func WithShouldCacheResponse(predicates ...ShouldCacheResponse) Option {
+	return func(cfg *pageConfig) {
+		cfg.responsePredicates = append(cfg.responsePredicates, predicates...)
+	}
+}
+
+// WithMaxBodySize doesn't cache the responses whose body is larger than size
+// bytes. They are given up as soon as they grow past size, before their chunks
+// are stored.
+func WithMaxBodySize(size int64) Option {
+	return func(cfg *pageConfig) {
+		cfg.maxBodySize = size
+	}
+}
+
+func (cfg *pageConfig) shouldCacheRequest(c *gin.Context) bool {
+	for _, predicate := range cfg.requestPredicates {
+		if !predicate(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (cfg *pageConfig) shouldCacheResponse(status int, header http.Header, body []byte) bool {
+	for _, predicate := range cfg.responsePredicates {
+		if !predicate(status, header, body) {
+			return false
+		}
+	}
+	return true
+}
+
+// NoAuthorization turns down the requests carrying credentials, whose
+// responses may depend on the user
+func NoAuthorization(c *gin.Context) bool {
+	return c.GetHeader("Authorization") == ""
+}
+
+// NoQueryFlag turns down the requests setting the query parameter name, like
+// ?preview or ?preview=1. The flag is off when its value is false for
+// strconv.ParseBool.
+func NoQueryFlag(name string) ShouldCacheRequest {
+	return func(c *gin.Context) bool {
+		values, ok := c.Request.URL.Query()[name]
+		if !ok {
+			return true
+		}
+		flag, err := strconv.ParseBool(values[0])
+		return err == nil && !flag
+	}
+}
+
+// NoSetCookie turns down the responses setting a cookie, which belong to a
+// single client
+func NoSetCookie(status int, header http.Header, body []byte) bool {
+	return header.Get("Set-Cookie") == ""
+}
+
+// NotContentType turns down the responses with one of the media types given,
+// like "text/event-stream". A type may end with /* to match all its subtypes.
+func NotContentType(types ...string) ShouldCacheResponse {
+	return func(status int, header http.Header, body []byte) bool {
+		mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+		if err != nil {
+			return true
+		}
+		for _, t := range types {
+			t = strings.ToLower(t)
+			if t == mediaType || strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, t[:len(t)-1]) {
+				return false
+			}
+		}
+		return true
+	}
+}
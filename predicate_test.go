@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePageShouldCacheRequest(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+
+	router := gin.New()
+	router.GET("/cache_request", CachePage(store, time.Minute, func(c *gin.Context) {
+		c.String(200, fmt.Sprint(time.Now().UnixNano()))
+	}, WithShouldCacheRequest(NoAuthorization, NoQueryFlag("preview"))))
+
+	w1 := performRequest("GET", "/cache_request", router)
+	assert.Equal(t, "MISS", w1.Header().Get("X-Cache-Status"))
+
+	r := httptest.NewRequest("GET", "/cache_request", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	w2 := httptest.NewRecorder()
+	router.ServeHTTP(w2, r)
+	assert.Equal(t, "BYPASS", w2.Header().Get("X-Cache-Status"))
+	assert.NotEqual(t, w1.Body.String(), w2.Body.String())
+
+	w3 := performRequest("GET", "/cache_request?preview=1", router)
+	assert.Equal(t, "BYPASS", w3.Header().Get("X-Cache-Status"))
+
+	// the requests bypassing the cache left the cached page alone
+	w4 := performRequest("GET", "/cache_request", router)
+	assert.Equal(t, "HIT", w4.Header().Get("X-Cache-Status"))
+	assert.Equal(t, w1.Body.String(), w4.Body.String())
+}
+
+func TestCachePageShouldCacheResponse(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+
+	router := gin.New()
+	router.GET("/cache_response/:kind", CachePage(store, time.Minute, func(c *gin.Context) {
+		switch c.Param("kind") {
+		case "cookie":
+			c.SetCookie("session", "id", 0, "/", "", false, true)
+		case "events":
+			c.Header("Content-Type", "text/event-stream")
+		case "large":
+			c.String(200, strings.Repeat("x", 100))
+		}
+		c.String(200, fmt.Sprint(time.Now().UnixNano()))
+	}, WithShouldCacheResponse(NoSetCookie, NotContentType("text/event-stream")), WithMaxBodySize(64)))
+
+	for _, test := range []struct {
+		path   string
+		cached bool
+	}{
+		{"/cache_response/plain", true},
+		{"/cache_response/cookie", false},
+		{"/cache_response/events", false},
+		{"/cache_response/large", false},
+	} {
+		performRequest("GET", test.path, router)
+		w := performRequest("GET", test.path, router)
+		assert.Equal(t, test.cached, w.Header().Get("X-Cache-Status") == "HIT", test.path)
+	}
+}
+
+func TestCachePageMaxBodySizeChunked(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+
+	router := gin.New()
+	router.GET("/cache_large", CachePage(store, time.Minute, func(c *gin.Context) {
+		for i := 0; i < 10; i++ {
+			c.Writer.WriteString(strings.Repeat("x", 100))
+		}
+	}, WithChunkSize(100), WithMaxBodySize(500)))
+
+	w := performRequest("GET", "/cache_large", router)
+	assert.Equal(t, 1000, w.Body.Len())
+
+	// the chunks stored before the response grew too large were dropped
+	for i := 0; i < 10; i++ {
+		var chunk responseChunk
+		assert.Equal(t, persistence.ErrCacheMiss, store.Get(chunkKey(CreateKey("/cache_large"), i), &chunk))
+	}
+	w = performRequest("GET", "/cache_large", router)
+	assert.Equal(t, "MISS", w.Header().Get("X-Cache-Status"))
+}
+
+func TestNoQueryFlag(t *testing.T) {
+	predicate := NoQueryFlag("preview")
+	for query, expected := range map[string]bool{
+		"":                true,
+		"?page=2":         true,
+		"?preview":        false,
+		"?preview=1":      false,
+		"?preview=true":   false,
+		"?preview=false":  true,
+		"?preview=0&page": true,
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/"+query, nil)
+		assert.Equal(t, expected, predicate(c), query)
+	}
+}
+
+func TestNotContentType(t *testing.T) {
+	predicate := NotContentType("text/event-stream", "image/*")
+	for contentType, expected := range map[string]bool{
+		"":                         true,
+		"text/html; charset=utf-8": true,
+		"text/event-stream":        false,
+		"Text/Event-Stream":        false,
+		"image/png":                false,
+		"application/octet-stream": true,
+		"imagex/png":               true,
+	} {
+		header := http.Header{}
+		header.Set("Content-Type", contentType)
+		assert.Equal(t, expected, predicate(200, header, nil), contentType)
+	}
+}
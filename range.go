@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+)
+
+// httpRange is a range of the body asked for by a range request
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+var (
+	errInvalidRange       = errors.New("cache: invalid range")
+	errUnsatisfiableRange = errors.New("cache: unsatisfiable range")
+)
+
+// serveCachedBody writes the body of a cached response, or the ranges of it a
+// range request asks for. Ranges are served for GET requests on 200
+// responses, provided If-Range matches the ETag or the Last-Modified header of
+// the entry. Invalid ranges are ignored, like ranges asking for more than the
+// whole body.
+func serveCachedBody(c *gin.Context, store persistence.CacheStore, key string, cache *responseCache) {
+	if cache.Status != http.StatusOK || c.Request.Method != http.MethodGet {
+		writeCachedBody(c, store, key, cache)
+		return
+	}
+	header := c.Writer.Header()
+	header.Set("Accept-Ranges", "bytes")
+	spec := c.Request.Header.Get("Range")
+	if spec == "" || !ifRangeMatches(c.Request.Header.Get("If-Range"), cache.Header) {
+		writeCachedBody(c, store, key, cache)
+		return
+	}
+
+	size := cache.size()
+	ranges, err := parseRange(spec, size)
+	switch {
+	case err == errUnsatisfiableRange:
+		header.Del("Content-Length")
+		header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		c.Writer.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+	case err != nil || rangesLength(ranges) > size:
+		writeCachedBody(c, store, key, cache)
+	case len(ranges) == 1:
+		r := ranges[0]
+		header.Set("Content-Range", r.contentRange(size))
+		header.Set("Content-Length", strconv.FormatInt(r.length, 10))
+		c.Writer.WriteHeader(http.StatusPartialContent)
+		writeCachedRange(c, c.Writer, store, key, cache, r.start, r.start+r.length)
+	default:
+		contentType := cache.Header.Get("Content-Type")
+		w := multipart.NewWriter(c.Writer)
+		header.Del("Content-Length")
+		header.Set("Content-Type", "multipart/byteranges; boundary="+w.Boundary())
+		c.Writer.WriteHeader(http.StatusPartialContent)
+		for _, r := range ranges {
+			partHeader := textproto.MIMEHeader{"Content-Range": {r.contentRange(size)}}
+			if contentType != "" {
+				partHeader.Set("Content-Type", contentType)
+			}
+			part, err := w.CreatePart(partHeader)
+			if err != nil {
+				return
+			}
+			writeCachedRange(c, part, store, key, cache, r.start, r.start+r.length)
+		}
+		w.Close()
+	}
+}
+
+// ifRangeMatches tells whether the If-Range header of a request, which may be
+// empty, validates the entry with headers. Entity tags are compared with the
+// strong comparison, and dates must match Last-Modified exactly.
+func ifRangeMatches(ifRange string, headers http.Header) bool {
+	switch {
+	case ifRange == "":
+		return true
+	case strings.HasPrefix(ifRange, `"`), strings.HasPrefix(ifRange, "W/"):
+		etag := headers.Get("ETag")
+		return strings.HasPrefix(etag, `"`) && etag == ifRange
+	}
+	lastModified := headers.Get("Last-Modified")
+	return lastModified != "" && lastModified == ifRange
+}
+
+// parseRange parses the Range header of a request for a body of size bytes.
+// Ranges beyond the end of the body are left out, and errUnsatisfiableRange
+// is returned when none is left.
+func parseRange(spec string, size int64) ([]httpRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(spec, prefix) {
+		return nil, errInvalidRange
+	}
+	var ranges []httpRange
+	unsatisfiable := false
+	for _, part := range strings.Split(spec[len(prefix):], ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, "-")
+		if i < 0 {
+			return nil, errInvalidRange
+		}
+		first, last := strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+		var r httpRange
+		if first == "" {
+			// the last bytes of the body
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n = min(n, size); n == 0 {
+				unsatisfiable = true
+				continue
+			}
+			r = httpRange{size - n, n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				end = min(end, size-1)
+			}
+			if start >= size {
+				unsatisfiable = true
+				continue
+			}
+			r = httpRange{start, end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+	if len(ranges) == 0 && unsatisfiable {
+		return nil, errUnsatisfiableRange
+	}
+	if len(ranges) == 0 {
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+func rangesLength(ranges []httpRange) int64 {
+	var length int64
+	for _, r := range ranges {
+		length += r.length
+	}
+	return length
+}
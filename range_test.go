@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const rangeBody = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func newRangeRouter(store persistence.CacheStore, opts ...Option) *gin.Engine {
+	router := gin.New()
+	router.GET("/file", CachePage(store, time.Minute, func(c *gin.Context) {
+		// ServeContent answers range requests on its own
+		c.Header("ETag", `"v1"`)
+		c.Header("Content-Type", "text/plain")
+		http.ServeContent(c.Writer, c.Request, "", time.Time{}, strings.NewReader(rangeBody))
+	}, opts...))
+	return router
+}
+
+func performRangeRequest(router *gin.Engine, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/file", nil)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestCachePageRange(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+	router := newRangeRouter(store)
+
+	// the miss is rendered in full, to be cached
+	w := performRangeRequest(router, map[string]string{"Range": "bytes=0-4"})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, rangeBody, w.Body.String())
+
+	w = performRangeRequest(router, map[string]string{"Range": "bytes=0-4"})
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "HIT", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "01234", w.Body.String())
+	assert.Equal(t, "bytes 0-4/36", w.Header().Get("Content-Range"))
+	assert.Equal(t, "5", w.Header().Get("Content-Length"))
+
+	w = performRangeRequest(router, map[string]string{"Range": "bytes=-3"})
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "xyz", w.Body.String())
+	assert.Equal(t, "bytes 33-35/36", w.Header().Get("Content-Range"))
+
+	w = performRangeRequest(router, map[string]string{"Range": "bytes=30-"})
+	assert.Equal(t, "uvwxyz", w.Body.String())
+
+	w = performRangeRequest(router, map[string]string{"Range": "bytes=40-50"})
+	assert.Equal(t, 416, w.Code)
+	assert.Equal(t, "bytes */36", w.Header().Get("Content-Range"))
+
+	w = performRangeRequest(router, map[string]string{"Range": "lines=1-2"})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, rangeBody, w.Body.String())
+	assert.Equal(t, "bytes", w.Header().Get("Accept-Ranges"))
+}
+
+func TestCachePageMultiRange(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+	router := newRangeRouter(store)
+
+	performRangeRequest(router, nil)
+	w := performRangeRequest(router, map[string]string{"Range": "bytes=0-1, 10-12"})
+	assert.Equal(t, 206, w.Code)
+
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	for _, expected := range []struct{ body, contentRange string }{
+		{"01", "bytes 0-1/36"},
+		{"abc", "bytes 10-12/36"},
+	} {
+		part, err := reader.NextPart()
+		if !assert.Nil(t, err) {
+			return
+		}
+		body, _ := io.ReadAll(part)
+		assert.Equal(t, expected.body, string(body))
+		assert.Equal(t, expected.contentRange, part.Header.Get("Content-Range"))
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+	}
+	_, err = reader.NextPart()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestCachePageIfRange(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+	router := newRangeRouter(store)
+
+	performRangeRequest(router, nil)
+	w := performRangeRequest(router, map[string]string{"Range": "bytes=0-4", "If-Range": `"v1"`})
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "01234", w.Body.String())
+
+	// a stale validator gets the whole body
+	w = performRangeRequest(router, map[string]string{"Range": "bytes=0-4", "If-Range": `"v0"`})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, rangeBody, w.Body.String())
+
+	w = performRangeRequest(router, map[string]string{"Range": "bytes=0-4", "If-Range": "Mon, 02 Jan 2006 15:04:05 GMT"})
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestCachePageRangeChunked(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+	body := bytes.Repeat([]byte(rangeBody), 100)
+
+	router := gin.New()
+	router.GET("/file", CachePage(store, time.Minute, func(c *gin.Context) {
+		c.Data(200, "application/octet-stream", body)
+	}, WithChunkSize(1000)))
+
+	performRangeRequest(router, nil)
+	// a range across three chunks
+	w := performRangeRequest(router, map[string]string{"Range": "bytes=990-2010"})
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, string(body[990:2011]), w.Body.String())
+	assert.Equal(t, "bytes 990-2010/3600", w.Header().Get("Content-Range"))
+
+	w = performRangeRequest(router, map[string]string{"Range": "bytes=-100"})
+	assert.Equal(t, string(body[3500:]), w.Body.String())
+}
+
+func TestParseRange(t *testing.T) {
+	for _, test := range []struct {
+		spec   string
+		ranges []httpRange
+		err    error
+	}{
+		{"bytes=0-9", []httpRange{{0, 10}}, nil},
+		{"bytes=5-", []httpRange{{5, 5}}, nil},
+		{"bytes=-4", []httpRange{{6, 4}}, nil},
+		{"bytes=-20", []httpRange{{0, 10}}, nil},
+		{"bytes=8-20", []httpRange{{8, 2}}, nil},
+		{"bytes=0-0, 2-3,", []httpRange{{0, 1}, {2, 2}}, nil},
+		{"bytes=0-1, 20-30", []httpRange{{0, 2}}, nil},
+		{"bytes=10-", nil, errUnsatisfiableRange},
+		{"bytes=-0", nil, errUnsatisfiableRange},
+		{"bytes=5-1", nil, errInvalidRange},
+		{"bytes=a-b", nil, errInvalidRange},
+		{"bytes=", nil, errInvalidRange},
+		{"items=0-1", nil, errInvalidRange},
+	} {
+		ranges, err := parseRange(test.spec, 10)
+		assert.Equal(t, test.err, err, test.spec)
+		assert.Equal(t, test.ranges, ranges, test.spec)
+	}
+}
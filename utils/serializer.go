@@ -7,6 +7,21 @@ import (
 	"strconv"
 )
 
+// SerializationError is returned by Serialize and Deserialize when a value
+// can't be encoded, or decoded into the passed ptr
+type SerializationError struct {
+	Err error
+}
+
+func (e *SerializationError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error of the encoding
+func (e *SerializationError) Unwrap() error {
+	return e.Err
+}
+
 // Serialize returns a []byte representing the passed value
 func Serialize(value interface{}) ([]byte, error) {
 	if bytes, ok := value.([]byte); ok {
@@ -23,7 +38,7 @@ func Serialize(value interface{}) ([]byte, error) {
 	var b bytes.Buffer
 	encoder := gob.NewEncoder(&b)
 	if err := encoder.Encode(value); err != nil {
-		return nil, err
+		return nil, &SerializationError{err}
 	}
 	return b.Bytes(), nil
 }
@@ -41,7 +56,7 @@ func Deserialize(byt []byte, ptr interface{}) (err error) {
 			var i int64
 			i, err = strconv.ParseInt(string(byt), 10, 64)
 			if err != nil {
-				return err
+				return &SerializationError{err}
 			}
 
 			p.SetInt(i)
@@ -51,7 +66,7 @@ func Deserialize(byt []byte, ptr interface{}) (err error) {
 			var i uint64
 			i, err = strconv.ParseUint(string(byt), 10, 64)
 			if err != nil {
-				return err
+				return &SerializationError{err}
 			}
 
 			p.SetUint(i)
@@ -62,7 +77,7 @@ func Deserialize(byt []byte, ptr interface{}) (err error) {
 	b := bytes.NewBuffer(byt)
 	decoder := gob.NewDecoder(b)
 	if err = decoder.Decode(ptr); err != nil {
-		return err
+		return &SerializationError{err}
 	}
 	return nil
 }